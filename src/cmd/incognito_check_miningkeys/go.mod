@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.4
+	github.com/prometheus/client_golang v1.9.0
 	github.com/robotrongt/incognito_node_bot/src/models v0.0.0-00010101000000-000000000000
 )
 
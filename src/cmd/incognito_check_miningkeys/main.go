@@ -1,53 +1,186 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"math/rand"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/robotrongt/incognito_node_bot/src/models"
 )
 
 func main() {
-	env := models.NewEnv()
+	configFlags := models.NewConfigFlags()
+	intervalPtr := flag.Duration("interval", 0, "repeat the check every interval (0 runs a single check and exits)")
+	metricsAddrPtr := flag.String("metrics", "", "address where /metrics is exposed while looping (default metrics_addr from config, empty disables)")
+	exporterPtr := flag.Bool("exporter", false, "also export validator and beacon state gauges on /metrics (needs -interval)")
+	flag.Parse()
+	env := models.NewEnv(configFlags.Load())
 	defer env.Db.DB.Close()
 	defer log.Println("Exiting...")
 	defer log.Printf("%T %T\n", env.Db, env.Db.DB)
+	metricsAddr := env.METRICS_ADDR
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "metrics" {
+			metricsAddr = *metricsAddrPtr
+		}
+	})
+
+	if err := env.Db.CreateTablesIfNotExists(); err != nil {
+		log.Fatal(err)
+	}
 
 	rand.Seed(time.Now().UnixNano())
 
-	var miningkeys *[]models.MiningKey
-	var err error
-	miningkeys, err = env.Db.GetMiningKeys(100, 0)
-	if err != nil {
-		log.Fatal(err)
+	var exporter *models.ValidatorExporter
+	if *intervalPtr <= 0 {
+		if *exporterPtr {
+			log.Println("-exporter ignored without -interval")
+		}
+		checkMiningKeys(env, exporter)
+		return
+	}
+	if *exporterPtr {
+		exporter = models.NewValidatorExporter()
+		prometheus.MustRegister(exporter)
+	}
+	models.ServeMetrics(metricsAddr)
+	for {
+		checkMiningKeys(env, exporter)
+		time.Sleep(*intervalPtr)
+	}
+}
+
+//esegue un ciclo di controllo di tutte le chiavi di mining e ne registra esito, durata e totali,
+//se exporter non è nil gli passa lo stato dei validatori e del beacon letto nel ciclo
+func checkMiningKeys(env *models.Env, exporter *models.ValidatorExporter) {
+	start := time.Now()
+	cc := &models.CheckCycle{Timestamp: models.MakeTSFromTime(start), Outcome: models.CheckOutcomeOK}
+	defer func() {
+		cc.Duration = time.Since(start).Seconds()
+		models.ObserveCheckCycle(start, cc.Outcome)
+		env.Db.AddCheckCycle(cc)
+		log.Printf("Check cycle: %s checked %d changed %d failed %d in %.3fs\n", cc.Outcome, cc.Keys, cc.Changed, cc.Failed, cc.Duration)
+	}()
+
+	env.ProbeEndpoints()
+	if err := env.RefreshTokens(); err != nil {
+		log.Println("error RefreshTokens:", err)
 	}
-	theUrl := env.DEFAULT_NODE_URL
 	bbsd := models.BBSD{}
-	if err := models.GetBeaconBestStateDetail(theUrl, &bbsd); err != nil {
+	if err := env.GetBeaconBestStateDetail(&bbsd); err != nil {
 		log.Println("error getBeaconBestStateDetail:", err)
+		cc.Outcome = models.CheckOutcomeRPCError
 		return
 	}
-	for _, miningkey := range *miningkeys {
-		status, pki := models.GetPubKeyStatus(&bbsd, miningkey.PubKey)
-		mk := &models.MiningKey{
-			PubKey:     miningkey.PubKey,
-			LastStatus: status,
+	if err := env.Db.RecordCommittees(&bbsd); err != nil {
+		log.Println("error RecordCommittees:", err)
+	}
+	validators := []models.ValidatorState{}
+	err := env.Db.ForEachMiningKeysPage(env.CHECK_KEYS_LIMIT, func(page []models.MiningKey) error {
+		for _, res := range checkPage(env, &bbsd, page) {
+			cc.Keys++
+			if res.changed {
+				cc.Changed++
+			}
+			if res.outcome != models.CheckOutcomeOK {
+				cc.Failed++
+				cc.Outcome = res.outcome
+			}
+			if exporter != nil {
+				validators = append(validators, res.vs)
+			}
 		}
-		if pki != nil { //abbiamo info della chiave
-			mk.LastPRV = pki.PRV
-			mk.IsAutoStake = pki.IsAutoStake
-			mk.Bls = pki.MiningPubKey.Bls
-			mk.Dsa = pki.MiningPubKey.Dsa
-			mrfmk := models.MRFMK{}
-			err := models.GetMinerRewardFromMiningKey(env.DEFAULT_FULLNODE_URL, "bls:"+mk.Bls, &mrfmk)
-			if err == nil { //no err, abbiamo anche i Saldi
-				mk.LastPRV = mrfmk.Result.GetPRV()
-			} else { //non abbiamo i PRV
-				mk.LastPRV = -1 //segnaliamo che non è da aggiornare
+		return nil
+	})
+	if err != nil {
+		log.Println("error ForEachMiningKeysPage:", err)
+		cc.Outcome = models.CheckOutcomeDBError
+	}
+	if exporter != nil {
+		exporter.Update(&bbsd.Result, validators)
+	}
+	checked, down := env.CheckUrlNodes()
+	log.Printf("Checked %d nodes, %d down\n", checked, down)
+	env.FlushNotifyQueue(int64(bbsd.Result.Epoch))
+}
+
+//esito del controllo di una chiave
+type keyResult struct {
+	vs      models.ValidatorState
+	changed bool   //notificato cambio di stato, di reward o perdita dell'autostake
+	outcome string //CheckOutcomeOK se la chiave è stata aggiornata con i suoi reward
+}
+
+//controlla una pagina di chiavi con al massimo CHECK_WORKERS chiavi in parallelo,
+//i risultati sono nello stesso ordine della pagina
+func checkPage(env *models.Env, bbsd *models.BBSD, page []models.MiningKey) []keyResult {
+	blsKeys := []string{}
+	for _, miningkey := range page {
+		if _, pki := models.GetPubKeyStatus(bbsd, miningkey.PubKey); pki != nil {
+			blsKeys = append(blsKeys, pki.MiningPubKey.Bls)
+		}
+	}
+	rewards := env.GetMinerRewards(blsKeys)
+	results := make([]keyResult, len(page))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < env.CHECK_WORKERS && w < len(page); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = checkKey(env, bbsd, rewards, page[i].PubKey)
 			}
+		}()
+	}
+	for i := range page {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+//aggiorna la chiave con lo stato del beacon ed i reward letti, notificando i cambiamenti
+func checkKey(env *models.Env, bbsd *models.BBSD, rewards map[string]models.TMinerReward, pubkey string) keyResult {
+	res := keyResult{outcome: models.CheckOutcomeOK}
+	status, pki := models.GetPubKeyStatus(bbsd, pubkey)
+	res.vs = models.ValidatorState{PubKey: pubkey}
+	res.vs.Role, res.vs.Shard = models.GetPubKeyRole(bbsd, pubkey)
+	mk := &models.MiningKey{
+		PubKey:        pubkey,
+		LastStatus:    status,
+		InAutoStaking: bbsd.InAutoStaking(pubkey),
+	}
+	if pki != nil { //abbiamo info della chiave
+		mk.LastPRV = pki.PRV
+		mk.IsAutoStake = pki.IsAutoStake
+		mk.Bls = pki.MiningPubKey.Bls
+		mk.Dsa = pki.MiningPubKey.Dsa
+		if reward, ok := rewards[mk.Bls]; ok { //abbiamo anche i Saldi
+			mk.LastPRV = reward.GetPRV()
+			res.vs.Rewards = reward
+		} else { //non abbiamo i PRV
+			mk.LastPRV = -1 //segnaliamo che non è da aggiornare
+			res.outcome = models.CheckOutcomeRPCError
 		}
-		env.Db.UpdateMiningKey(mk, models.StatusChangeNotifierFunc(env.StatusChanged))
 	}
+	res.vs.IsAutoStake = mk.IsAutoStake
+	statusChanged := func(miningkey *models.MiningKey, oldstatus string, oldprv int64) error {
+		res.changed = true
+		return env.StatusChanged(miningkey, oldstatus, oldprv)
+	}
+	autoStakeLost := func(miningkey *models.MiningKey, disappeared bool) error {
+		res.changed = true
+		return env.AutoStakeLost(miningkey, disappeared)
+	}
+	if err := env.Db.UpdateMiningKey(mk, statusChanged, autoStakeLost); err != nil {
+		log.Println("error UpdateMiningKey:", err)
+		res.outcome = models.CheckOutcomeDBError
+	}
+	return res
 }
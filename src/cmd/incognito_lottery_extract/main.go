@@ -68,41 +68,20 @@ type BtcBlock struct {
 }
 
 func main() {
-	env := models.NewEnv()
+	configFlags := models.NewConfigFlags()
+	noBtcClientPtr := flag.Bool("noBtcClient", false, "skip checking btc blockchain for nonce")
+	flag.Parse()
+	env := models.NewEnv(configFlags.Load())
 	defer env.Db.DB.Close()
 	defer log.Println("Exiting...")
 	defer log.Printf("%T %T\n", env.Db, env.Db.DB)
 
-	noBtcClientPtr := flag.Bool("noBtcClient", false, "skip checking btc blockchain for nonce")
-	flag.Parse()
-
 	rand.Seed(time.Now().UnixNano())
 
-	tmNow := time.Now() //prendiamo data attuale
-	//per l'estrazione prendiamo il primo blocco BTC dopo mezzanotte ora locale
-	//del primo del mese
-	tmExtract := time.Date(tmNow.Year(), tmNow.Month(), 1, 0, 0, 0, 0, tmNow.Location())
-	tmTickets := tmExtract.AddDate(0, 0, -1)
-	tsExtract := models.MakeTSFromTime(tmExtract)
-	btcblock := BtcBlock{}
-	useDbNonce := false
-	tmTicketsStr := fmt.Sprintf("%s-%s", strconv.Itoa(tmTickets.Year()), strconv.Itoa(int(tmTickets.Month())))
 	if *noBtcClientPtr { //we want the nonce from db
-		useDbNonce = true
 		log.Printf("noBtcClient: %t\n", *noBtcClientPtr)
-	} else {
-		if nonce, blockHeight, btcts, err := getNonce(tmExtract); err == nil {
-			btcblock = BtcBlock{Nonce: nonce, Height: blockHeight, Timestamp: btcts}
-			log.Println("tmExtract:", tmExtract)
-			log.Println("tsExtract:", tsExtract)
-			log.Println("blockHeight:", blockHeight)
-			log.Println("btcts:", btcts, models.GetTSTime(btcts))
-			log.Println("nonce:", nonce)
-		} else {
-			log.Println("error searching btc block and nonce:", err)
-			useDbNonce = true
-		}
 	}
+	btcblocks := map[int64]BtcBlock{} //blocchi btc già cercati per timestamp di estrazione
 	lotteries, err := env.Db.GetLotteries()
 	if err != nil {
 		log.Println("Err in GetLotteries:", err)
@@ -110,6 +89,31 @@ func main() {
 	}
 	for _, lottery := range lotteries {
 		log.Println("Lottery:", lottery)
+		tmNow := time.Now().In(lottery.Location()) //prendiamo data attuale nel fuso della lotteria
+		//per l'estrazione prendiamo il primo blocco BTC dopo mezzanotte ora della lotteria
+		//del primo del mese
+		tmExtract := time.Date(tmNow.Year(), tmNow.Month(), 1, 0, 0, 0, 0, tmNow.Location())
+		tmTickets := tmExtract.AddDate(0, 0, -1)
+		tsExtract := models.MakeTSFromTime(tmExtract)
+		btcblock := BtcBlock{}
+		useDbNonce := *noBtcClientPtr
+		tmTicketsStr := fmt.Sprintf("%s-%s", strconv.Itoa(tmTickets.Year()), strconv.Itoa(int(tmTickets.Month())))
+		if !useDbNonce {
+			if cached, ok := btcblocks[tsExtract]; ok {
+				btcblock = cached
+			} else if nonce, blockHeight, btcts, err := getNonce(tmExtract); err == nil {
+				btcblock = BtcBlock{Nonce: nonce, Height: blockHeight, Timestamp: btcts}
+				btcblocks[tsExtract] = btcblock
+				log.Println("tmExtract:", tmExtract)
+				log.Println("tsExtract:", tsExtract)
+				log.Println("blockHeight:", blockHeight)
+				log.Println("btcts:", btcts, models.GetTSTime(btcts))
+				log.Println("nonce:", nonce)
+			} else {
+				log.Println("error searching btc block and nonce:", err)
+				useDbNonce = true
+			}
+		}
 
 		var lotteryextraction models.LotteryExtraction
 		var err error
@@ -199,9 +203,10 @@ func main() {
 			continue
 		}
 		for _, lotterychat := range lotterychats {
+			chatLoc := env.Db.GetChatLocation(lotterychat.ChatID)
 			//vediamo se la chat vuole essere notificata
 			chatuser, err := env.Db.GetUserByChatID(lotterychat.ChatID)
-			if !chatuser.Notify {
+			if !env.Db.WantsNotify(lotterychat.ChatID, winner.PubKey, models.EventLotteryDraw, 0) {
 				log.Println("Skipping notify ChatUser:", chatuser.Name)
 				continue
 			}
@@ -213,13 +218,13 @@ func main() {
 			}
 			msg := fmt.Sprintf("Hello %s, in lottery %s the winner of %s is...", chatuser.Name, lottery.LotteryName, tmTicketsStr)
 			msg = fmt.Sprintf("%s\n%s", msg, " 🥳🎊🎉 🥳🎊🎉")
-			msg = fmt.Sprintf("%s\n%s %s %s", msg, thealias, models.GetTSString(winner.Timestamp), flag)
+			msg = fmt.Sprintf("%s\n%s %s %s", msg, thealias, models.GetTSStringIn(winner.Timestamp, chatLoc), flag)
 			msg = fmt.Sprintf("%s\n%s", msg, " 🥳🎊🎉 🥳🎊🎉")
-			msg = fmt.Sprintf("%s\nThe seed of the extraction is taken from blockchain block height %d (%s)", msg, btcblock.Height, models.GetTSString(btcblock.Timestamp))
+			msg = fmt.Sprintf("%s\nThe seed of the extraction is taken from blockchain block height %d (%s)", msg, btcblock.Height, models.GetTSStringIn(btcblock.Timestamp, chatLoc))
 			msg = fmt.Sprintf("%s\nNonce: %d", msg, btcblock.Nonce)
 			msg = fmt.Sprintf("%s\nYou can verify it here: https://www.blockchain.com/btc/block/%d", msg, btcblock.Height)
 			msg = fmt.Sprintf("%s\nAnd this is a sample code to test https://play.golang.org/p/WDF3-Eoh_l7", msg)
-			if err := env.SayText(lotterychat.ChatID, msg); err != nil {
+			if err := env.DeliverNotify(lotterychat.ChatID, models.EventLotteryDraw, msg); err != nil {
 				log.Println("Error sending msg:", msg)
 			}
 		}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+//ritorna vero se la chat è admin, altrimenti avvisa la chat e ritorna falso
+func (env MyEnv) checkAdmin(chatUser *models.ChatUser) bool {
+	if chatUser != nil && chatUser.IsAdmin {
+		return true
+	}
+	if chatUser != nil {
+		log.Println("admin command refused for chat:", chatUser.ChatID)
+		if err := env.SayText(chatUser.ChatID, "Mi spiace, comando riservato agli admin."); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	return false
+}
+
+// /stats: contatori del bot ed ultimo ciclo di controllo
+func (env MyEnv) cmdStats(chatID int64) {
+	stats, err := env.Db.GetStats()
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	messaggio := fmt.Sprintf("Users: %d (notify on: %d)\nChat keys: %d\nMining keys: %d\nNodes: %d\nLotteries: %d",
+		stats.Users, stats.Notifiers, stats.ChatKeys, stats.MiningKeys, stats.Nodes, stats.Lotteries)
+	if stats.LastCheck != nil {
+		messaggio = fmt.Sprintf("%s\nLast check: %s %s, %d keys (%d changed, %d failed) in %.1fs", messaggio,
+			models.GetTSStringIn(stats.LastCheck.Timestamp, env.Db.GetChatLocation(chatID)), stats.LastCheck.Outcome,
+			stats.LastCheck.Keys, stats.LastCheck.Changed, stats.LastCheck.Failed, stats.LastCheck.Duration)
+	} else {
+		messaggio = fmt.Sprintf("%s\nLast check: never", messaggio)
+	}
+	if err := env.SayText(chatID, messaggio); err != nil {
+		log.Println("error in sending reply:", err)
+	}
+}
+
+// /broadcast [testo]: manda in background il testo a tutte le chat con le notifiche attive,
+//alla fine risponde con quante lo hanno ricevuto
+func (env MyEnv) cmdBroadcast(chatID int64, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		if err := env.SayText(chatID, "Problema sui parametri di broadcast, serve [testo]"); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+		return
+	}
+	log.Println("/broadcast from", chatID, text)
+	if err := env.SayText(chatID, "Broadcast started, I will tell you when it is done."); err != nil {
+		log.Println("error in sending reply:", err)
+	}
+	env.jobs.once(func() {
+		sent, err := env.Broadcast(text, env.jobs.quit)
+		messaggio := fmt.Sprintf("Broadcast sent to %d chats.", sent)
+		if err != nil {
+			messaggio = fmt.Sprintf("%s\nStopped by error: %s", messaggio, err)
+		}
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	})
+}
+
+// /user [chatid]: dati, chiavi e nodi di una chat per il supporto
+func (env MyEnv) cmdUser(chatID int64, params []string) {
+	if len(params) != 1 {
+		if err := env.SayText(chatID, "Problema sui parametri di user, serve [chatid]"); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+		return
+	}
+	userChatID, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	if !env.Db.UserExists(userChatID) {
+		if err := env.SayText(chatID, fmt.Sprintf("Non trovo la chat %d", userChatID)); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+		return
+	}
+	chatUser, err := env.Db.GetUserByChatID(userChatID)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	messaggio := fmt.Sprintf("Chat %d \"%s\" notify: %t admin: %t", chatUser.ChatID, chatUser.Name, chatUser.Notify, chatUser.IsAdmin)
+	listaChiavi, err := env.Db.GetChatKeys(userChatID, env.LIST_LIMIT, 0)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	messaggio = fmt.Sprintf("%s\nKeys: %d", messaggio, len(*listaChiavi))
+	for i, chatkey := range *listaChiavi {
+		status := "?"
+		if mk, err := env.Db.GetMiningKey(chatkey.PubKey); err == nil {
+			status = mk.LastStatus
+		}
+		messaggio = fmt.Sprintf("%s\n%d)\t\"%s\"\t%s\t%s", messaggio, i+1, chatkey.KeyAlias, status, chatkey.PubKey)
+	}
+	listaNodi, err := env.Db.GetUrlNodes(userChatID, env.LIST_LIMIT, 0)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	messaggio = fmt.Sprintf("%s\nNodes: %d", messaggio, len(*listaNodi))
+	for i, urlnodo := range *listaNodi {
+		messaggio = fmt.Sprintf("%s\n%d)\t\"%s\"\t%s", messaggio, i+1, urlnodo.NodeName, urlnodo.NodeURL)
+	}
+	if err := env.SayText(chatID, messaggio); err != nil {
+		log.Println("error in sending reply:", err)
+	}
+}
+
+// /endpoints: salute, latenza ed altezza del beacon dei nodi e fullnode del bot, in ordine di preferenza
+func (env MyEnv) cmdEndpoints(chatID int64) {
+	righe := []string{}
+	for _, pool := range []*models.EndpointPool{env.NodePool, env.FullnodePool} {
+		righe = append(righe, fmt.Sprintf("%s:", pool.Role))
+		for i, st := range pool.Status() {
+			stato := "✅"
+			switch {
+			case !st.Up:
+				stato = "❌"
+			case !st.InSync:
+				stato = "⚠️"
+			}
+			riga := fmt.Sprintf("%s %s %dms", stato, models.RedactURL(st.URL), st.Latency.Milliseconds())
+			if i == 0 {
+				riga += " (in uso)"
+			}
+			if st.Height > 0 {
+				riga += fmt.Sprintf(", beacon %d", st.Height)
+			}
+			riga += fmt.Sprintf(", calls %d, errors %d", st.Calls, st.Errors)
+			if st.LastError != "" {
+				riga += fmt.Sprintf("\n    last error %s: %s", models.GetTSStringIn(models.MakeTSFromTime(st.LastErrTime), env.Db.GetChatLocation(chatID)), st.LastError)
+			}
+			righe = append(righe, riga)
+		}
+	}
+	if err := env.SayText(chatID, strings.Join(righe, "\n")); err != nil {
+		log.Println("error in sending reply:", err)
+	}
+}
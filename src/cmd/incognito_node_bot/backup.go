@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+const pendingImportTTL = time.Hour //dopo quanto scade un import non confermato
+
+// /export [json|csv]: manda chiavi e nodi della chat come documento
+func (env MyEnv) cmdExport(chatID int64, params []string) {
+	format := "json"
+	if len(params) > 0 {
+		format = strings.ToLower(params[0])
+	}
+	cb, err := env.Db.GetChatBackup(chatID)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	var data []byte
+	switch format {
+	case "json":
+		data, err = cb.ToJSON()
+	case "csv":
+		data, err = cb.ToCSV()
+	default:
+		if err := env.SayText(chatID, "Problema sui parametri di export, serve [json|csv]"); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+		return
+	}
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	filename := fmt.Sprintf("incognito_node_bot_%s.%s", time.Now().Format("20060102"), format)
+	caption := fmt.Sprintf("%d keys, %d nodes", len(cb.Keys), len(cb.Nodes))
+	withAuth := 0
+	for _, n := range cb.Nodes {
+		if n.HasAuth {
+			withAuth++
+		}
+	}
+	if withAuth > 0 {
+		caption = fmt.Sprintf("%s, credentials of %d nodes not exported", caption, withAuth)
+	}
+	if err := env.SendDocument(chatID, filename, data, caption); err != nil {
+		log.Println("error in sending document:", err)
+		env.SayErr(chatID, err)
+	}
+}
+
+// /import: con un documento allegato (json o csv) valida tutte le righe e mostra l'anteprima,
+// /import confirm applica l'import in attesa, /import cancel lo annulla
+func (env MyEnv) cmdImport(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	if body.Message.Document != nil {
+		env.importDocument(body)
+		return
+	}
+	action := ""
+	if len(params) > 0 {
+		action = strings.ToLower(params[0])
+	}
+	switch action {
+	case "confirm":
+		cb, ts, err := env.Db.GetPendingImport(chatID)
+		if err != nil {
+			say("Non c'è nessun import da confermare, manda il file con didascalia /import")
+			return
+		}
+		env.Db.DelPendingImport(chatID)
+		if time.Since(models.GetTSTime(ts)) > pendingImportTTL {
+			say("L'import è scaduto, manda di nuovo il file con didascalia /import")
+			return
+		}
+		if err := env.Db.ApplyChatBackup(chatID, cb); err != nil {
+			say(fmt.Sprint("Problema applicando l'import, nessuna modifica fatta: ", err))
+			return
+		}
+		say(fmt.Sprintf("Import completato: %d chiavi, %d nodi.", len(cb.Keys), len(cb.Nodes)))
+	case "cancel":
+		env.Db.DelPendingImport(chatID)
+		say("Import annullato.")
+	default:
+		say("Manda il file json o csv (come da /export) con didascalia /import, poi conferma con /import confirm.\nAttenzione: chiavi e nodi non presenti nel file vengono eliminati.")
+	}
+}
+
+//scarica e valida il documento allegato e salva l'import in attesa di conferma mostrandone l'anteprima
+func (env MyEnv) importDocument(body *webhookReqBody) {
+	chatID := body.Message.Chat.ID
+	doc := body.Message.Document
+	log.Println("/import", doc.FileName, doc.FileSize)
+	file, err := env.GetFile(doc.FileID)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	data, err := env.DownloadFile(file, models.MaxBackupSize)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	cb, err := models.ParseChatBackup(doc.FileName, data)
+	if err != nil {
+		env.SayText(chatID, fmt.Sprint("Problema leggendo il file, nessuna modifica fatta:\n", err))
+		return
+	}
+	var beacon *models.BBSD
+	bbsd := models.BBSD{}
+	if err := env.GetBeaconSnapshot(nil, &bbsd); err != nil {
+		log.Println("error getBeaconBestStateDetail:", err)
+	} else {
+		beacon = &bbsd
+	}
+	if err := cb.Validate(beacon); err != nil {
+		env.SayText(chatID, fmt.Sprint("Errori nel file, nessuna modifica fatta:\n", err))
+		return
+	}
+	current, err := env.Db.GetChatBackup(chatID)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	preview := cb.Preview(current)
+	if preview.Empty() {
+		env.SayText(chatID, "Il file non cambia nulla.")
+		return
+	}
+	if err := env.Db.SetPendingImport(chatID, cb, models.MakeTSFromTime(time.Now())); err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	messaggio := fmt.Sprintf("%s\nConferma con /import confirm oppure annulla con /import cancel.", preview)
+	if err := env.SayText(chatID, messaggio); err != nil {
+		log.Println("error in sending reply:", err)
+	}
+}
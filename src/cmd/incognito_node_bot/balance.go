@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+// Saldi di una chiave letti dal fullnode
+type keyBalance struct {
+	alias  string
+	reward models.TMinerReward
+}
+
+//ritorna il testo di /balance per le chiavi: saldi per moneta, con più chiavi il totale esatto per moneta
+//e, se abbiamo i prezzi, il valore in valuta per chiave e totale. Vuoto se non troviamo nulla.
+func (env MyEnv) balanceText(chatID int64, listaChiavi *[]models.ChatKey) string {
+	aliases := []string{}
+	blsKeys := []string{}
+	for _, pubkey := range *listaChiavi {
+		mk, errmk := env.Db.GetMiningKey(pubkey.PubKey)
+		if errmk != nil { //non abbiamo info della chiave
+			continue
+		}
+		aliases = append(aliases, pubkey.KeyAlias)
+		blsKeys = append(blsKeys, mk.Bls)
+	}
+	rewards := env.GetMinerRewards(blsKeys)
+	balances := []keyBalance{}
+	symbols := map[string]bool{}
+	for i, bls := range blsKeys {
+		reward, ok := rewards[bls]
+		if !ok {
+			continue
+		}
+		balances = append(balances, keyBalance{alias: aliases[i], reward: reward})
+		for _, id := range reward.GetValueIDs() {
+			coin, _ := reward.GetNameValuePair(id)
+			symbols[coin] = true
+		}
+	}
+	names := make([]string, 0, len(symbols))
+	for coin := range symbols {
+		names = append(names, coin)
+	}
+	sort.Strings(names)
+	prices, fiat := env.ChatPrices(chatID, names)
+
+	messaggio := ""
+	total := 0.0
+	coinTotals := map[string]models.Amount{}
+	for _, kb := range balances {
+		messaggio = fmt.Sprintf("%s\n%s:\n", messaggio, kb.alias)
+		keyTotal := 0.0
+		for _, id := range kb.reward.GetValueIDs() {
+			coin, val := kb.reward.GetNameValuePair(id)
+			amount := models.BIG_COINS.GetAmount(coin, val)
+			messaggio = fmt.Sprintf("%s\t%s%s", messaggio, amount, coin)
+			if price, ok := prices[coin]; ok {
+				messaggio = fmt.Sprintf("%s ≈ %.2f %s", messaggio, amount.Float64()*price, fiat)
+				keyTotal += amount.Float64() * price
+			}
+			if sum, err := coinTotals[coin].Add(amount); err == nil {
+				coinTotals[coin] = sum
+			}
+			messaggio += "\n"
+		}
+		if prices != nil {
+			messaggio = fmt.Sprintf("%s\tTotale ≈ %.2f %s\n", messaggio, keyTotal, fiat)
+		}
+		total += keyTotal
+	}
+	if len(balances) > 1 {
+		messaggio += "\nTotale chiavi:\n"
+		for _, coin := range names {
+			messaggio = fmt.Sprintf("%s\t%s%s\n", messaggio, coinTotals[coin], coin)
+		}
+		if prices != nil {
+			messaggio = fmt.Sprintf("%s\t≈ %.2f %s", messaggio, total, fiat)
+		}
+	}
+	return messaggio
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	errQueueFull         = errors.New("update queue full")
+	errDispatcherStopped = errors.New("update dispatcher stopped")
+)
+
+// Elabora gli update su un numero fisso di worker, ciascuno con la sua coda limitata:
+// gli update della stessa chat vanno sempre allo stesso worker e restano in ordine
+type updateDispatcher struct {
+	queues  []chan *webhookReqBody
+	process func(*webhookReqBody)
+	wg      sync.WaitGroup
+	mutex   sync.RWMutex //Dispatch non manda mai su una coda chiusa da Stop
+	stopped bool
+}
+
+func newUpdateDispatcher(workers, queueSize int, process func(*webhookReqBody)) *updateDispatcher {
+	ud := &updateDispatcher{process: process}
+	for i := 0; i < workers; i++ {
+		queue := make(chan *webhookReqBody, queueSize)
+		ud.queues = append(ud.queues, queue)
+		ud.wg.Add(1)
+		go ud.work(queue)
+	}
+	log.Printf("updateDispatcher: %d workers, queue %d\n", workers, queueSize)
+	return ud
+}
+
+func (ud *updateDispatcher) work(queue chan *webhookReqBody) {
+	defer ud.wg.Done()
+	for body := range queue {
+		ud.process(body)
+	}
+}
+
+//mette in coda l'update sul worker della chat, errQueueFull se la coda è piena
+//ed errDispatcherStopped dopo Stop (handler ancora attivi alla scadenza dello shutdown)
+func (ud *updateDispatcher) Dispatch(body *webhookReqBody) error {
+	chatID := body.Message.Chat.ID
+	if chatID < 0 {
+		chatID = -chatID
+	}
+	ud.mutex.RLock()
+	defer ud.mutex.RUnlock()
+	if ud.stopped {
+		return errDispatcherStopped
+	}
+	select {
+	case ud.queues[chatID%int64(len(ud.queues))] <- body:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+//chiude le code ed aspetta che i worker finiscano gli update già accettati
+func (ud *updateDispatcher) Stop() {
+	ud.mutex.Lock()
+	ud.stopped = true
+	for _, queue := range ud.queues {
+		close(queue)
+	}
+	ud.mutex.Unlock()
+	ud.wg.Wait()
+}
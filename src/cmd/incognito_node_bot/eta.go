@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+// Dati comuni per stimare l'ingresso in committee delle chiavi, letti una volta per comando
+type etaContext struct {
+	rates       map[string]float64
+	remaining   int
+	epochBlocks int
+}
+
+//legge i tassi di ingresso in committee dal db e la fine dell'epoch dal nodo node (nil per i nodi del bot)
+func (env MyEnv) getEtaContext(node *models.RPCNode) *etaContext {
+	ec := &etaContext{}
+	rates, err := env.Db.GetShardSwapRates()
+	if err != nil {
+		log.Println("error GetShardSwapRates:", err)
+	}
+	ec.rates = rates
+	bci := models.BCI{}
+	if err := env.GetBlockChainInfo(node, &bci); err != nil {
+		log.Println("error GetBlockChainInfo:", err)
+		return ec
+	}
+	beacon := bci.Result.BestBlocks[models.BeaconBestBlockKey]
+	ec.remaining = beacon.RemainingBlockEpoch
+	ec.epochBlocks = beacon.EpochBlock
+	return ec
+}
+
+//stima per la chiave, nil se non è in coda per il committee
+func (ec *etaContext) keyETA(bbsd *models.BBSD, pubkey string) *models.KeyETA {
+	return models.ComputeKeyETA(bbsd, pubkey, ec.rates, ec.remaining, ec.epochBlocks)
+}
+
+// /eta [alias]: posizione in coda e stima dell'ingresso in committee delle chiavi in waiting o pending
+func (env MyEnv) cmdEta(chatID int64, params []string) {
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	listaChiavi := &[]models.ChatKey{}
+	if len(params) > 0 {
+		chiave, err := env.Db.GetChatKey(chatID, params[0])
+		if err != nil {
+			say(fmt.Sprintf("Non trovo la chiave %s, vedi /listkeys", params[0]))
+			return
+		}
+		*listaChiavi = append(*listaChiavi, *chiave)
+	} else {
+		var err error
+		if listaChiavi, err = env.Db.GetChatKeys(chatID, 100, 0); err != nil {
+			say(fmt.Sprint("Problema recuperando le chiavi: ", err))
+			return
+		}
+	}
+	bbsd := models.BBSD{}
+	if err := env.GetBeaconSnapshot(nil, &bbsd); err != nil {
+		log.Println("error getBeaconBestStateDetail:", err)
+		env.SayErr(chatID, err)
+		return
+	}
+	ec := env.getEtaContext(nil)
+	righe := []string{}
+	for _, chatkey := range *listaChiavi {
+		if ke := ec.keyETA(&bbsd, chatkey.PubKey); ke != nil {
+			righe = append(righe, fmt.Sprintf("%s: %s", chatkey.KeyAlias, ke))
+		} else {
+			status, _ := models.GetPubKeyStatus(&bbsd, chatkey.PubKey)
+			righe = append(righe, fmt.Sprintf("%s: %s, non è in coda", chatkey.KeyAlias, status))
+		}
+	}
+	if len(righe) == 0 {
+		say("Non trovo nulla!")
+		return
+	}
+	say(strings.Join(righe, "\n\n"))
+}
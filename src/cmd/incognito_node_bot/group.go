@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+//ritorna vero se il messaggio arriva da un gruppo o supergruppo
+func (body *webhookReqBody) isGroup() bool {
+	return body.Message.Chat.Type == "group" || body.Message.Chat.Type == "supergroup"
+}
+
+//ritorna vero se il messaggio è di un admin anonimo del gruppo (mandato a nome del gruppo stesso)
+func (body *webhookReqBody) isAnonymousAdmin() bool {
+	return body.isGroup() && body.Message.SenderChat != nil && body.Message.SenderChat.ID == body.Message.Chat.ID
+}
+
+//ritorna il nome telegram di chi ha mandato il messaggio
+func (body *webhookReqBody) senderName() string {
+	if body.Message.SenderChat != nil && body.Message.SenderChat.Title != "" {
+		return body.Message.SenderChat.Title
+	}
+	name := strings.TrimSpace(body.Message.From.FirstName + " " + body.Message.From.LastName)
+	if name == "" && body.Message.From.Username != "" {
+		name = "@" + body.Message.From.Username
+	}
+	if name == "" {
+		name = "Sconosciuto"
+	}
+	return name
+}
+
+//ritorna vero se chi ha mandato il messaggio può modificare chiavi, nodi ed impostazioni della chat:
+//nelle chat private sempre, nei gruppi solo gli admin del gruppo (anche anonimi). Se non può lo avvisa.
+func (env MyEnv) canModify(body *webhookReqBody) bool {
+	if !body.isGroup() || body.isAnonymousAdmin() {
+		return true
+	}
+	member, err := env.GetChatMember(body.Message.Chat.ID, body.Message.From.ID)
+	if err != nil {
+		env.SayErr(body.Message.Chat.ID, err)
+		return false
+	}
+	if member.IsAdmin() {
+		return true
+	}
+	log.Printf("chat %d: user %d (%s) is not a group admin\n", body.Message.Chat.ID, body.Message.From.ID, member.Status)
+	if err := env.SayText(body.Message.Chat.ID, "Mi spiace "+body.senderName()+", solo gli admin del gruppo possono modificare chiavi, nodi ed impostazioni."); err != nil {
+		log.Println("error in sending reply:", err)
+	}
+	return false
+}
+
+//gestisce la migrazione di un gruppo a supergruppo spostando i dati sul nuovo ChatID,
+//ritorna vero se il messaggio era di migrazione
+func (env MyEnv) migrateChat(body *webhookReqBody) bool {
+	switch {
+	case body.Message.MigrateToChatID != 0:
+		if err := env.Db.MigrateChat(body.Message.Chat.ID, body.Message.MigrateToChatID); err != nil {
+			log.Println("error migrating chat:", err)
+		}
+		return true
+	case body.Message.MigrateFromChatID != 0:
+		if err := env.Db.MigrateChat(body.Message.MigrateFromChatID, body.Message.Chat.ID); err != nil {
+			log.Println("error migrating chat:", err)
+		}
+		return true
+	}
+	return false
+}
+
+//nei gruppi usiamo il titolo del gruppo come nome della chat (es. per le notifiche)
+func (env MyEnv) updateGroupName(body *webhookReqBody, chatUser *models.ChatUser) {
+	if !body.isGroup() || chatUser == nil || body.Message.Chat.Title == "" {
+		return
+	}
+	if chatUser.Name == body.Message.Chat.Title && !chatUser.NameAsked {
+		return
+	}
+	chatUser.Name = body.Message.Chat.Title
+	chatUser.NameAsked = false
+	if err := env.Db.UpdateUser(chatUser); err != nil {
+		log.Println("error updating group name:", err)
+	}
+}
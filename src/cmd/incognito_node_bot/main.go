@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,10 +20,24 @@ import (
 
 type MyEnv struct {
 	*models.Env
+	dispatcher *updateDispatcher
+	jobs       *backgroundJobs
 }
 
 func main() {
-	env := &MyEnv{models.NewEnv()}
+	configFlags := models.NewConfigFlags()
+	flag.Parse()
+	cfg := configFlags.Load()
+	if flag.Arg(0) == "webhook" {
+		env := models.NewEnv(cfg)
+		code := webhookCmd(env, flag.Args()[1:])
+		env.Db.DB.Close()
+		os.Exit(code)
+	}
+	if err := cfg.ValidateServer(); err != nil {
+		log.Fatal(err)
+	}
+	env := &MyEnv{Env: models.NewEnv(cfg)}
 	defer env.Db.DB.Close()
 	defer log.Println("Exiting...")
 	defer log.Printf("%T %T\n", env.Db, env.Db.DB)
@@ -28,25 +45,73 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := env.Db.SetAdmins(env.ADMIN_CHATIDS); err != nil {
+		log.Fatal(err)
+	}
 
 	rand.Seed(time.Now().UnixNano())
 
 	for _, cmd := range env.BOT_CMDS {
 		log.Printf("%s - %s\n", cmd.Cmd, cmd.Descr)
 	}
-	http.HandleFunc("/", env.RootHandler)
-	http.HandleFunc("/telegram"+env.TGTOKEN+"/", env.TelegramHandler)
-	log.Fatal(http.ListenAndServeTLS(":8443", "cert.pem", "key.pem", nil))
+	env.Db.RegisterCheckCycleMetrics()
+	models.ServeMetrics(env.METRICS_ADDR)
+
+	jobs := newBackgroundJobs()
+	env.jobs = jobs
+	env.ProbeEndpoints()
+	jobs.every(models.EndpointProbeInterval, env.ProbeEndpoints)
+	env.RefreshTokens()
+	jobs.every(time.Hour, func() { env.RefreshTokens() })
+	jobs.every(time.Hour, func() { env.Db.PruneUpdates() })
+	checkWebhook(env.Env)
+	jobs.once(func() { env.PublishCommands() }) //menu dei comandi di telegram sempre allineato a BOT_CMDS
+	if env.WEBHOOK_SECRET == "" {
+		log.Println("WARNING: webhook_secret not set, the secret token header is not verified")
+	}
+	env.dispatcher = newUpdateDispatcher(env.WORKERS, env.QUEUE_SIZE, env.processUpdate)
+
+	server := &botServer{env: env, jobs: jobs}
+	if err := server.run(); err == errDrainTimeout {
+		log.Println(err, "exiting without closing the DB")
+		os.Exit(1) //niente defer: worker e job potrebbero ancora usare il DB
+	} else if err != nil {
+		env.Db.DB.Close()
+		log.Fatal("Server error: ", err)
+	}
 }
 
 // Create a struct that mimics the webhook response body
 // https://core.telegram.org/bots/api#update
 type webhookReqBody struct {
-	Message struct {
-		Text string `json:"text"`
-		Chat struct {
-			ID int64 `json:"id"`
+	UpdateID int64 `json:"update_id"`
+	Message  struct {
+		MessageID int64  `json:"message_id"`
+		Text      string `json:"text"`
+		Chat      struct {
+			ID    int64  `json:"id"`
+			Type  string `json:"type"`
+			Title string `json:"title"`
 		} `json:"chat"`
+		From struct {
+			ID        int64  `json:"id"`
+			FirstName string `json:"first_name"`
+			LastName  string `json:"last_name"`
+			Username  string `json:"username"`
+		} `json:"from"`
+		SenderChat *struct { //chat per cui è mandato il messaggio: il gruppo stesso per gli admin anonimi
+			ID    int64  `json:"id"`
+			Title string `json:"title"`
+		} `json:"sender_chat"`
+		Caption  string `json:"caption"`
+		Document *struct {
+			FileID   string `json:"file_id"`
+			FileName string `json:"file_name"`
+			MimeType string `json:"mime_type"`
+			FileSize int64  `json:"file_size"`
+		} `json:"document"`
+		MigrateToChatID   int64 `json:"migrate_to_chat_id"`
+		MigrateFromChatID int64 `json:"migrate_from_chat_id"`
 	} `json:"message"`
 }
 
@@ -58,17 +123,79 @@ func (env MyEnv) RootHandler(w http.ResponseWriter, r *http.Request) {
 
 // This handler is called everytime telegram sends us a webhook event
 func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
+	if env.WEBHOOK_SECRET != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(env.WEBHOOK_SECRET)) != 1 {
+		log.Printf("TelegramHandler: bad secret token from %s", req.RemoteAddr)
+		models.UpdatesRejected.WithLabelValues("secret").Inc()
+		http.Error(res, "forbidden", http.StatusForbidden)
+		return
+	}
 	// First, decode the JSON response body
 	body := &webhookReqBody{}
-	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxUpdateSize)).Decode(body); err != nil {
 		log.Println("could not decode request body", err)
+		models.UpdatesRejected.WithLabelValues("bad_request").Inc()
+		http.Error(res, "bad request", http.StatusBadRequest)
+		return
+	}
+	//telegram rispedisce gli update se non rispondiamo in tempo: li elaboriamo una volta sola
+	isNew := true
+	if body.UpdateID != 0 {
+		var err error
+		if isNew, err = env.Db.MarkUpdate(body.UpdateID, body.Message.Chat.ID); err != nil {
+			http.Error(res, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !isNew {
+		log.Println("TelegramHandler: duplicate update", body.UpdateID)
+		models.UpdatesRejected.WithLabelValues("duplicate").Inc()
+		return
+	}
+	if err := env.dispatcher.Dispatch(body); err != nil { //coda piena o bot in chiusura: telegram riproverà più tardi
+		log.Println("TelegramHandler:", err, "update", body.UpdateID)
+		reason := "queue_full"
+		if err == errDispatcherStopped {
+			reason = "shutting_down"
+		}
+		models.UpdatesRejected.WithLabelValues(reason).Inc()
+		if body.UpdateID != 0 {
+			env.Db.UnmarkUpdate(body.UpdateID)
+		}
+		http.Error(res, "busy", http.StatusServiceUnavailable)
+		return
+	}
+}
+
+//elabora un update già accettato da TelegramHandler, chiamata dai worker del dispatcher
+func (env MyEnv) processUpdate(body *webhookReqBody) {
+	cmdLabel := env.CmdLabel(body.Message.Text + body.Message.Caption)
+	start := time.Now()
+	defer func() {
+		models.UpdatesProcessed.WithLabelValues(cmdLabel).Inc()
+		models.UpdateDuration.WithLabelValues(cmdLabel).Observe(time.Since(start).Seconds())
+	}()
+	if env.migrateChat(body) {
 		return
 	}
+	if body.Message.Text == "" { //i comandi dei documenti sono nella didascalia
+		body.Message.Text = body.Message.Caption
+	}
 	ChatData, _ := env.Db.GetUserByChatID(body.Message.Chat.ID)
+	env.updateGroupName(body, ChatData)
+	userName := ChatData.Name
+	if body.isGroup() {
+		userName = body.senderName()
+	}
 	bbsd := models.BBSD{}
 	bci := models.BCI{}
-	log.Println("Ricevuto:", body.Message.Text)
+	log.Println("Ricevuto:", env.redactedText(body.Message.Text))
 	switch {
+	case env.StrCmd(body.Message.Text) == "/start" && body.isGroup():
+		messaggio := fmt.Sprintf("Ciao %s, in questo gruppo chiavi e nodi sono condivisi e solo gli admin del gruppo possono modificarli.", userName)
+		if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+			return
+		}
 	case env.StrCmd(body.Message.Text) == "/start":
 		ChatData.NameAsked = true
 		if err := env.Db.UpdateUser(ChatData); err != nil {
@@ -78,7 +205,7 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			log.Println("error in sending reply:", err)
 			return
 		}
-	case ChatData.NameAsked:
+	case ChatData.NameAsked && !body.isGroup():
 		ChatData.Name = body.Message.Text
 		ChatData.NameAsked = false
 		if err := env.Db.UpdateUser(ChatData); err != nil {
@@ -106,9 +233,13 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			nodo = params[0]
 		}
 		log.Println("/height", nodo, np, params)
-		theUrl := env.DEFAULT_NODE_URL
+		var theNode *models.RPCNode //nil: i nodi del bot
 		if urlNode, err := env.Db.GetUrlNode(ChatData.ChatID, nodo); err == nil {
-			theUrl = urlNode.NodeURL
+			if theNode, err = env.RPCNode(urlNode); err != nil {
+				log.Println("error RPCNode:", err)
+				env.SayErr(body.Message.Chat.ID, err)
+				return
+			}
 		} else {
 			if np > 0 {
 				messaggio := fmt.Sprintf("Non trovo tuo nodo \"%s\" uso mio nodo", nodo)
@@ -118,12 +249,12 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 				nodo = ""
 			}
 		}
-		if err := models.GetBeaconBestStateDetail(theUrl, &bbsd); err != nil {
+		if err := env.GetBeaconSnapshot(theNode, &bbsd); err != nil {
 			log.Println("error getBeaconBestStateDetail:", err)
 			env.SayErr(body.Message.Chat.ID, err)
 			return
 		}
-		if err := models.GetBlockChainInfo(theUrl, &bci); err != nil {
+		if err := env.GetBlockChainInfo(theNode, &bci); err != nil {
 			log.Println("error GetBlockChainInfo:", err)
 			env.SayErr(body.Message.Chat.ID, err)
 			return
@@ -132,7 +263,7 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 		if len(nodo) > 0 {
 			nodestring = fmt.Sprintf("nodo \"%s\"", nodo)
 		}
-		messaggio := fmt.Sprintf("Ecco %s, al %s risulta altezza: %d, epoca: %d/%d (%d)", ChatData.Name, nodestring, bbsd.Result.BeaconHeight, bbsd.Result.Epoch, 350-(bbsd.Result.BeaconHeight%350), bci.Result.BestBlocks["-1"].RemainingBlockEpoch)
+		messaggio := fmt.Sprintf("Ecco %s, al %s risulta altezza: %d, epoca: %d/%d (%d)", userName, nodestring, bbsd.Result.BeaconHeight, bbsd.Result.Epoch, 350-(bbsd.Result.BeaconHeight%350), bci.Result.BestBlocks["-1"].RemainingBlockEpoch)
 		shards := make([]string, 0, len(bbsd.Result.BestShardHeight))
 		for shard := range bbsd.Result.BestShardHeight {
 			shards = append(shards, shard)
@@ -148,35 +279,12 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 	case env.StrCmd(body.Message.Text) == "/addnode":
-		params := strings.Fields(env.RemoveCmd(body.Message.Text))
-		np := len(params)
-		nodo := ""
-		urlnodo := ""
-		if np < 2 {
-			messaggio := fmt.Sprint("Problema sui parametri di addnode, servono [nome] [url] ", len(params), " ", params)
-			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
-				log.Println("error in sending reply:", err)
-			}
-			return
-		}
-		nodo = params[0]
-		urlnodo = params[1]
-		log.Println("/addnode", nodo, urlnodo, np, params)
-		err := env.Db.UpdateUrlNode(&models.UrlNode{UNId: 0, ChatID: body.Message.Chat.ID, NodeName: nodo, NodeURL: urlnodo})
-		if err != nil {
-			messaggio := fmt.Sprint("Problema aggiornamento nodo: ", err)
-			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
-				log.Println("error in sending reply:", err)
-			}
-			return
-		}
-		messaggio := fmt.Sprint("Nodo aggiornato: \"", nodo, "\" ", urlnodo)
-		if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
-			log.Println("error in sending reply:", err)
+		if !env.canModify(body) {
 			return
 		}
+		env.cmdAddNode(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
 	case env.StrCmd(body.Message.Text) == "/listnodes":
-		listaNodi, err := env.Db.GetUrlNodes(body.Message.Chat.ID, 100, 0)
+		listaNodi, err := env.Db.GetUrlNodes(body.Message.Chat.ID, env.LIST_LIMIT, 0)
 		if err != nil {
 			messaggio := fmt.Sprint("Problema recuperando i nodi: ", err)
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -186,7 +294,10 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 		}
 		messaggio := ""
 		for i, urlnodo := range *listaNodi {
-			messaggio = fmt.Sprintf("%s\n%d)\t\"%s\"\t%s", messaggio, i+1, urlnodo.NodeName, urlnodo.NodeURL)
+			messaggio = fmt.Sprintf("%s\n%d)\t\"%s\"\t%s%s\n\t%s", messaggio, i+1, urlnodo.NodeName, urlnodo.NodeURL, env.nodeAuthText(&urlnodo), nodeInfoText(urlnodo.Info))
+			if urlnodo.Info != nil {
+				messaggio = fmt.Sprintf("%s (%s)", messaggio, models.GetTSStringIn(urlnodo.ProbeTS, env.Db.GetChatLocation(body.Message.Chat.ID)))
+			}
 		}
 		log.Printf("/listnodes invio %d nodi.", len(*listaNodi))
 		if messaggio == "" {
@@ -197,7 +308,10 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 	case env.StrCmd(body.Message.Text) == "/delnode":
-		listaNodi, err := env.Db.GetUrlNodes(body.Message.Chat.ID, 100, 0)
+		if !env.canModify(body) {
+			return
+		}
+		listaNodi, err := env.Db.GetUrlNodes(body.Message.Chat.ID, env.LIST_LIMIT, 0)
 		if err != nil {
 			messaggio := fmt.Sprint("Problema recuperando i nodi: ", err)
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -256,6 +370,9 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 	case env.StrCmd(body.Message.Text) == "/addkey":
+		if !env.canModify(body) {
+			return
+		}
 		params := strings.Fields(env.RemoveCmd(body.Message.Text))
 		np := len(params)
 		alias := ""
@@ -270,7 +387,22 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 		alias = params[0]
 		pubkey = params[1]
 		log.Println("/addkey", alias, pubkey, np, params)
-		err := env.Db.UpdateChatKey(&models.ChatKey{ChatID: body.Message.Chat.ID, KeyAlias: alias, PubKey: pubkey})
+		var beacon *models.BBSD
+		if err := env.GetBeaconSnapshot(nil, &bbsd); err != nil {
+			log.Println("error getBeaconBestStateDetail:", err)
+		} else {
+			beacon = &bbsd
+		}
+		rk, err := models.ResolvePubKey(beacon, pubkey)
+		if err != nil {
+			messaggio := fmt.Sprint("Chiave non valida: ", err)
+			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
+				log.Println("error in sending reply:", err)
+			}
+			return
+		}
+		pubkey = rk.IncPubKey
+		err = env.Db.UpdateChatKey(&models.ChatKey{ChatID: body.Message.Chat.ID, KeyAlias: alias, PubKey: pubkey})
 		if err != nil {
 			messaggio := fmt.Sprint("Problema aggiornamento chiave: ", err)
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -279,12 +411,25 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		messaggio := fmt.Sprint("Chiave aggiornata: \"", alias, "\" ", pubkey)
+		switch {
+		case beacon == nil:
+			messaggio = fmt.Sprintf("%s\nNon riesco a leggere il beacon state, stato della chiave sconosciuto.", messaggio)
+		case rk.Known():
+			if rk.Info.MiningPubKey.Bls != "" {
+				if err := env.Db.SaveMiningKeyInfo(pubkey, rk.Info.MiningPubKey.Bls, rk.Info.MiningPubKey.Dsa, rk.Info.IsAutoStake); err != nil {
+					log.Println("error SaveMiningKeyInfo:", err)
+				}
+			}
+			messaggio = fmt.Sprintf("%s\nStato attuale: %s", messaggio, rk.Status)
+		default:
+			messaggio = fmt.Sprintf("%s\nAttenzione: la chiave non è (ancora) presente nel beacon state.", messaggio)
+		}
 		if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
 			log.Println("error in sending reply:", err)
 			return
 		}
 	case env.StrCmd(body.Message.Text) == "/listkeys":
-		listaChiavi, err := env.Db.GetChatKeys(body.Message.Chat.ID, 100, 0)
+		listaChiavi, err := env.Db.GetChatKeys(body.Message.Chat.ID, env.LIST_LIMIT, 0)
 		if err != nil {
 			messaggio := fmt.Sprint("Problema recuperando le chiavi: ", err)
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -305,7 +450,10 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 	case env.StrCmd(body.Message.Text) == "/delkey":
-		listaChiavi, err := env.Db.GetChatKeys(body.Message.Chat.ID, 100, 0)
+		if !env.canModify(body) {
+			return
+		}
+		listaChiavi, err := env.Db.GetChatKeys(body.Message.Chat.ID, env.LIST_LIMIT, 0)
 		if err != nil {
 			messaggio := fmt.Sprint("Problema recuperando le chiavi: ", err)
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -368,9 +516,13 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			nodo = params[0]
 		}
 		log.Println("/status", nodo, np, params)
-		theUrl := env.DEFAULT_NODE_URL
+		var theNode *models.RPCNode //nil: i nodi del bot
 		if urlNode, err := env.Db.GetUrlNode(ChatData.ChatID, nodo); err == nil {
-			theUrl = urlNode.NodeURL
+			if theNode, err = env.RPCNode(urlNode); err != nil {
+				log.Println("error RPCNode:", err)
+				env.SayErr(body.Message.Chat.ID, err)
+				return
+			}
 		} else {
 			if np > 0 {
 				messaggio := fmt.Sprintf("Non trovo tuo nodo \"%s\" uso mio nodo", nodo)
@@ -379,12 +531,12 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 				}
 			}
 		}
-		if err := models.GetBeaconBestStateDetail(theUrl, &bbsd); err != nil {
+		if err := env.GetBeaconSnapshot(theNode, &bbsd); err != nil {
 			log.Println("error getBeaconBestStateDetail:", err)
 			env.SayErr(body.Message.Chat.ID, err)
 			return
 		}
-		listaChiavi, err := env.Db.GetChatKeys(body.Message.Chat.ID, 100, 0)
+		listaChiavi, err := env.Db.GetChatKeys(body.Message.Chat.ID, env.LIST_LIMIT, 0)
 		if err != nil {
 			messaggio := fmt.Sprint("Problema recuperando le chiavi: ", err)
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -392,30 +544,47 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			}
 			return
 		}
+		blsKeys := []string{}
+		for _, pubkey := range *listaChiavi {
+			if _, pki := models.GetPubKeyStatus(&bbsd, pubkey.PubKey); pki != nil {
+				blsKeys = append(blsKeys, pki.MiningPubKey.Bls)
+			}
+		}
+		rewards := env.GetMinerRewards(blsKeys)
 		messaggio := ""
+		var ec *etaContext //letto solo se serve
 		for _, pubkey := range *listaChiavi {
 			status, pki := models.GetPubKeyStatus(&bbsd, pubkey.PubKey)
+			eta := ""
+			if role := models.StatusRole(status); role == models.RoleWaiting || role == models.RolePending {
+				if ec == nil {
+					ec = env.getEtaContext(theNode)
+				}
+				if ke := ec.keyETA(&bbsd, pubkey.PubKey); ke != nil {
+					eta = " " + ke.Short()
+				}
+			}
 			mk := &models.MiningKey{
-				PubKey:     pubkey.PubKey,
-				LastStatus: status,
+				PubKey:        pubkey.PubKey,
+				LastStatus:    status,
+				InAutoStaking: bbsd.InAutoStaking(pubkey.PubKey),
 			}
 			if pki != nil { //abbiamo info della chiave
 				mk.LastPRV = pki.PRV
 				mk.IsAutoStake = pki.IsAutoStake
 				mk.Bls = pki.MiningPubKey.Bls
 				mk.Dsa = pki.MiningPubKey.Dsa
-				mrfmk := models.MRFMK{}
-				err := models.GetMinerRewardFromMiningKey(env.DEFAULT_FULLNODE_URL, "bls:"+mk.Bls, &mrfmk)
-				if err == nil { //no err, abbiamo anche i PRV
-					mk.LastPRV = mrfmk.Result.GetPRV()
+				if reward, ok := rewards[mk.Bls]; ok { //abbiamo anche i PRV
+					mk.LastPRV = reward.GetPRV()
 				} else { //non abbiamo i PRV
 					mk.LastPRV = -1 //segnaliamo che non è da aggiornare
 				}
 			}
-			//messaggio = fmt.Sprintf("%s\n%s %s %fPRV", messaggio, pubkey.KeyAlias, status, float64(mk.LastPRV)/float64(1000000000))
-			messaggio = fmt.Sprintf("%s\n%s %s %.9fPRV", messaggio, pubkey.KeyAlias, status, models.BIG_COINS.GetFloat64Val("PRV", mk.LastPRV))
+			messaggio = fmt.Sprintf("%s\n%s %s%s %sPRV", messaggio, pubkey.KeyAlias, status, eta, models.PRVAmount(mk.LastPRV))
 
-			env.Db.UpdateMiningKey(mk, models.StatusChangeNotifierFunc(env.StatusChanged))
+			if theNode == nil { //lo stato di un nodo della chat può essere indietro: salviamo solo quello dei nodi del bot
+				env.Db.UpdateMiningKey(mk, models.StatusChangeNotifierFunc(env.StatusChanged), nil) //l'autostake lo controlla il checker
+			}
 		}
 		if messaggio == "" {
 			messaggio = "Non trovo nulla!"
@@ -425,6 +594,8 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+	case env.StrCmd(body.Message.Text) == "/eta":
+		env.cmdEta(body.Message.Chat.ID, strings.Fields(env.RemoveCmd(body.Message.Text)))
 	case env.StrCmd(body.Message.Text) == "/balance":
 		params := strings.Fields(env.RemoveCmd(body.Message.Text))
 		np := len(params)
@@ -436,7 +607,7 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 		listaChiavi := &[]models.ChatKey{}
 		if key == "" { //chiave non specificata, prendiamo tutte
 			var err error
-			listaChiavi, err = env.Db.GetChatKeys(body.Message.Chat.ID, 100, 0)
+			listaChiavi, err = env.Db.GetChatKeys(body.Message.Chat.ID, env.LIST_LIMIT, 0)
 			if err != nil {
 				messaggio := fmt.Sprint("Problema recuperando le chiavi: ", err)
 				if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
@@ -455,21 +626,7 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			}
 			*listaChiavi = append(*listaChiavi, *chiave)
 		}
-		messaggio := ""
-		for _, pubkey := range *listaChiavi {
-			mk, errmk := env.Db.GetMiningKey(pubkey.PubKey)
-			if errmk == nil { //abbiamo info della chiave
-				mrfmk := models.MRFMK{}
-				err := models.GetMinerRewardFromMiningKey(env.DEFAULT_FULLNODE_URL, "bls:"+mk.Bls, &mrfmk)
-				if err == nil { //no err, abbiamo anche i Saldi
-					messaggio = fmt.Sprintf("%s\n%s:\n", messaggio, pubkey.KeyAlias)
-					for _, id := range mrfmk.Result.GetValueIDs() {
-						coin, val := mrfmk.Result.GetNameValuePair(id)
-						messaggio = fmt.Sprintf("%s\t%.9f%s\n", messaggio, models.BIG_COINS.GetFloat64Val(coin, val), coin)
-					}
-				}
-			}
-		}
+		messaggio := env.balanceText(body.Message.Chat.ID, listaChiavi)
 		if messaggio == "" {
 			messaggio = "Non trovo nulla!"
 		}
@@ -477,21 +634,35 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			log.Println("error in sending reply:", err)
 			return
 		}
+	case env.StrCmd(body.Message.Text) == "/fiat":
+		env.cmdFiat(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
 	case env.StrCmd(body.Message.Text) == "/notify":
+		if !env.canModify(body) {
+			return
+		}
 		newNotify := env.Db.ChangeNotify(body.Message.Chat.ID)
 		messaggio := fmt.Sprintf("Notify is now %t.", newNotify)
 		if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
 			log.Println("error in sending reply:", err)
 			return
 		}
+	case env.StrCmd(body.Message.Text) == "/settings":
+		env.cmdSettings(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
+	case env.StrCmd(body.Message.Text) == "/quiet":
+		env.cmdQuiet(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
+	case env.StrCmd(body.Message.Text) == "/digest":
+		env.cmdDigest(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
+	case env.StrCmd(body.Message.Text) == "/tz":
+		env.cmdTz(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
 	case env.StrCmd(body.Message.Text) == "/lstickets":
 		params := strings.Fields(env.RemoveCmd(body.Message.Text))
 		np := len(params)
 		var errParse error = nil
-		y, m, _ := time.Now().Date()
-		var starttm = time.Date(y, m, 1, 0, 0, 0, 0, time.Now().Location())
+		chatLoc := env.Db.GetChatLocation(body.Message.Chat.ID)
+		y, m, _ := time.Now().In(chatLoc).Date()
+		var starttm = time.Date(y, m, 1, 0, 0, 0, 0, chatLoc)
 		if np == 1 {
-			starttm, errParse = time.ParseInLocation("2006-01-02 15:04:05", params[0]+"-01 00:00:00", time.Now().Location())
+			starttm, errParse = time.ParseInLocation("2006-01-02 15:04:05", params[0]+"-01 00:00:00", chatLoc)
 			if errParse != nil {
 				log.Println("errParse:", errParse)
 				messaggio := fmt.Sprintf("Problems with /lsnotify command params, need aaaa-mm but found '%s'.", env.RemoveCmd(body.Message.Text))
@@ -524,7 +695,9 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 			lottery := env.Db.GetLotteryByKey(lotterychat.LOId)
 			messaggio := fmt.Sprintf("Lottery %s.", lottery.LotteryName)
 			messaggio = fmt.Sprintf("%s\n*Listing 🎫 of %s.", messaggio, period)
-			lotterytickets, err := env.Db.GetLotteryTickets(lotterychat.LOId, starttm, -1)
+			//il mese è quello nel fuso della lotteria
+			lotterytm := time.Date(starttm.Year(), starttm.Month(), 1, 0, 0, 0, 0, lottery.Location())
+			lotterytickets, err := env.Db.GetLotteryTickets(lotterychat.LOId, lotterytm, -1)
 			if err != nil {
 				log.Println("/lsnotify err:", err)
 				messaggio := fmt.Sprintf("Problems with /lsnotify GetLotteryTickets '%v'.", err)
@@ -537,7 +710,7 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 				chatkey, err := env.Db.GetChatKeyFromPub(lotterychat.ChatID, lotteryticket.PubKey)
 				if err != nil { // we get default description for chatkey
 					lotterykey := env.Db.GetLotteryKeyByKey(lotteryticket.LOId, lotteryticket.PubKey)
-					chatkey = &models.ChatKey{lotterychat.ChatID, lotterykey.DefaultAlias, lotterykey.PubKey}
+					chatkey = &models.ChatKey{ChatID: lotterychat.ChatID, KeyAlias: lotterykey.DefaultAlias, PubKey: lotterykey.PubKey}
 				}
 				flag := ""
 				if lotteryticket.Extracted > 0 {
@@ -552,15 +725,45 @@ func (env MyEnv) TelegramHandler(res http.ResponseWriter, req *http.Request) {
 				if lotteryticket.Extracted == 3 {
 					flag = "🥉"
 				}
-				messaggio = fmt.Sprintf("%s\n  %s %s %s", messaggio, chatkey.KeyAlias, models.GetTSString(lotteryticket.Timestamp), flag)
+				messaggio = fmt.Sprintf("%s\n  %s %s %s", messaggio, chatkey.KeyAlias, models.GetTSStringIn(lotteryticket.Timestamp, chatLoc), flag)
 			}
 			if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
 				log.Println("error in sending reply:", err)
 				return
 			}
 		}
+	case env.StrCmd(body.Message.Text) == "/export":
+		env.cmdExport(body.Message.Chat.ID, strings.Fields(env.RemoveCmd(body.Message.Text)))
+	case env.StrCmd(body.Message.Text) == "/import":
+		if !env.canModify(body) {
+			return
+		}
+		env.cmdImport(body, strings.Fields(env.RemoveCmd(body.Message.Text)))
+	case env.StrCmd(body.Message.Text) == "/stats":
+		if env.checkAdmin(ChatData) {
+			env.cmdStats(body.Message.Chat.ID)
+		}
+	case env.StrCmd(body.Message.Text) == "/broadcast":
+		if env.checkAdmin(ChatData) {
+			env.cmdBroadcast(body.Message.Chat.ID, env.RemoveCmd(body.Message.Text))
+		}
+	case env.StrCmd(body.Message.Text) == "/user":
+		if env.checkAdmin(ChatData) {
+			env.cmdUser(body.Message.Chat.ID, strings.Fields(env.RemoveCmd(body.Message.Text)))
+		}
+	case env.StrCmd(body.Message.Text) == "/endpoints":
+		if env.checkAdmin(ChatData) {
+			env.cmdEndpoints(body.Message.Chat.ID)
+		}
+	case body.isGroup() && !strings.HasPrefix(body.Message.Text, "/"):
+		log.Println("ignoring group message without command")
+		return
 	default:
-		if err := env.SayText(body.Message.Chat.ID, env.PrintBOT_CMDS()); err != nil {
+		messaggio := env.PrintBOT_CMDS()
+		if ChatData != nil && ChatData.IsAdmin {
+			messaggio = fmt.Sprintf("%s\n\n%s", messaggio, env.PrintADMIN_CMDS())
+		}
+		if err := env.SayText(body.Message.Chat.ID, messaggio); err != nil {
 			log.Println("error in sending reply:", err)
 			return
 		}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+// /addnode [nome] [url] [basic utente:password|header Nome:valore]: verifica che l'url sia un nodo Incognito
+//raggiungibile e lo salva con i suoi dati e le eventuali credenziali, cifrate
+func (env MyEnv) cmdAddNode(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	if len(params) != 2 && len(params) != 4 {
+		say(fmt.Sprint("Problema sui parametri di addnode, servono [nome] [url] ed eventualmente [basic utente:password] o [header Nome:valore] ", len(params)))
+		return
+	}
+	nodo := params[0]
+	node := models.RPCNode{URL: params[1]}
+	if len(params) == 4 {
+		auth, err := models.ParseNodeAuth(params[2], params[3])
+		if err != nil {
+			say(fmt.Sprint("Problema sulle credenziali: ", err))
+			return
+		}
+		node.Auth = auth
+	}
+	if u, err := url.Parse(node.URL); err == nil && u.User != nil { //utente e password nell'url: li teniamo solo cifrati
+		if node.Auth == nil {
+			password, _ := u.User.Password()
+			node.Auth = &models.NodeAuth{Kind: models.AuthBasic, User: u.User.Username(), Password: password}
+		}
+		u.User = nil
+		node.URL = u.String()
+	}
+	log.Println("/addnode", nodo, node.URL, node.Auth)
+	if node.Auth != nil { //il messaggio con le credenziali non deve restare nella chat
+		if err := env.DeleteMessage(chatID, body.Message.MessageID); err != nil {
+			log.Println("/addnode error deleting message:", err)
+			say("⚠️ Non riesco a cancellare il messaggio con le credenziali, cancellalo tu.")
+		}
+	}
+	sealed, err := env.SealNodeAuth(node.Auth)
+	if err != nil {
+		log.Println("/addnode error sealing credentials:", err)
+		say("Questo bot non è configurato per salvare credenziali dei nodi (manca secret_key), non salvo il nodo.")
+		return
+	}
+	ni, err := env.ProbeNode(node)
+	switch {
+	case err == models.ErrNotIncognitoNode:
+		say(fmt.Sprintf("\"%s\" risponde ma non come un nodo Incognito, non lo salvo. L'url è quello RPC del nodo, es. http://1.2.3.4:9334", nodo))
+		return
+	case errors.Is(err, models.ErrRPCUnauthorized):
+		say(fmt.Sprintf("\"%s\" rifiuta la richiesta: servono credenziali (basic o header) o quelle date non sono giuste, non lo salvo.", nodo))
+		return
+	case err != nil:
+		log.Println("/addnode probe error:", err)
+		say(fmt.Sprintf("Non riesco a contattare \"%s\", non lo salvo: controlla url e porta RPC del nodo (%s)", nodo, err))
+		return
+	}
+	urlnode := &models.UrlNode{ChatID: chatID, NodeName: nodo, NodeURL: node.URL, Info: ni, ProbeTS: models.MakeTSFromTime(time.Now()), Auth: sealed}
+	if err = env.Db.UpdateUrlNode(urlnode); err != nil {
+		say(fmt.Sprint("Problema aggiornamento nodo: ", err))
+		return
+	}
+	messaggio := fmt.Sprintf("Nodo aggiornato: \"%s\" %s%s\n%s", nodo, node.URL, env.nodeAuthText(urlnode), nodeInfoText(ni))
+	if ni.Behind() {
+		messaggio = fmt.Sprintf("%s\n⚠️ Il nodo è indietro di %d blocchi beacon rispetto al fullnode di riferimento, forse non è sincronizzato.", messaggio, ni.BeaconLag)
+	}
+	say(messaggio)
+}
+
+//ritorna il tipo di credenziali del nodo, mai i segreti
+func (env MyEnv) nodeAuthText(urlnode *models.UrlNode) string {
+	if urlnode.Auth == "" {
+		return ""
+	}
+	node, err := env.RPCNode(urlnode)
+	if err != nil {
+		return " 🔒 credenziali non leggibili"
+	}
+	return " 🔒 " + node.Auth.String()
+}
+
+//ritorna il testo del messaggio da scrivere nel log, senza le credenziali di /addnode
+func (env MyEnv) redactedText(text string) string {
+	if env.StrCmd(text) != "/addnode" {
+		return text
+	}
+	params := strings.Fields(env.RemoveCmd(text))
+	if len(params) > 1 {
+		params[1] = models.RedactURL(params[1])
+	}
+	if len(params) > 2 {
+		params = append(params[:2], "[credenziali nascoste]")
+	}
+	return strings.Join(append([]string{"/addnode"}, params...), " ")
+}
+
+//ritorna chain, shard, versione ed altezza del beacon del nodo
+func nodeInfoText(ni *models.NodeInfo) string {
+	if ni == nil {
+		return "non verificato"
+	}
+	testo := fmt.Sprintf("%s, %d shard", ni.ChainName, ni.ActiveShards)
+	if ni.Version != "" {
+		testo = fmt.Sprintf("%s, versione %s", testo, ni.Version)
+	}
+	testo = fmt.Sprintf("%s, beacon %d", testo, ni.BeaconHeight)
+	switch {
+	case ni.Behind():
+		testo = fmt.Sprintf("%s ⚠️ indietro di %d", testo, ni.BeaconLag)
+	case ni.BeaconLag >= 0:
+		testo = fmt.Sprintf("%s, sincronizzato", testo)
+	}
+	return testo
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 15 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 120 * time.Second
+	maxHeaderBytes    = 64 << 10
+	maxUpdateSize     = 1 << 20          //dimensione massima di un update di telegram
+	shutdownTimeout   = 30 * time.Second //tempo per finire richieste, update in corso e job in background
+)
+
+//update o job ancora in esecuzione alla scadenza dello shutdown: il DB non va chiuso sotto di loro
+var errDrainTimeout = errors.New("shutdown timeout, updates or background jobs still running")
+
+// Job in background che vanno fermati prima di chiudere il DB
+type backgroundJobs struct {
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBackgroundJobs() *backgroundJobs {
+	return &backgroundJobs{quit: make(chan struct{})}
+}
+
+//esegue job ogni interval finché non viene chiamato Stop
+func (bj *backgroundJobs) every(interval time.Duration, job func()) {
+	bj.wg.Add(1)
+	go func() {
+		defer bj.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				job()
+			case <-bj.quit:
+				return
+			}
+		}
+	}()
+}
+
+//esegue job una volta in background
+func (bj *backgroundJobs) once(job func()) {
+	bj.wg.Add(1)
+	go func() {
+		defer bj.wg.Done()
+		job()
+	}()
+}
+
+//ferma i job periodici ed aspetta quelli in esecuzione
+func (bj *backgroundJobs) Stop() {
+	close(bj.quit)
+	bj.wg.Wait()
+}
+
+// Server HTTPS del webhook con endpoint di salute e shutdown ordinato
+type botServer struct {
+	env          *MyEnv
+	jobs         *backgroundJobs
+	shuttingDown int32
+}
+
+//vivo finché il processo risponde
+func (bs *botServer) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+//pronto se non in chiusura, il DB risponde ed il nodo è raggiungibile
+func (bs *botServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&bs.shuttingDown) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := bs.env.CheckReady(); err != nil {
+		log.Println("readyz:", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+//Serve il webhook fino a SIGINT/SIGTERM, poi smette di accettare richieste, finisce gli update
+//in coda ed i job in background e ritorna (il chiamante chiude il DB, tranne che con errDrainTimeout)
+func (bs *botServer) run() error {
+	env := bs.env
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", env.RootHandler)
+	mux.HandleFunc("/healthz", bs.healthz)
+	mux.HandleFunc("/readyz", bs.readyz)
+	mux.HandleFunc("/telegram"+env.TGTOKEN+"/", env.TelegramHandler)
+	server := &http.Server{
+		Addr:              env.LISTEN_ADDR,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		log.Println("Listening on", env.LISTEN_ADDR)
+		errc <- server.ListenAndServeTLS(env.CERT_FILE, env.KEY_FILE)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errc:
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if !bs.stop(ctx) {
+			log.Println("Server error:", err)
+			return errDrainTimeout
+		}
+		return err
+	case sig := <-signals:
+		log.Println("Received", sig, "shutting down")
+	}
+	atomic.StoreInt32(&bs.shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown error:", err)
+	}
+	if !bs.stop(ctx) {
+		return errDrainTimeout
+	}
+	return nil
+}
+
+//finisce gli update già accettati e ferma i job in background, aspettando al massimo fino alla scadenza
+//di ctx (la stessa dello shutdown del server): una chiamata RPC lenta non blocca la chiusura.
+//Ritorna false se alla scadenza qualcosa è ancora in esecuzione
+func (bs *botServer) stop(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		if bs.env.dispatcher != nil {
+			bs.env.dispatcher.Stop()
+		}
+		bs.jobs.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("Updates and background jobs stopped")
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
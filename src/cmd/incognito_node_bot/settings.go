@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+const settingsHelp = `Uso:
+/settings: mostra le impostazioni
+/settings [all|alias] [evento|all] [on|off]: attiva o disattiva le notifiche dell'evento per tutte le chiavi o per una
+/settings [all|alias] reward [PRV]: notifica il reward solo se cambia di almeno PRV
+/settings [all|alias] reset: torna alle impostazioni di default`
+
+//ritorna "on" o "off"
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// /settings: mostra o modifica le preferenze di notifica per evento e per chiave
+func (env MyEnv) cmdSettings(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	if len(params) == 0 {
+		say(env.printSettings(chatID))
+		return
+	}
+	if len(params) < 2 || len(params) > 3 {
+		say(settingsHelp)
+		return
+	}
+	if !env.canModify(body) {
+		return
+	}
+	pubkey := "" //preferenze per tutte le chiavi
+	scope := strings.ToLower(params[0])
+	if scope != "all" {
+		chatkey, err := env.Db.GetChatKey(chatID, params[0])
+		if err != nil {
+			say(fmt.Sprintf("Non trovo la chiave %s, vedi /listkeys", params[0]))
+			return
+		}
+		pubkey = chatkey.PubKey
+		scope = chatkey.KeyAlias
+	}
+	action := strings.ToLower(params[1])
+	switch {
+	case action == "reset" && len(params) == 2:
+		if err := env.Db.DelNotifyPrefs(chatID, pubkey); err != nil {
+			env.SayErr(chatID, err)
+			return
+		}
+		say(fmt.Sprintf("Impostazioni di %s tornate ai default.", scope))
+	case action == string(models.EventReward) && len(params) == 3 && params[2] != "on" && params[2] != "off":
+		prv, err := models.ParseAmount(params[2], models.PRVDecimals)
+		if err != nil || prv.Sign() < 0 {
+			say(fmt.Sprintf("Soglia non valida '%s', serve un numero di PRV", params[2]))
+			return
+		}
+		pref := &models.NotifyPref{ChatID: chatID, PubKey: pubkey, Event: models.EventReward, Enabled: true, Threshold: prv.Units}
+		if err := env.Db.SetNotifyPref(pref); err != nil {
+			env.SayErr(chatID, err)
+			return
+		}
+		say(fmt.Sprintf("%s: reward notificato se cambia di almeno %sPRV.", scope, prv))
+	case len(params) == 3 && (params[2] == "on" || params[2] == "off"):
+		events := []models.NotifyEvent{}
+		if action == "all" {
+			for _, ev := range models.NOTIFY_EVENTS {
+				events = append(events, ev.Event)
+			}
+		} else if event, ok := models.ParseNotifyEvent(action); ok {
+			events = append(events, event)
+		} else {
+			say(fmt.Sprintf("Evento sconosciuto '%s'.\n%s", params[1], env.printSettings(chatID)))
+			return
+		}
+		for _, event := range events {
+			pref := &models.NotifyPref{ChatID: chatID, PubKey: pubkey, Event: event, Enabled: params[2] == "on"}
+			if err := env.Db.SetNotifyPref(pref); err != nil {
+				env.SayErr(chatID, err)
+				return
+			}
+		}
+		say(fmt.Sprintf("%s: notifiche %s %s.", scope, action, params[2]))
+	default:
+		say(settingsHelp)
+	}
+}
+
+//elenca le impostazioni di notifica della chat: prima quelle generali, poi le eccezioni per chiave
+func (env MyEnv) printSettings(chatID int64) string {
+	prefs, err := env.Db.GetNotifyPrefs(chatID)
+	if err != nil {
+		return fmt.Sprint("Problema leggendo le impostazioni: ", err)
+	}
+	general := map[models.NotifyEvent]models.NotifyPref{}
+	perKey := map[string][]models.NotifyPref{}
+	for _, pref := range *prefs {
+		if pref.PubKey == "" {
+			general[pref.Event] = pref
+		} else {
+			perKey[pref.PubKey] = append(perKey[pref.PubKey], pref)
+		}
+	}
+	describe := func(pref models.NotifyPref) string {
+		if pref.Event == models.EventReward && pref.Enabled && pref.Threshold > 0 {
+			return fmt.Sprintf("on (>= %sPRV)", models.PRVAmount(pref.Threshold))
+		}
+		return onOff(pref.Enabled)
+	}
+	text := fmt.Sprintf("Notifiche: %s (/notify)\nTutte le chiavi:", onOff(env.Db.GetNotify(chatID)))
+	for _, ev := range models.NOTIFY_EVENTS {
+		pref, ok := general[ev.Event]
+		if !ok {
+			pref = models.NotifyPref{Event: ev.Event, Enabled: true}
+		}
+		text = fmt.Sprintf("%s\n  %s: %s (%s)", text, ev.Event, describe(pref), ev.Descr)
+	}
+	chatkeys, err := env.Db.GetChatKeys(chatID, env.LIST_LIMIT, 0)
+	if err == nil {
+		for _, chatkey := range *chatkeys {
+			if len(perKey[chatkey.PubKey]) == 0 {
+				continue
+			}
+			text = fmt.Sprintf("%s\n%s:", text, chatkey.KeyAlias)
+			for _, pref := range perKey[chatkey.PubKey] {
+				text = fmt.Sprintf("%s\n  %s: %s", text, pref.Event, describe(pref))
+			}
+		}
+	}
+	if ns, err := env.Db.GetNotifySchedule(chatID); err == nil {
+		text = fmt.Sprintf("%s\n%s", text, describeSchedule(ns))
+	}
+	return fmt.Sprintf("%s\n\n%s", text, settingsHelp)
+}
+
+//descrive ore di silenzio e modalità riepilogo
+func describeSchedule(ns *models.NotifySchedule) string {
+	tz := ns.TimeZone
+	if tz == "" {
+		tz = time.Local.String()
+	}
+	quiet := "off"
+	if ns.QuietStart != ns.QuietEnd {
+		quiet = fmt.Sprintf("%02d-%02d %s", ns.QuietStart, ns.QuietEnd, tz)
+	}
+	return fmt.Sprintf("Ore di silenzio: %s (/quiet)\nRiepilogo: %s (/digest)", quiet, ns.Digest)
+}
+
+// /tz [fuso|off]: fuso orario della chat per orari mostrati, ore di silenzio e riepiloghi
+func (env MyEnv) cmdTz(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	if len(params) == 0 {
+		loc := env.Db.GetChatLocation(chatID)
+		say(fmt.Sprintf("Fuso orario: %s, ora sono le %s\nUso: /tz Europe/Rome oppure /tz off per quello del bot", loc, time.Now().In(loc).Format("15:04")))
+		return
+	}
+	if len(params) > 1 {
+		say("Problema sui parametri, serve /tz fuso (es. Europe/Rome) oppure /tz off")
+		return
+	}
+	tz := params[0]
+	if strings.ToLower(tz) == "off" {
+		tz = ""
+	} else if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+		say(fmt.Sprintf("Fuso orario sconosciuto '%s' (es. Europe/Rome, America/New_York, UTC)", tz))
+		return
+	}
+	if !env.canModify(body) {
+		return
+	}
+	if err := env.Db.SetChatTimeZone(chatID, tz); err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	loc := models.LoadLocationOrLocal(tz)
+	say(fmt.Sprintf("Fuso orario: %s, ora sono le %s", loc, time.Now().In(loc).Format("15:04")))
+}
+
+// /fiat [valuta|off]: valuta in cui mostrare il valore dei reward
+func (env MyEnv) cmdFiat(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	if len(params) == 0 {
+		messaggio := fmt.Sprintf("Valuta: %s\nUso: /fiat EUR oppure /fiat off", env.Db.GetChatFiat(chatID))
+		if env.Prices == nil {
+			messaggio += "\n(i prezzi non sono configurati su questo bot)"
+		}
+		say(messaggio)
+		return
+	}
+	fiat := strings.ToUpper(params[0])
+	if strings.ToLower(fiat) == models.FiatOff {
+		fiat = models.FiatOff
+	} else if len(params) > 1 || len(fiat) < 3 || len(fiat) > 5 {
+		say("Problema sui parametri, serve /fiat valuta (es. EUR, USD) oppure /fiat off")
+		return
+	}
+	if !env.canModify(body) {
+		return
+	}
+	if err := env.Db.SetChatFiat(chatID, fiat); err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	say(fmt.Sprintf("Valuta: %s", fiat))
+}
+
+// /quiet [hh-hh|off] [fuso]: ore in cui le notifiche non critiche aspettano la fine del silenzio
+func (env MyEnv) cmdQuiet(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	ns, err := env.Db.GetNotifySchedule(chatID)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	if len(params) == 0 {
+		say(describeSchedule(ns) + "\nUso: /quiet 23-07 [Europe/Rome] oppure /quiet off")
+		return
+	}
+	if len(params) > 2 {
+		say("Problema sui parametri, serve /quiet hh-hh [fuso] oppure /quiet off")
+		return
+	}
+	if !env.canModify(body) {
+		return
+	}
+	if strings.ToLower(params[0]) == "off" {
+		ns.QuietStart, ns.QuietEnd = 0, 0
+	} else {
+		var start, end int
+		if n, err := fmt.Sscanf(params[0], "%d-%d", &start, &end); err != nil || n != 2 || start < 0 || start > 23 || end < 0 || end > 23 {
+			say(fmt.Sprintf("Orario non valido '%s', serve hh-hh (es. 23-07)", params[0]))
+			return
+		}
+		ns.QuietStart, ns.QuietEnd = start, end
+	}
+	if len(params) == 2 {
+		if _, err := time.LoadLocation(params[1]); err != nil {
+			say(fmt.Sprintf("Fuso orario sconosciuto '%s' (es. Europe/Rome)", params[1]))
+			return
+		}
+		ns.TimeZone = params[1]
+	}
+	if err := env.Db.SetNotifySchedule(ns); err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	say(describeSchedule(ns))
+}
+
+// /digest [off|daily|epoch]: riceve le notifiche non critiche in un unico riepilogo
+func (env MyEnv) cmdDigest(body *webhookReqBody, params []string) {
+	chatID := body.Message.Chat.ID
+	say := func(messaggio string) {
+		if err := env.SayText(chatID, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	ns, err := env.Db.GetNotifySchedule(chatID)
+	if err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	if len(params) == 0 {
+		say(describeSchedule(ns) + "\nUso: /digest off|daily|epoch (chiave missing e autostake off arrivano sempre subito)")
+		return
+	}
+	mode := strings.ToLower(params[0])
+	if len(params) > 1 || (mode != models.DigestOff && mode != models.DigestDaily && mode != models.DigestEpoch) {
+		say("Problema sui parametri, serve /digest off|daily|epoch")
+		return
+	}
+	if !env.canModify(body) {
+		return
+	}
+	if mode != ns.Digest {
+		ns.Digest = mode
+		ns.LastDigest = models.MakeTSFromTime(time.Now()) //il primo riepilogo parte dal prossimo periodo
+		ns.LastDigestEpoch = 0
+		if bbsd := (models.BBSD{}); env.GetBeaconSnapshot(nil, &bbsd) == nil {
+			ns.LastDigestEpoch = int64(bbsd.Result.Epoch)
+		}
+	}
+	if err := env.Db.SetNotifySchedule(ns); err != nil {
+		env.SayErr(chatID, err)
+		return
+	}
+	say(describeSchedule(ns))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/robotrongt/incognito_node_bot/src/models"
+)
+
+const webhookUsage = "usage: incognito_node_bot [flags] webhook set|delete [-drop-pending]|info"
+
+//esegue il sottocomando webhook set|delete|info e ritorna il codice di uscita
+func webhookCmd(env *models.Env, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, webhookUsage)
+		return 2
+	}
+	switch args[0] {
+	case "set":
+		if err := env.SetWebhook(); err != nil {
+			fmt.Fprintln(os.Stderr, "webhook set:", err)
+			return 1
+		}
+		fmt.Println("webhook set")
+		return printWebhookInfo(env)
+	case "delete":
+		fs := flag.NewFlagSet("webhook delete", flag.ContinueOnError)
+		dropPending := fs.Bool("drop-pending", false, "also drop the updates waiting to be delivered")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if err := env.DeleteWebhook(*dropPending); err != nil {
+			fmt.Fprintln(os.Stderr, "webhook delete:", err)
+			return 1
+		}
+		fmt.Println("webhook deleted")
+		return 0
+	case "info":
+		return printWebhookInfo(env)
+	default:
+		fmt.Fprintln(os.Stderr, webhookUsage)
+		return 2
+	}
+}
+
+//stampa il webhook registrato e le differenze dalla configurazione
+func printWebhookInfo(env *models.Env) int {
+	info, err := env.GetWebhookInfo()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "webhook info:", err)
+		return 1
+	}
+	fmt.Println(info.String(env.TGTOKEN))
+	mismatches := env.WebhookMismatches(info)
+	for _, mismatch := range mismatches {
+		fmt.Println("mismatch:", mismatch)
+	}
+	if len(mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
+
+//all'avvio confronta il webhook registrato con la configurazione e segnala code ed errori
+func checkWebhook(env *models.Env) {
+	info, err := env.GetWebhookInfo()
+	if err != nil {
+		log.Println("checkWebhook: cannot get webhook info:", err)
+		return
+	}
+	log.Printf("checkWebhook: %d pending updates\n", info.PendingUpdateCount)
+	if info.LastErrorDate > 0 {
+		log.Printf("checkWebhook: last error %s: %s\n", models.GetTSString(info.LastErrorDate), info.LastErrorMessage)
+	}
+	for _, mismatch := range env.WebhookMismatches(info) {
+		log.Println("checkWebhook: WARNING", mismatch, "(run: incognito_node_bot webhook set)")
+	}
+}
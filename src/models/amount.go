@@ -0,0 +1,140 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const PRVDecimals = 9 //decimali del PRV, i reward arrivano in nano PRV
+
+// Importo esatto: unità base intere (es. nano PRV) più il numero di decimali del token
+type Amount struct {
+	Units    int64
+	Decimals int
+}
+
+var ErrAmountOverflow = errors.New("amount overflow")
+
+func NewAmount(units int64, decimals int) Amount {
+	return Amount{Units: units, Decimals: decimals}
+}
+
+//importo in PRV da nano PRV
+func PRVAmount(units int64) Amount {
+	return NewAmount(units, PRVDecimals)
+}
+
+//Legge un importo decimale ("1.5", "-0.000001", "3") con al massimo decimals cifre dopo la virgola
+func ParseAmount(s string, decimals int) (Amount, error) {
+	str := strings.TrimSpace(s)
+	neg := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+	intPart, fracPart := str, ""
+	if i := strings.IndexAny(str, ".,"); i >= 0 {
+		intPart, fracPart = str[:i], str[i+1:]
+	}
+	if (intPart == "" && fracPart == "") || strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return Amount{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(fracPart) > decimals {
+		if strings.Trim(fracPart[decimals:], "0") != "" {
+			return Amount{}, fmt.Errorf("amount %q has more than %d decimals", s, decimals)
+		}
+		fracPart = fracPart[:decimals]
+	}
+	digits := strings.TrimLeft(intPart+fracPart+strings.Repeat("0", decimals-len(fracPart)), "0")
+	if digits == "" {
+		return NewAmount(0, decimals), nil
+	}
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Amount{}, ErrAmountOverflow
+	}
+	if neg {
+		units = -units
+	}
+	return NewAmount(units, decimals), nil
+}
+
+//importo esatto con tutti i decimali del token, es. 1.500000000
+func (a Amount) String() string {
+	if a.Decimals <= 0 {
+		return strconv.FormatInt(a.Units, 10)
+	}
+	digits := strconv.FormatInt(a.Units, 10)
+	sign := ""
+	if a.Units < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if len(digits) <= a.Decimals {
+		digits = strings.Repeat("0", a.Decimals-len(digits)+1) + digits
+	}
+	cut := len(digits) - a.Decimals
+	return sign + digits[:cut] + "." + digits[cut:]
+}
+
+//valore approssimato, solo per calcoli non esatti (prezzi, metriche)
+func (a Amount) Float64() float64 {
+	f, _ := strconv.ParseFloat(a.String(), 64)
+	return f
+}
+
+func (a Amount) Sign() int {
+	switch {
+	case a.Units < 0:
+		return -1
+	case a.Units > 0:
+		return 1
+	}
+	return 0
+}
+
+func (a Amount) Neg() Amount {
+	return NewAmount(-a.Units, a.Decimals)
+}
+
+//valore assoluto
+func (a Amount) Abs() Amount {
+	if a.Units < 0 {
+		return a.Neg()
+	}
+	return a
+}
+
+//unità base scalate a decimals (maggiore o uguale a quelli dell'importo)
+func (a Amount) bigUnits(decimals int) *big.Int {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals-a.Decimals)), nil)
+	return scale.Mul(scale, big.NewInt(a.Units))
+}
+
+func maxDecimals(a, b Amount) int {
+	if a.Decimals > b.Decimals {
+		return a.Decimals
+	}
+	return b.Decimals
+}
+
+//Somma esatta, il risultato ha il maggiore dei decimali dei due importi
+func (a Amount) Add(b Amount) (Amount, error) {
+	decimals := maxDecimals(a, b)
+	sum := a.bigUnits(decimals)
+	sum.Add(sum, b.bigUnits(decimals))
+	if !sum.IsInt64() {
+		return Amount{}, ErrAmountOverflow
+	}
+	return NewAmount(sum.Int64(), decimals), nil
+}
+
+//Differenza esatta a - b
+func (a Amount) Sub(b Amount) (Amount, error) {
+	return a.Add(b.Neg())
+}
+
+//Confronto esatto anche con decimali diversi: -1 se a < b, 0 se uguali, 1 se a > b
+func (a Amount) Cmp(b Amount) int {
+	decimals := maxDecimals(a, b)
+	return a.bigUnits(decimals).Cmp(b.bigUnits(decimals))
+}
@@ -0,0 +1,66 @@
+package models
+
+import "testing"
+
+func TestAmountString(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		want   string
+	}{
+		{NewAmount(1500000000, 9), "1.500000000"},
+		{NewAmount(1, 9), "0.000000001"},
+		{NewAmount(-123456, 6), "-0.123456"},
+		{NewAmount(9223372036854775807, 6), "9223372036854.775807"},
+		{NewAmount(42, 0), "42"},
+		{NewAmount(0, 6), "0.000000"},
+	}
+	for _, tt := range tests {
+		if got := tt.amount.String(); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s        string
+		decimals int
+		want     int64
+		ok       bool
+	}{
+		{"1.5", 9, 1500000000, true},
+		{"0,000001", 6, 1, true},
+		{"-3", 6, -3000000, true},
+		{".25", 2, 25, true},
+		{"1.2300", 2, 123, true},
+		{"1.234", 2, 0, false},
+		{"abc", 9, 0, false},
+		{"", 9, 0, false},
+		{"99999999999", 9, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.s, tt.decimals)
+		if (err == nil) != tt.ok || (tt.ok && got.Units != tt.want) {
+			t.Errorf("ParseAmount(%q, %d) = %+v, %v", tt.s, tt.decimals, got, err)
+		}
+	}
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	a := NewAmount(1, 6)      //0.000001
+	b := NewAmount(999000, 9) //0.000999
+	sum, err := a.Add(b)
+	if err != nil || sum.String() != "0.001000000" {
+		t.Errorf("Add: got %s, %v", sum, err)
+	}
+	if a.Cmp(NewAmount(1000, 9)) != 0 || a.Cmp(b) != -1 || b.Cmp(a) != 1 {
+		t.Errorf("Cmp with different decimals")
+	}
+	diff, _ := a.Sub(b)
+	if diff.String() != "-0.000998000" || diff.Abs().Sign() != 1 {
+		t.Errorf("Sub: got %s", diff)
+	}
+	if _, err := NewAmount(9223372036854775807, 9).Add(NewAmount(1, 9)); err != ErrAmountOverflow {
+		t.Errorf("Add overflow: got %v", err)
+	}
+}
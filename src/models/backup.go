@@ -0,0 +1,385 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const MaxBackupSize = 1 << 20 //dimensione massima di un file da importare
+
+// Chiavi e nodi di una chat, per /export e /import
+type ChatBackup struct {
+	Keys  []BackupKey  `json:"keys"`
+	Nodes []BackupNode `json:"nodes"`
+}
+type BackupKey struct {
+	Alias  string `json:"alias"`
+	PubKey string `json:"pubkey"`
+}
+type BackupNode struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	HasAuth bool   `json:"-"` //il nodo ha credenziali, che non vengono esportate
+}
+
+// Errore di validazione di una riga del file importato
+type BackupError struct {
+	Where string //es. "row 3" per il csv o "keys[2]" per la validazione
+	Err   error
+}
+
+func (be BackupError) Error() string {
+	return fmt.Sprintf("%s: %s", be.Where, be.Err)
+}
+
+// Anteprima delle modifiche che farebbe un import
+type BackupPreview struct {
+	AddedKeys, UpdatedKeys, RemovedKeys    []string
+	AddedNodes, UpdatedNodes, RemovedNodes []string
+}
+
+//ritorna vero se l'import non cambia nulla
+func (bp *BackupPreview) Empty() bool {
+	return len(bp.AddedKeys)+len(bp.UpdatedKeys)+len(bp.RemovedKeys)+len(bp.AddedNodes)+len(bp.UpdatedNodes)+len(bp.RemovedNodes) == 0
+}
+
+func (bp *BackupPreview) String() string {
+	text := ""
+	add := func(label string, names []string) {
+		if len(names) > 0 {
+			text = fmt.Sprintf("%s\n%s (%d): %s", text, label, len(names), strings.Join(names, ", "))
+		}
+	}
+	add("➕ keys", bp.AddedKeys)
+	add("✏️ keys", bp.UpdatedKeys)
+	add("➖ keys", bp.RemovedKeys)
+	add("➕ nodes", bp.AddedNodes)
+	add("✏️ nodes", bp.UpdatedNodes)
+	add("➖ nodes", bp.RemovedNodes)
+	if text == "" {
+		return "No changes."
+	}
+	return strings.TrimLeft(text, "\n")
+}
+
+func (cb *ChatBackup) ToJSON() ([]byte, error) {
+	return json.MarshalIndent(cb, "", "  ")
+}
+
+//csv con intestazione type,name,value dove type è "key" o "node"
+func (cb *ChatBackup) ToCSV() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write([]string{"type", "name", "value"})
+	for _, k := range cb.Keys {
+		w.Write([]string{"key", k.Alias, k.PubKey})
+	}
+	for _, n := range cb.Nodes {
+		w.Write([]string{"node", n.Name, n.URL})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+//legge il file importato, json o csv in base all'estensione o al contenuto
+func ParseChatBackup(filename string, data []byte) (*ChatBackup, error) {
+	if len(data) > MaxBackupSize {
+		return nil, fmt.Errorf("file too big: %d bytes, max %d", len(data), MaxBackupSize)
+	}
+	trimmed := bytes.TrimSpace(data)
+	if strings.HasSuffix(strings.ToLower(filename), ".json") || bytes.HasPrefix(trimmed, []byte("{")) {
+		cb := &ChatBackup{}
+		if err := json.Unmarshal(trimmed, cb); err != nil {
+			return nil, err
+		}
+		return cb, nil
+	}
+	return parseBackupCSV(data)
+}
+
+func parseBackupCSV(data []byte) (*ChatBackup, error) {
+	cb := &ChatBackup{}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	errs := BackupErrors{}
+	row := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		where := fmt.Sprintf("row %d", row)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", where, err)
+		}
+		if len(record) != 3 {
+			errs = append(errs, BackupError{where, fmt.Errorf("need 3 fields type,name,value, found %d", len(record))})
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(record[0])) {
+		case "type": //intestazione
+		case "key":
+			cb.Keys = append(cb.Keys, BackupKey{Alias: strings.TrimSpace(record[1]), PubKey: strings.TrimSpace(record[2])})
+		case "node":
+			cb.Nodes = append(cb.Nodes, BackupNode{Name: strings.TrimSpace(record[1]), URL: strings.TrimSpace(record[2])})
+		default:
+			errs = append(errs, BackupError{where, fmt.Errorf("unknown type %q, need key or node", record[0])})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cb, nil
+}
+
+// Tutti gli errori di validazione del file importato
+type BackupErrors []BackupError
+
+func (be BackupErrors) Error() string {
+	lines := []string{}
+	for _, e := range be {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+//valida tutte le righe: alias e nomi non vuoti e non duplicati, chiavi valide (risolte con
+//il beacon state bbsd se disponibile, sostituendo le chiavi bls con la public key) e url http(s).
+//Ritorna BackupErrors con tutte le righe sbagliate.
+func (cb *ChatBackup) Validate(bbsd *BBSD) error {
+	errs := BackupErrors{}
+	aliases := map[string]bool{}
+	for i := range cb.Keys {
+		k := &cb.Keys[i]
+		where := fmt.Sprintf("keys[%d] %q", i, k.Alias)
+		if k.Alias == "" || strings.ContainsAny(k.Alias, " \t") {
+			errs = append(errs, BackupError{where, errors.New("alias must be a single non empty word")})
+			continue
+		}
+		if aliases[k.Alias] {
+			errs = append(errs, BackupError{where, errors.New("duplicated alias")})
+			continue
+		}
+		aliases[k.Alias] = true
+		rk, err := ResolvePubKey(bbsd, k.PubKey)
+		if err != nil {
+			errs = append(errs, BackupError{where, err})
+			continue
+		}
+		k.PubKey = rk.IncPubKey
+	}
+	names := map[string]bool{}
+	for i, n := range cb.Nodes {
+		where := fmt.Sprintf("nodes[%d] %q", i, n.Name)
+		if n.Name == "" || strings.ContainsAny(n.Name, " \t") {
+			errs = append(errs, BackupError{where, errors.New("name must be a single non empty word")})
+			continue
+		}
+		if names[n.Name] {
+			errs = append(errs, BackupError{where, errors.New("duplicated name")})
+			continue
+		}
+		names[n.Name] = true
+		u, err := url.Parse(n.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, BackupError{where, fmt.Errorf("invalid url %q", n.URL)})
+			continue
+		}
+		if u.User != nil { //le credenziali si salvano solo cifrate con /addnode
+			errs = append(errs, BackupError{where, errors.New("credentials in the url are not imported, remove them and add them with /addnode")})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//confronta il backup attuale della chat con quello da importare
+func (cb *ChatBackup) Preview(current *ChatBackup) *BackupPreview {
+	bp := &BackupPreview{}
+	oldKeys := map[string]string{}
+	for _, k := range current.Keys {
+		oldKeys[k.Alias] = k.PubKey
+	}
+	for _, k := range cb.Keys {
+		old, ok := oldKeys[k.Alias]
+		switch {
+		case !ok:
+			bp.AddedKeys = append(bp.AddedKeys, k.Alias)
+		case old != k.PubKey:
+			bp.UpdatedKeys = append(bp.UpdatedKeys, k.Alias)
+		}
+		delete(oldKeys, k.Alias)
+	}
+	for alias := range oldKeys {
+		bp.RemovedKeys = append(bp.RemovedKeys, alias)
+	}
+	oldNodes := map[string]string{}
+	for _, n := range current.Nodes {
+		oldNodes[n.Name] = n.URL
+	}
+	for _, n := range cb.Nodes {
+		old, ok := oldNodes[n.Name]
+		switch {
+		case !ok:
+			bp.AddedNodes = append(bp.AddedNodes, n.Name)
+		case old != n.URL:
+			bp.UpdatedNodes = append(bp.UpdatedNodes, n.Name)
+		}
+		delete(oldNodes, n.Name)
+	}
+	for name := range oldNodes {
+		bp.RemovedNodes = append(bp.RemovedNodes, name)
+	}
+	sort.Strings(bp.RemovedKeys)
+	sort.Strings(bp.RemovedNodes)
+	return bp
+}
+
+//Recupera chiavi e nodi della chat
+func (db *DBnode) GetChatBackup(chatID int64) (*ChatBackup, error) {
+	cb := &ChatBackup{Keys: []BackupKey{}, Nodes: []BackupNode{}}
+	rows, err := db.DB.Query("SELECT `KeyAlias`,`PubKey` FROM `chatkeys` WHERE ChatID = ? ORDER BY `KeyAlias`", chatID)
+	if err != nil {
+		dbError("GetChatBackup", err)
+		return nil, err
+	}
+	for rows.Next() {
+		k := BackupKey{}
+		if err = rows.Scan(&k.Alias, &k.PubKey); err != nil {
+			rows.Close()
+			dbError("GetChatBackup", err)
+			return nil, err
+		}
+		cb.Keys = append(cb.Keys, k)
+	}
+	rows.Close()
+	rows, err = db.DB.Query("SELECT `NodeName`,`NodeURL`,`Auth` != '' FROM `urlnodes` WHERE ChatID = ? ORDER BY `NodeName`", chatID)
+	if err != nil {
+		dbError("GetChatBackup", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		n := BackupNode{}
+		if err = rows.Scan(&n.Name, &n.URL, &n.HasAuth); err != nil {
+			dbError("GetChatBackup", err)
+			return nil, err
+		}
+		cb.Nodes = append(cb.Nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		dbError("GetChatBackup", err)
+		return nil, err
+	}
+	return cb, nil
+}
+
+//Sostituisce in un'unica transazione chiavi e nodi della chat con quelli del backup.
+//I nodi già presenti vengono aggiornati così mantengono il loro UNId.
+func (db *DBnode) ApplyChatBackup(chatID int64, cb *ChatBackup) error {
+	log.Println("ApplyChatBackup:", chatID, len(cb.Keys), len(cb.Nodes))
+	current, err := db.GetChatBackup(chatID)
+	if err != nil {
+		return err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		dbError("ApplyChatBackup", err)
+		return err
+	}
+	exec := func(query string, args ...interface{}) error {
+		_, err := tx.Exec(query, args...)
+		if err != nil {
+			dbError("ApplyChatBackup", err)
+			tx.Rollback()
+		}
+		return err
+	}
+	if err = exec("DELETE FROM `chatkeys` WHERE `ChatID` = ?", chatID); err != nil {
+		return err
+	}
+	for _, k := range cb.Keys {
+		if err = exec("INSERT INTO `chatkeys`(`ChatID`,`KeyAlias`,`PubKey`) VALUES (?,?,?)", chatID, k.Alias, k.PubKey); err != nil {
+			return err
+		}
+	}
+	newNodes := map[string]string{}
+	for _, n := range cb.Nodes {
+		newNodes[n.Name] = n.URL
+	}
+	for _, n := range current.Nodes {
+		if _, ok := newNodes[n.Name]; !ok {
+			if err = exec("DELETE FROM `urlnodes` WHERE `ChatID` = ? AND `NodeName` = ?", chatID, n.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = exec("UPDATE `urlnodes` SET `ProbeTS` = CASE WHEN `NodeURL` = ? THEN `ProbeTS` ELSE 0 END, `Auth` = CASE WHEN `NodeURL` = ? THEN `Auth` ELSE '' END, `DownChecks` = CASE WHEN `NodeURL` = ? THEN `DownChecks` ELSE 0 END, `NodeURL` = ? WHERE `ChatID` = ? AND `NodeName` = ?", newNodes[n.Name], newNodes[n.Name], newNodes[n.Name], newNodes[n.Name], chatID, n.Name); err != nil {
+			return err
+		}
+		delete(newNodes, n.Name)
+	}
+	for _, n := range cb.Nodes {
+		if _, ok := newNodes[n.Name]; !ok {
+			continue //già aggiornato
+		}
+		if err = exec("INSERT INTO `urlnodes`(`ChatID`,`NodeName`,`NodeURL`) VALUES (?,?,?)", chatID, n.Name, n.URL); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		dbError("ApplyChatBackup", err)
+	}
+	return err
+}
+
+//Salva l'import in attesa di conferma della chat (uno solo per chat)
+func (db *DBnode) SetPendingImport(chatID int64, cb *ChatBackup, ts int64) error {
+	payload, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("INSERT OR REPLACE INTO `pendingimports`(`ChatID`,`Payload`,`Timestamp`) VALUES (?,?,?)", chatID, string(payload), ts)
+	if err != nil {
+		dbError("SetPendingImport", err)
+	}
+	return err
+}
+
+//Recupera l'import in attesa di conferma della chat e il suo timestamp
+func (db *DBnode) GetPendingImport(chatID int64) (*ChatBackup, int64, error) {
+	payload := ""
+	ts := int64(0)
+	err := db.DB.QueryRow("SELECT `Payload`,`Timestamp` FROM `pendingimports` WHERE `ChatID` = ?", chatID).Scan(&payload, &ts)
+	if err != nil {
+		dbError("GetPendingImport", err)
+		return nil, 0, err
+	}
+	cb := &ChatBackup{}
+	if err := json.Unmarshal([]byte(payload), cb); err != nil {
+		return nil, 0, err
+	}
+	return cb, ts, nil
+}
+
+//Elimina l'import in attesa di conferma della chat
+func (db *DBnode) DelPendingImport(chatID int64) error {
+	_, err := db.DB.Exec("DELETE FROM `pendingimports` WHERE `ChatID` = ?", chatID)
+	if err != nil {
+		dbError("DelPendingImport", err)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Ruolo e dati di una chiave nel beacon state
+type PubKeyIndexEntry struct {
+	Role          string
+	Shard         string
+	InAutoStaking bool //presente nella lista AutoStaking
+	IsAutoStake   bool
+	MiningPubKey  TMiningPubKey
+}
+
+// Indice del beacon state per public key e per chiave bls, costruito una volta per stato letto
+type BeaconIndex struct {
+	byPubKey map[string]*PubKeyIndexEntry
+	byBls    map[string]*TPubKeyAuto
+}
+
+//Costruisce l'indice. I ruoli vengono inseriti dal meno al più prioritario,
+//così una chiave presente in più liste ha lo stesso ruolo che le dava la ricerca lineare.
+func NewBeaconIndex(result *TBeaconStateResult) *BeaconIndex {
+	bi := &BeaconIndex{byPubKey: map[string]*PubKeyIndexEntry{}, byBls: map[string]*TPubKeyAuto{}}
+	entry := func(pubkey string) *PubKeyIndexEntry {
+		e, ok := bi.byPubKey[pubkey]
+		if !ok {
+			e = &PubKeyIndexEntry{Role: RoleMissing}
+			bi.byPubKey[pubkey] = e
+		}
+		return e
+	}
+	setRole := func(arr []TPubKey, role, shard string) {
+		for _, tpk := range arr {
+			e := entry(tpk.IncPubKey)
+			e.Role, e.Shard = role, shard
+		}
+	}
+	setRole(result.BeaconCommittee, RoleBeaconCommittee, "")
+	setRole(result.BeaconPendingValidator, RoleBeaconPending, "")
+	setRole(result.CandidateBeaconWaitingForCurrentRandom, RoleBeaconWaiting, "")
+	setRole(result.CandidateBeaconWaitingForNextRandom, RoleBeaconWaiting, "")
+	for shard, arr := range result.ShardCommittee {
+		setRole(arr, RoleCommittee, shard)
+	}
+	for shard, arr := range result.ShardPendingValidator {
+		setRole(arr, RolePending, shard)
+	}
+	setRole(result.CandidateShardWaitingForCurrentRandom, RoleWaiting, "")
+	setRole(result.CandidateShardWaitingForNextRandom, RoleWaiting, "")
+	for i := range result.AutoStaking {
+		tpka := &result.AutoStaking[i]
+		if e := entry(tpka.IncPubKey); !e.InAutoStaking { //vale la prima occorrenza
+			e.InAutoStaking = true
+			e.IsAutoStake = tpka.IsAutoStake
+			e.MiningPubKey = tpka.MiningPubKey
+		}
+		if _, ok := bi.byBls[tpka.MiningPubKey.Bls]; !ok {
+			bi.byBls[tpka.MiningPubKey.Bls] = tpka
+		}
+	}
+	return bi
+}
+
+//ritorna i dati della chiave, nil se non compare nel beacon state
+func (bi *BeaconIndex) Lookup(pubkey string) *PubKeyIndexEntry {
+	return bi.byPubKey[pubkey]
+}
+
+//ritorna la chiave in AutoStaking con quella chiave bls (senza prefisso), nil se non c'è
+func (bi *BeaconIndex) LookupBls(bls string) *TPubKeyAuto {
+	return bi.byBls[bls]
+}
+
+//Ritorna l'indice dello stato, costruendolo se serve. Lo stato letto da GetBeaconBestStateDetail
+//ha già l'indice; uno costruito a mano non va modificato dopo la prima chiamata.
+func (bbsd *BBSD) Index() *BeaconIndex {
+	if bbsd.index == nil {
+		bbsd.index = NewBeaconIndex(&bbsd.Result)
+	}
+	return bbsd.index
+}
+
+//Decodifica la risposta di getbeaconbeststatedetail campo per campo dallo stream:
+//i campi che non usiamo vengono saltati senza tenerli in memoria tutti insieme
+func decodeBeaconState(r io.Reader, bbsd *BBSD) error {
+	dec := json.NewDecoder(r)
+	return decodeObject(dec, reflect.ValueOf(bbsd).Elem(), func(name string, field reflect.Value) error {
+		if name == "Result" {
+			return decodeObject(dec, field, nil)
+		}
+		return dec.Decode(field.Addr().Interface())
+	})
+}
+
+//decodifica un oggetto json nei campi della struct v (nome senza distinzione di maiuscole),
+//decodeField se non nil decide come decodificare i campi trovati
+func decodeObject(dec *json.Decoder, v reflect.Value, decodeField func(string, reflect.Value) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil { //null
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("decodeObject: expected object, got %v", tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := tok.(string)
+		field := v.FieldByNameFunc(func(f string) bool { return strings.EqualFold(f, name) })
+		if !field.IsValid() || !field.CanSet() { //campo che non ci serve
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if decodeField != nil {
+			err = decodeField(name, field)
+		} else {
+			err = dec.Decode(field.Addr().Interface())
+		}
+		if err != nil {
+			return fmt.Errorf("decodeObject %s: %v", name, err)
+		}
+	}
+	_, err = dec.Token() //'}'
+	return err
+}
@@ -0,0 +1,237 @@
+package models
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//genera uno stato del beacon con shards shard da perShard chiavi in committee ed altrettante in pending,
+//più chiavi in waiting, nel beacon e campi che non usiamo, come lo restituisce il nodo
+func largeBeaconState(shards, perShard int) *BBSD {
+	bbsd := &BBSD{Id: 1, Jsonrpc: "1.0", Method: "getbeaconbeststatedetail"}
+	r := &bbsd.Result
+	r.Epoch, r.BeaconHeight, r.ActiveShards = 1234, 432100, shards
+	r.ShardCommittee = map[string][]TPubKey{}
+	r.ShardPendingValidator = map[string][]TPubKey{}
+	n := 0
+	key := func() TPubKey {
+		n++
+		return TPubKey{IncPubKey: fmt.Sprintf("inc%08d", n), MiningPubKey: TMiningPubKey{Bls: fmt.Sprintf("bls%08d", n), Dsa: fmt.Sprintf("dsa%08d", n)}}
+	}
+	for s := 0; s < shards; s++ {
+		shard := fmt.Sprint(s)
+		for i := 0; i < perShard; i++ {
+			r.ShardCommittee[shard] = append(r.ShardCommittee[shard], key())
+			r.ShardPendingValidator[shard] = append(r.ShardPendingValidator[shard], key())
+		}
+	}
+	for i := 0; i < perShard; i++ {
+		r.CandidateShardWaitingForNextRandom = append(r.CandidateShardWaitingForNextRandom, key())
+		r.CandidateShardWaitingForCurrentRandom = append(r.CandidateShardWaitingForCurrentRandom, key())
+	}
+	for i := 0; i < 4; i++ {
+		r.BeaconCommittee = append(r.BeaconCommittee, key())
+		r.BeaconPendingValidator = append(r.BeaconPendingValidator, key())
+	}
+	//la stessa chiave in più liste: vince il ruolo prioritario
+	r.CandidateShardWaitingForNextRandom = append(r.CandidateShardWaitingForNextRandom, r.ShardCommittee["0"][0])
+	for i := 1; i <= n; i++ {
+		pk := fmt.Sprintf("inc%08d", i)
+		r.AutoStaking = append(r.AutoStaking, TPubKeyAuto{IncPubKey: pk, MiningPubKey: TMiningPubKey{Bls: fmt.Sprintf("bls%08d", i)}, IsAutoStake: i%3 != 0})
+	}
+	return bbsd
+}
+
+//json dello stato con i campi che decodeBeaconState deve saltare
+func beaconStateJSON(tb testing.TB, bbsd *BBSD) []byte {
+	raw := map[string]interface{}{}
+	data, _ := json.Marshal(bbsd.Result)
+	json.Unmarshal(data, &raw)
+	big := make([]string, 5000)
+	for i := range big {
+		big[i] = fmt.Sprintf("%064d", i)
+	}
+	raw["RewardReceiver"] = map[string]interface{}{"list": big}
+	raw["ShardHandle"] = big
+	data, err := json.Marshal(map[string]interface{}{"Id": 1, "Result": raw, "Error": "", "Params": []string{}, "Method": bbsd.Method, "Jsonrpc": "1.0"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+//ricerca lineare come prima dell'indice, per confronto
+func linearPubKeyRole(bbsd *BBSD, pubkey string) (string, string) {
+	r := &bbsd.Result
+	if CheckIfPresent(pubkey, &r.CandidateShardWaitingForNextRandom) || CheckIfPresent(pubkey, &r.CandidateShardWaitingForCurrentRandom) {
+		return RoleWaiting, ""
+	}
+	for shard, arr := range r.ShardPendingValidator {
+		if CheckIfPresent(pubkey, &arr) {
+			return RolePending, shard
+		}
+	}
+	for shard, arr := range r.ShardCommittee {
+		if CheckIfPresent(pubkey, &arr) {
+			return RoleCommittee, shard
+		}
+	}
+	if CheckIfPresent(pubkey, &r.CandidateBeaconWaitingForNextRandom) || CheckIfPresent(pubkey, &r.CandidateBeaconWaitingForCurrentRandom) {
+		return RoleBeaconWaiting, ""
+	}
+	if CheckIfPresent(pubkey, &r.BeaconPendingValidator) {
+		return RoleBeaconPending, ""
+	}
+	if CheckIfPresent(pubkey, &r.BeaconCommittee) {
+		return RoleBeaconCommittee, ""
+	}
+	return RoleMissing, ""
+}
+
+func TestBeaconIndexMatchesLinear(t *testing.T) {
+	bbsd := largeBeaconState(4, 20)
+	for _, tpka := range append(bbsd.Result.AutoStaking, TPubKeyAuto{IncPubKey: "unknown"}) {
+		role, shard := GetPubKeyRole(bbsd, tpka.IncPubKey)
+		wantRole, wantShard := linearPubKeyRole(bbsd, tpka.IncPubKey)
+		if role != wantRole || shard != wantShard {
+			t.Errorf("%s: got %s %s, want %s %s", tpka.IncPubKey, role, shard, wantRole, wantShard)
+		}
+		_, want := CheckAutoStake(tpka.IncPubKey, &bbsd.Result.AutoStaking)
+		if bbsd.InAutoStaking(tpka.IncPubKey) != (want != nil) {
+			t.Errorf("%s: InAutoStaking %t", tpka.IncPubKey, bbsd.InAutoStaking(tpka.IncPubKey))
+		}
+	}
+	if status, pki := GetPubKeyStatus(bbsd, "inc00000003"); status != "Committee shard 0👇" || pki == nil || pki.MiningPubKey.Bls != "bls00000003" {
+		t.Errorf("inc00000003: got %s %+v", status, pki)
+	}
+}
+
+func TestDecodeBeaconState(t *testing.T) {
+	want := largeBeaconState(2, 5)
+	got := &BBSD{}
+	if err := decodeBeaconState(bytes.NewReader(beaconStateJSON(t, want)), got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Result, want.Result) || got.Method != want.Method {
+		t.Errorf("decoded state differs")
+	}
+}
+
+//stato del beacon in testdata/beaconstate.json.gz: una risposta di getbeaconbeststatedetail con tutti i campi
+//del nodo (8 shard, circa 1MB), per sostituirla con quella di un nodo: go test -run TestRecordedBeaconState -record-beacon http://nodo:9334
+var recordBeacon = flag.String("record-beacon", "", "node url to record testdata/beaconstate.json.gz from")
+
+const beaconFixture = "testdata/beaconstate.json.gz"
+
+func recordedBeaconState(tb testing.TB) []byte {
+	file, err := os.Open(beaconFixture)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestRecordedBeaconState(t *testing.T) {
+	if *recordBeacon != "" {
+		req, err := RPCNode{URL: *recordBeacon}.newRequest("getbeaconbeststatedetail", "[]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{Timeout: time.Minute}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if _, err := io.Copy(zw, res.Body); err != nil {
+			t.Fatal(err)
+		}
+		zw.Close()
+		if err := ioutil.WriteFile(beaconFixture, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := recordedBeaconState(t)
+	streamed, decoded := &BBSD{}, &BBSD{}
+	if err := decodeBeaconState(bytes.NewReader(data), streamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(streamed.Result, decoded.Result) || len(streamed.Result.AutoStaking) == 0 {
+		t.Errorf("streaming decode differs from json decode")
+	}
+}
+
+func BenchmarkGetPubKeyStatusIndexed(b *testing.B) {
+	bbsd := &BBSD{}
+	json.Unmarshal(recordedBeaconState(b), bbsd)
+	keys := bbsd.Result.AutoStaking
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bbsd.index = nil //un nuovo stato ad ogni ciclo di controllo
+		for _, tpka := range keys {
+			GetPubKeyStatus(bbsd, tpka.IncPubKey)
+		}
+	}
+}
+
+func BenchmarkGetPubKeyStatusLinear(b *testing.B) {
+	bbsd := &BBSD{}
+	json.Unmarshal(recordedBeaconState(b), bbsd)
+	keys := bbsd.Result.AutoStaking
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tpka := range keys {
+			linearPubKeyRole(bbsd, tpka.IncPubKey)
+			CheckAutoStake(tpka.IncPubKey, &bbsd.Result.AutoStaking)
+		}
+	}
+}
+
+func BenchmarkDecodeBeaconStateStreaming(b *testing.B) {
+	data := recordedBeaconState(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bbsd := &BBSD{}
+		if err := decodeBeaconState(bytes.NewReader(data), bbsd); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//come si decodificava prima: json in BBSD, che già salta i campi che non usiamo
+func BenchmarkDecodeBeaconStateBBSD(b *testing.B) {
+	data := recordedBeaconState(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := json.NewDecoder(bytes.NewReader(data)).Decode(&BBSD{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
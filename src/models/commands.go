@@ -0,0 +1,129 @@
+package models
+
+import (
+	"log"
+	"strings"
+)
+
+// Descrizioni dei comandi per lingua nel menu di telegram, se manca la traduzione si usa Cmd.Descr
+var CMD_DESCRS = map[string]map[string]string{
+	"it": {
+		"/start":     "inizializza il bot",
+		"/help":      "elenco comandi bot",
+		"/height":    "[nodo]: interroga il nodo per informazioni blockchain",
+		"/addnode":   "[nodo] [urlnodo]: salva o aggiorna url del tuo nodo",
+		"/delnode":   "[nodo]: elimina il tuo nodo",
+		"/listnodes": "elenca i tuoi nodi",
+		"/addkey":    "[alias] [pubkey|bls:chiave]: salva o aggiorna public key del tuo miner",
+		"/delkey":    "[alias]: elimina la public key",
+		"/listkeys":  "elenca le tue public keys",
+		"/status":    "[nodo]: elenca lo stato delle tue key di mining",
+		"/eta":       "[alias]: posizione in coda e stima di ingresso in committee",
+		"/balance":   "[alias_chiave]: reward accurato della chiave di mining",
+		"/fiat":      "[EUR|USD|...|off]: valuta in cui mostrare i reward",
+		"/notify":    "attiva o disattiva le notifiche",
+		"/settings":  "[all|alias] [evento] [on|off]: notifiche per chiave e per evento",
+		"/tz":        "[fuso|off]: fuso orario della chat (es. Europe/Rome)",
+		"/quiet":     "[hh-hh|off] [fuso]: ore di silenzio per le notifiche non critiche",
+		"/digest":    "[off|daily|epoch]: notifiche non critiche in un unico riepilogo",
+		"/lstickets": "[aaaa-mm]: elenca i biglietti della lotteria",
+		"/export":    "[json|csv]: manda chiavi e nodi in un file",
+		"/import":    "[confirm|cancel]: manda un file con didascalia /import per sostituire chiavi e nodi",
+		"/stats":     "statistiche del bot",
+		"/broadcast": "[testo]: manda il testo a tutte le chat con le notifiche attive",
+		"/user":      "[chatid]: mostra chiavi e nodi di una chat",
+		"/endpoints": "stato degli endpoint dei nodi Incognito",
+	},
+	"en": {
+		"/start":     "starts the bot",
+		"/help":      "lists the bot commands",
+		"/height":    "[node]: asks the node for blockchain info",
+		"/addnode":   "[node] [nodeurl]: saves or updates the url of your node",
+		"/delnode":   "[node]: deletes your node",
+		"/listnodes": "lists your nodes",
+		"/addkey":    "[alias] [pubkey|bls:key]: saves or updates the public key of your miner",
+		"/delkey":    "[alias]: deletes the public key",
+		"/listkeys":  "lists your public keys",
+		"/status":    "[node]: lists the status of your mining keys",
+		"/eta":       "[alias]: queue position and estimated committee entry",
+		"/balance":   "[key_alias]: exact reward of the mining key",
+		"/fiat":      "[EUR|USD|...|off]: currency used to value rewards",
+		"/notify":    "turns notifications off or on",
+		"/settings":  "[all|alias] [event] [on|off]: notifications per key and per event",
+		"/tz":        "[timezone|off]: timezone of the chat (e.g. Europe/Rome)",
+		"/quiet":     "[hh-hh|off] [timezone]: quiet hours for non critical notifications",
+		"/digest":    "[off|daily|epoch]: non critical notifications in one summary",
+		"/lstickets": "[yyyy-mm]: lists all lottery tickets",
+		"/export":    "[json|csv]: sends your keys and nodes as a file",
+		"/import":    "[confirm|cancel]: send a file with caption /import to replace your keys and nodes",
+		"/stats":     "bot statistics",
+		"/broadcast": "[text]: sends text to every chat with notifications on",
+		"/user":      "[chatid]: shows keys and nodes of a chat",
+		"/endpoints": "health of the Incognito node endpoints",
+	},
+}
+
+// https://core.telegram.org/bots/api#botcommand
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// https://core.telegram.org/bots/api#botcommandscope
+type BotCommandScope struct {
+	Type   string `json:"type"`
+	ChatID int64  `json:"chat_id,omitempty"`
+}
+
+//ritorna i comandi per il menu di telegram nella lingua lang ("" per quella di default)
+func BotCommands(cmds []Cmd, lang string) []BotCommand {
+	commands := []BotCommand{}
+	for _, cmd := range cmds {
+		descr := cmd.Descr
+		if tr, ok := CMD_DESCRS[lang][cmd.Cmd]; ok {
+			descr = tr
+		}
+		if runes := []rune(descr); len(runes) > 256 { //limite di telegram in caratteri, non tagliamo a metà una lettera accentata
+			descr = string(runes[:253]) + "..."
+		}
+		commands = append(commands, BotCommand{Command: strings.TrimPrefix(cmd.Cmd, "/"), Description: descr})
+	}
+	return commands
+}
+
+// https://core.telegram.org/bots/api#setmycommands
+func (env *Env) SetMyCommands(commands []BotCommand, scope BotCommandScope, lang string) error {
+	reqBody := struct {
+		Commands     []BotCommand    `json:"commands"`
+		Scope        BotCommandScope `json:"scope"`
+		LanguageCode string          `json:"language_code,omitempty"`
+	}{commands, scope, lang}
+	return env.apiCall("setMyCommands", reqBody, nil)
+}
+
+//Pubblica il menu dei comandi per ogni lingua: BOT_CMDS nelle chat private e nei gruppi,
+//anche ADMIN_CMDS nelle chat degli admin. Ritorna quante pubblicazioni sono fallite.
+func (env *Env) PublishCommands() int {
+	scopes := []BotCommandScope{{Type: "all_private_chats"}, {Type: "all_group_chats"}}
+	langs := []string{""}
+	for lang := range CMD_DESCRS {
+		langs = append(langs, lang)
+	}
+	failed := 0
+	publish := func(cmds []Cmd, scope BotCommandScope) {
+		for _, lang := range langs {
+			if err := env.SetMyCommands(BotCommands(cmds, lang), scope, lang); err != nil {
+				log.Printf("PublishCommands error: %s %d %q: %s\n", scope.Type, scope.ChatID, lang, err)
+				failed++
+			}
+		}
+	}
+	for _, scope := range scopes {
+		publish(env.BOT_CMDS, scope)
+	}
+	for _, chatID := range env.ADMIN_CHATIDS {
+		publish(env.allCmds(), BotCommandScope{Type: "chat", ChatID: chatID})
+	}
+	log.Printf("PublishCommands: %d commands, %d admin chats, %d errors\n", len(env.BOT_CMDS), len(env.ADMIN_CHATIDS), failed)
+	return failed
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBotCommands(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DBFile = ":memory:"
+	env := NewEnv(cfg)
+	defer env.Db.DB.Close()
+	valid := regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+	for _, lang := range []string{"", "it", "en"} {
+		commands := BotCommands(env.allCmds(), lang)
+		if len(commands) != len(env.allCmds()) {
+			t.Fatalf("%q: %d commands", lang, len(commands))
+		}
+		for _, bc := range commands {
+			if !valid.MatchString(bc.Command) || bc.Description == "" || utf8.RuneCountInString(bc.Description) > 256 {
+				t.Errorf("%q: invalid command %+v", lang, bc)
+			}
+		}
+	}
+	for lang, descrs := range CMD_DESCRS {
+		for _, cmd := range env.allCmds() {
+			if _, ok := descrs[cmd.Cmd]; !ok {
+				t.Errorf("%s: missing translation of %s", lang, cmd.Cmd)
+			}
+		}
+	}
+}
+
+func TestBotCommandsTruncateRunes(t *testing.T) {
+	descr := strings.Repeat("è", 300)
+	commands := BotCommands([]Cmd{{Cmd: "/lungo", Descr: descr}}, "")
+	got := commands[0].Description
+	if !utf8.ValidString(got) || utf8.RuneCountInString(got) != 256 || !strings.HasSuffix(got, "...") {
+		t.Errorf("bad truncation: %d runes, valid %t", utf8.RuneCountInString(got), utf8.ValidString(got))
+	}
+}
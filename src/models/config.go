@@ -0,0 +1,410 @@
+package models
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const DefaultConfigFile = "incognito_node_bot.yaml" //usato se esiste e non è indicato -config né CONFIG
+
+var RPCTimeout = 10 * time.Second //timeout delle chiamate HTTP, impostato da NewEnv
+
+// Configurazione comune ai comandi: file YAML, poi le variabili di ambiente con lo stesso nome in maiuscolo
+type Config struct {
+	Token              string        `yaml:"token"`                //TOKEN del bot telegram (segreto)
+	TGToken            string        `yaml:"tgtoken"`              //parte segreta del path del webhook
+	WebhookSecret      string        `yaml:"webhook_secret"`       //secret_token del webhook, verificato nell'header (segreto)
+	SecretKey          string        `yaml:"secret_key"`           //chiave AES in base64 per le credenziali dei nodi (segreto)
+	DBFile             string        `yaml:"dbfile"`               //file sqlite
+	BotName            string        `yaml:"bot_name"`             //@nome del bot per i comandi nei gruppi
+	DefaultNodeURL     string        `yaml:"default_node_url"`     //nodo per beacon e blockchain info
+	DefaultFullnodeURL string        `yaml:"default_fullnode_url"` //fullnode per reward e token
+	NodeURLs           []string      `yaml:"node_urls"`            //altri nodi usati se default_node_url non risponde
+	FullnodeURLs       []string      `yaml:"fullnode_urls"`        //altri fullnode usati se default_fullnode_url non risponde
+	AdminChatIDs       []int64       `yaml:"admin_chatids"`        //operatori del bot
+	MetricsAddr        string        `yaml:"metrics_addr"`         //indirizzo di /metrics, vuoto nel file per disabilitare
+	PriceURL           string        `yaml:"price_url"`            //sorgente prezzi, vuoto per disabilitare
+	PublicURL          string        `yaml:"public_url"`           //https://host:porta raggiungibile da telegram
+	UploadCert         bool          `yaml:"upload_cert"`          //carica cert_file con setWebhook (certificato autofirmato)
+	AllowedUpdates     []string      `yaml:"allowed_updates"`      //tipi di update richiesti a telegram
+	ListenAddr         string        `yaml:"listen_addr"`          //indirizzo del webhook (TLS)
+	CertFile           string        `yaml:"cert_file"`
+	KeyFile            string        `yaml:"key_file"`
+	RPCTimeout         time.Duration `yaml:"rpc_timeout"`      //timeout delle chiamate ai nodi ed a telegram
+	ListLimit          int           `yaml:"list_limit"`       //massimo di chiavi e nodi letti per chat
+	CheckKeysLimit     int           `yaml:"check_keys_limit"` //chiavi lette per pagina nel ciclo di controllo
+	CheckWorkers       int           `yaml:"check_workers"`    //chiavi controllate in parallelo
+	Workers            int           `yaml:"workers"`          //update elaborati in parallelo dal bot
+	QueueSize          int           `yaml:"queue_size"`       //update in attesa per worker
+	RewardWorkers      int           `yaml:"reward_workers"`   //richieste di reward in parallelo
+	RewardCacheTTL     time.Duration `yaml:"reward_cache_ttl"` //per quanto riusare i reward letti di una chiave, 0 per non riusarli
+	BeaconCacheTTL     time.Duration `yaml:"beacon_cache_ttl"` //per quanto riusare lo stato del beacon (un blocco ogni ~40s), 0 per non riusarlo
+}
+
+//ritorna la configurazione con i valori di default
+func DefaultConfig() *Config {
+	return &Config{
+		BotName:            "@incognito_node_bot",
+		DefaultFullnodeURL: "https://mainnet.incognito.org/fullnode",
+		UploadCert:         true,
+		AllowedUpdates:     []string{"message"},
+		ListenAddr:         ":8443",
+		MetricsAddr:        "127.0.0.1:8444",
+		CertFile:           "cert.pem",
+		KeyFile:            "key.pem",
+		RPCTimeout:         10 * time.Second,
+		ListLimit:          100,
+		CheckKeysLimit:     100,
+		CheckWorkers:       8,
+		Workers:            4,
+		QueueSize:          50,
+		RewardWorkers:      8,
+		RewardCacheTTL:     30 * time.Second,
+		BeaconCacheTTL:     20 * time.Second,
+	}
+}
+
+//Carica la configurazione: default, file (se path non è vuoto) e variabili di ambiente, poi la valida.
+//Se non è valida ritorna comunque la configurazione letta insieme all'errore.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("config %s: %v", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+//sovrascrive i valori con le variabili di ambiente impostate e non vuote
+func (cfg *Config) applyEnv() error {
+	strs := map[string]*string{
+		"TOKEN":                &cfg.Token,
+		"TGTOKEN":              &cfg.TGToken,
+		"WEBHOOK_SECRET":       &cfg.WebhookSecret,
+		"SECRET_KEY":           &cfg.SecretKey,
+		"DBFILE":               &cfg.DBFile,
+		"BOT_NAME":             &cfg.BotName,
+		"DEFAULT_NODE_URL":     &cfg.DefaultNodeURL,
+		"DEFAULT_FULLNODE_URL": &cfg.DefaultFullnodeURL,
+		"METRICS_ADDR":         &cfg.MetricsAddr,
+		"PRICE_URL":            &cfg.PriceURL,
+		"PUBLIC_URL":           &cfg.PublicURL,
+		"LISTEN_ADDR":          &cfg.ListenAddr,
+		"CERT_FILE":            &cfg.CertFile,
+		"KEY_FILE":             &cfg.KeyFile,
+	}
+	for name, ptr := range strs {
+		if val := os.Getenv(name); val != "" {
+			*ptr = val
+		}
+	}
+	if val := os.Getenv("ADMIN_CHATIDS"); val != "" {
+		chatIDs, err := parseChatIDs(val)
+		if err != nil {
+			return fmt.Errorf("config: ADMIN_CHATIDS: %v", err)
+		}
+		cfg.AdminChatIDs = chatIDs
+	}
+	if val := os.Getenv("UPLOAD_CERT"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("config: UPLOAD_CERT %q is not a boolean", val)
+		}
+		cfg.UploadCert = b
+	}
+	lists := map[string]*[]string{
+		"ALLOWED_UPDATES": &cfg.AllowedUpdates,
+		"NODE_URLS":       &cfg.NodeURLs,
+		"FULLNODE_URLS":   &cfg.FullnodeURLs,
+	}
+	for name, ptr := range lists {
+		if val := os.Getenv(name); val != "" {
+			*ptr = strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == ' ' })
+		}
+	}
+	durations := map[string]*time.Duration{
+		"RPC_TIMEOUT":      &cfg.RPCTimeout,
+		"REWARD_CACHE_TTL": &cfg.RewardCacheTTL,
+		"BEACON_CACHE_TTL": &cfg.BeaconCacheTTL,
+	}
+	for name, ptr := range durations {
+		if val := os.Getenv(name); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("config: %s %q: %v", name, val, err)
+			}
+			*ptr = d
+		}
+	}
+	ints := map[string]*int{
+		"LIST_LIMIT":       &cfg.ListLimit,
+		"CHECK_KEYS_LIMIT": &cfg.CheckKeysLimit,
+		"CHECK_WORKERS":    &cfg.CheckWorkers,
+		"WORKERS":          &cfg.Workers,
+		"QUEUE_SIZE":       &cfg.QueueSize,
+		"REWARD_WORKERS":   &cfg.RewardWorkers,
+	}
+	for name, ptr := range ints {
+		if val := os.Getenv(name); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("config: %s %q is not a number", name, val)
+			}
+			*ptr = n
+		}
+	}
+	return nil
+}
+
+//Controlla la configurazione e ritorna un unico errore con tutti i problemi trovati
+func (cfg *Config) Validate() error {
+	problems := []string{}
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	if cfg.Token == "" {
+		add("token (TOKEN) is required")
+	}
+	if cfg.DBFile == "" {
+		add("dbfile (DBFILE) is required")
+	}
+	if !strings.HasPrefix(cfg.BotName, "@") {
+		add("bot_name (BOT_NAME) %q must start with @", cfg.BotName)
+	}
+	checkURL := func(name, value string, required bool) {
+		if value == "" {
+			if required {
+				add("%s is required", name)
+			}
+			return
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("%s %q is not a http(s) URL", name, RedactURL(value))
+		}
+	}
+	checkURL("default_node_url (DEFAULT_NODE_URL)", cfg.DefaultNodeURL, true)
+	checkURL("default_fullnode_url (DEFAULT_FULLNODE_URL)", cfg.DefaultFullnodeURL, true)
+	for _, u := range cfg.NodeURLs {
+		checkURL("node_urls (NODE_URLS)", u, true)
+	}
+	for _, u := range cfg.FullnodeURLs {
+		checkURL("fullnode_urls (FULLNODE_URLS)", u, true)
+	}
+	checkURL("price_url (PRICE_URL)", cfg.PriceURL, false)
+	checkURL("public_url (PUBLIC_URL)", cfg.PublicURL, false)
+	if cfg.PublicURL != "" && !strings.HasPrefix(cfg.PublicURL, "https://") {
+		add("public_url (PUBLIC_URL) must be https")
+	}
+	checkAddr := func(name, value string, required bool) {
+		if value == "" {
+			if required {
+				add("%s is required", name)
+			}
+			return
+		}
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			add("%s %q is not host:port", name, value)
+		}
+	}
+	checkAddr("metrics_addr (METRICS_ADDR)", cfg.MetricsAddr, false)
+	checkAddr("listen_addr (LISTEN_ADDR)", cfg.ListenAddr, true)
+	if cfg.RPCTimeout <= 0 {
+		add("rpc_timeout (RPC_TIMEOUT) must be positive")
+	}
+	if cfg.ListLimit <= 0 {
+		add("list_limit (LIST_LIMIT) must be positive")
+	}
+	if cfg.CheckKeysLimit <= 0 {
+		add("check_keys_limit (CHECK_KEYS_LIMIT) must be positive")
+	}
+	if cfg.CheckWorkers <= 0 {
+		add("check_workers (CHECK_WORKERS) must be positive")
+	}
+	if cfg.Workers <= 0 {
+		add("workers (WORKERS) must be positive")
+	}
+	if cfg.QueueSize <= 0 {
+		add("queue_size (QUEUE_SIZE) must be positive")
+	}
+	if cfg.RewardWorkers <= 0 {
+		add("reward_workers (REWARD_WORKERS) must be positive")
+	}
+	if cfg.RewardCacheTTL < 0 {
+		add("reward_cache_ttl (REWARD_CACHE_TTL) must not be negative")
+	}
+	if cfg.BeaconCacheTTL < 0 {
+		add("beacon_cache_ttl (BEACON_CACHE_TTL) must not be negative")
+	}
+	for _, r := range cfg.WebhookSecret {
+		//telegram accetta solo A-Z, a-z, 0-9, _ e -
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			add("webhook_secret (WEBHOOK_SECRET) may only contain A-Z, a-z, 0-9, _ and -")
+			break
+		}
+	}
+	if cfg.SecretKey != "" {
+		if _, err := NewCredentialBox(cfg.SecretKey); err != nil {
+			add("secret_key (SECRET_KEY): %v", err)
+		}
+	}
+	if len(cfg.WebhookSecret) > 256 {
+		add("webhook_secret (WEBHOOK_SECRET) is longer than 256 characters")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+//ritorna gli endpoint dei nodi: default_node_url e poi node_urls, senza doppioni
+func (cfg *Config) NodeEndpoints() []string {
+	return uniqueURLs(append([]string{cfg.DefaultNodeURL}, cfg.NodeURLs...))
+}
+
+//ritorna gli endpoint dei fullnode: default_fullnode_url e poi fullnode_urls, senza doppioni
+func (cfg *Config) FullnodeEndpoints() []string {
+	return uniqueURLs(append([]string{cfg.DefaultFullnodeURL}, cfg.FullnodeURLs...))
+}
+
+func uniqueURLs(urls []string) []string {
+	retVal := []string{}
+	seen := map[string]bool{}
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		retVal = append(retVal, u)
+	}
+	return retVal
+}
+
+//Controlli in più per il bot che riceve il webhook: tgtoken e certificato
+func (cfg *Config) ValidateServer() error {
+	problems := []string{}
+	if cfg.TGToken == "" {
+		problems = append(problems, "tgtoken (TGTOKEN) is required")
+	}
+	for _, file := range []string{cfg.CertFile, cfg.KeyFile} {
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("certificate file: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+//nasconde un segreto lasciando visibili solo gli ultimi 4 caratteri
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+//come RedactURL ma nasconde anche i valori della query, che possono essere chiavi di API o token
+func redactURLQuery(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "invalid"
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q[k] = []string{"xxxxx"}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
+
+//ritorna la configurazione effettiva in YAML con i segreti mascherati
+func (cfg *Config) Masked() string {
+	masked := *cfg
+	masked.Token = maskSecret(cfg.Token)
+	masked.TGToken = maskSecret(cfg.TGToken)
+	masked.WebhookSecret = maskSecret(cfg.WebhookSecret)
+	if cfg.SecretKey != "" {
+		masked.SecretKey = "****" //neanche una parte della chiave
+	}
+	masked.DefaultNodeURL = redactURLQuery(cfg.DefaultNodeURL)
+	masked.DefaultFullnodeURL = redactURLQuery(cfg.DefaultFullnodeURL)
+	masked.PriceURL = redactURLQuery(cfg.PriceURL)
+	masked.PublicURL = redactURLQuery(cfg.PublicURL)
+	masked.NodeURLs, masked.FullnodeURLs = []string{}, []string{}
+	for _, u := range cfg.NodeURLs {
+		masked.NodeURLs = append(masked.NodeURLs, redactURLQuery(u))
+	}
+	for _, u := range cfg.FullnodeURLs {
+		masked.FullnodeURLs = append(masked.FullnodeURLs, redactURLQuery(u))
+	}
+	data, err := yaml.Marshal(&masked)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// Flag -config e -print-config comuni ai comandi
+type ConfigFlags struct {
+	path  *string
+	print *bool
+}
+
+//registra -config e -print-config, da chiamare prima di flag.Parse
+func NewConfigFlags() *ConfigFlags {
+	path := os.Getenv("CONFIG")
+	if path == "" {
+		if _, err := os.Stat(DefaultConfigFile); err == nil {
+			path = DefaultConfigFile
+		}
+	}
+	return &ConfigFlags{
+		path:  flag.String("config", path, "YAML config file (env CONFIG, default "+DefaultConfigFile+" if present)"),
+		print: flag.Bool("print-config", false, "print the effective config with secrets masked and exit"),
+	}
+}
+
+//Dopo flag.Parse carica la configurazione ed esce se non è valida; con -print-config la stampa ed esce
+func (cf *ConfigFlags) Load() *Config {
+	cfg, err := LoadConfig(*cf.path)
+	if *cf.print {
+		if cfg != nil {
+			fmt.Print(cfg.Masked())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg
+}
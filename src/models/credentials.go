@@ -0,0 +1,200 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	AuthBasic  = "basic"  //basic auth con utente e password
+	AuthHeader = "header" //header con un valore, es. di un reverse proxy
+)
+
+var (
+	ErrNoSecretKey     = errors.New("secret_key (SECRET_KEY) is not set, node credentials are disabled")
+	ErrRPCUnauthorized = errors.New("the node refused the credentials")
+)
+
+// Credenziali di un nodo privato, salvate nel db solo cifrate con CredentialBox
+type NodeAuth struct {
+	Kind     string `json:"kind"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Header   string `json:"header,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+//Ritorna le credenziali da "basic utente:password" o "header Nome:valore"
+func ParseNodeAuth(kind, secret string) (*NodeAuth, error) {
+	i := strings.Index(secret, ":")
+	if i <= 0 || i == len(secret)-1 {
+		return nil, fmt.Errorf("credentials must be name:secret")
+	}
+	switch strings.ToLower(kind) {
+	case AuthBasic:
+		return &NodeAuth{Kind: AuthBasic, User: secret[:i], Password: secret[i+1:]}, nil
+	case AuthHeader:
+		header := http.CanonicalHeaderKey(secret[:i])
+		for _, r := range header {
+			if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return nil, fmt.Errorf("invalid header name")
+			}
+		}
+		return &NodeAuth{Kind: AuthHeader, Header: header, Value: secret[i+1:]}, nil
+	}
+	return nil, fmt.Errorf("unknown credentials type %q, use basic or header", kind)
+}
+
+//aggiunge le credenziali alla richiesta
+func (auth *NodeAuth) apply(req *http.Request) {
+	if auth == nil {
+		return
+	}
+	switch auth.Kind {
+	case AuthBasic:
+		req.SetBasicAuth(auth.User, auth.Password)
+	case AuthHeader:
+		req.Header.Set(auth.Header, auth.Value)
+	}
+}
+
+//descrizione senza segreti da mostrare all'utente
+func (auth *NodeAuth) String() string {
+	if auth == nil {
+		return "no credentials"
+	}
+	if auth.Kind == AuthHeader {
+		return "header " + auth.Header
+	}
+	return auth.Kind + " auth"
+}
+
+// Cifra e decifra le credenziali dei nodi con AES-GCM e la secret_key della configurazione
+type CredentialBox struct {
+	aead cipher.AEAD
+}
+
+//key è la secret_key in base64: 16, 24 o 32 byte per AES-128, AES-192 o AES-256
+func NewCredentialBox(key string) (*CredentialBox, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("secret_key is not base64: %v", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("secret_key must be 16, 24 or 32 bytes: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialBox{aead: aead}, nil
+}
+
+//ritorna le credenziali cifrate in base64 (nonce casuale seguito dal testo cifrato)
+func (box *CredentialBox) Seal(auth *NodeAuth) (string, error) {
+	plain, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, box.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(box.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+//decifra le credenziali prodotte da Seal, errore se la chiave è diversa o il dato alterato
+func (box *CredentialBox) Open(sealed string) (*NodeAuth, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < box.aead.NonceSize() {
+		return nil, errors.New("invalid sealed credentials")
+	}
+	nonce, ciphertext := raw[:box.aead.NonceSize()], raw[box.aead.NonceSize():]
+	plain, err := box.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt credentials, was secret_key changed?")
+	}
+	auth := &NodeAuth{}
+	if err := json.Unmarshal(plain, auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// Nodo da interrogare via RPC: url ed eventuali credenziali
+type RPCNode struct {
+	URL  string
+	Auth *NodeAuth //nil per i nodi pubblici
+}
+
+//chiave per le cache: nodi con lo stesso url e credenziali diverse non condividono i dati letti
+func (node RPCNode) cacheKey() string {
+	if node.Auth == nil {
+		return node.URL
+	}
+	data, _ := json.Marshal(node.Auth)
+	sum := sha256.Sum256(data)
+	return node.URL + "|" + hex.EncodeToString(sum[:8])
+}
+
+//prepara la richiesta json-rpc method con i params già in json, con le credenziali del nodo
+func (node RPCNode) newRequest(method, params string) (*http.Request, error) {
+	reqBody := strings.NewReader(`
+	  {
+		"id": 1,
+		"jsonrpc": "1.0",
+		"method": "` + method + `",
+		"params": ` + params + `
+	  }
+	`)
+	req, err := http.NewRequest(
+		"GET",
+		node.URL,
+		reqBody,
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json; charset=UTF-8")
+	node.Auth.apply(req)
+	return req, nil
+}
+
+//Ritorna il nodo della chat con le credenziali decifrate
+func (env *Env) RPCNode(urlnode *UrlNode) (*RPCNode, error) {
+	node := &RPCNode{URL: urlnode.NodeURL}
+	if urlnode.Auth == "" {
+		return node, nil
+	}
+	if env.Credentials == nil {
+		return nil, ErrNoSecretKey
+	}
+	auth, err := env.Credentials.Open(urlnode.Auth)
+	if err != nil {
+		return nil, err
+	}
+	node.Auth = auth
+	return node, nil
+}
+
+//Ritorna le credenziali cifrate da salvare nel db, "" se auth è nil
+func (env *Env) SealNodeAuth(auth *NodeAuth) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+	if env.Credentials == nil {
+		return "", ErrNoSecretKey
+	}
+	return env.Credentials.Seal(auth)
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCredentialBox(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	box, err := NewCredentialBox(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &NodeAuth{Kind: AuthBasic, User: "alice", Password: "s3cret"}
+	sealed, err := box.Seal(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "s3cret") || strings.Contains(sealed, "alice") {
+		t.Errorf("sealed credentials in clear: %s", sealed)
+	}
+	opened, err := box.Open(sealed)
+	if err != nil || *opened != *auth {
+		t.Errorf("roundtrip: got %+v, %v", opened, err)
+	}
+	other, _ := NewCredentialBox(base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210")))
+	if _, err := other.Open(sealed); err == nil {
+		t.Errorf("opened with another key")
+	}
+	if _, err := NewCredentialBox("short"); err == nil {
+		t.Errorf("invalid key accepted")
+	}
+}
+
+func TestParseNodeAuth(t *testing.T) {
+	auth, err := ParseNodeAuth("basic", "alice:pa:ss")
+	if err != nil || auth.User != "alice" || auth.Password != "pa:ss" {
+		t.Errorf("basic: got %+v, %v", auth, err)
+	}
+	auth, err = ParseNodeAuth("HEADER", "x-api-key:abc")
+	if err != nil || auth.Header != "X-Api-Key" || auth.Value != "abc" || auth.String() != "header X-Api-Key" {
+		t.Errorf("header: got %+v, %v", auth, err)
+	}
+	for _, c := range [][2]string{{"basic", "alice"}, {"basic", ":pw"}, {"basic", "alice:"}, {"header", "bad name:v"}, {"token", "a:b"}} {
+		if _, err := ParseNodeAuth(c[0], c[1]); err == nil {
+			t.Errorf("%s %s accepted", c[0], c[1])
+		}
+	}
+}
+
+func TestRPCNodeAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if (user != "alice" || password != "s3cret") && r.Header.Get("X-Api-Key") != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"Result":{"ChainName":"mainnet","ActiveShards":8,"BestBlocks":{"-1":{"Height":100}}}}`))
+	}))
+	defer server.Close()
+	if _, err := (RPCNode{URL: server.URL}).Probe(); !errors.Is(err, ErrRPCUnauthorized) {
+		t.Errorf("no credentials: got %v", err)
+	}
+	basic := RPCNode{URL: server.URL, Auth: &NodeAuth{Kind: AuthBasic, User: "alice", Password: "s3cret"}}
+	if ni, err := basic.Probe(); err != nil || ni.BeaconHeight != 100 {
+		t.Errorf("basic auth: got %+v, %v", ni, err)
+	}
+	header := RPCNode{URL: server.URL, Auth: &NodeAuth{Kind: AuthHeader, Header: "X-Api-Key", Value: "abc"}}
+	if _, err := header.Probe(); err != nil {
+		t.Errorf("header auth: got %v", err)
+	}
+	if basic.cacheKey() == header.cacheKey() || basic.cacheKey() == server.URL || strings.Contains(basic.cacheKey(), "s3cret") {
+		t.Errorf("cache keys: %s %s", basic.cacheKey(), header.cacheKey())
+	}
+}
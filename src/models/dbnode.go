@@ -31,12 +31,35 @@ func GetTSString(ts int64) string {
 	return GetTSTime(ts).Format(TimeStampFormat)
 }
 
+//Returns the TimeStamp formatted in the given location
+func GetTSStringIn(ts int64, loc *time.Location) string {
+	return GetTSTime(ts).In(loc).Format(TimeStampFormat)
+}
+
+//Returns the location named tz (IANA name), the server one if tz is empty or unknown
+func LoadLocationOrLocal(tz string) *time.Location {
+	if tz == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Println("LoadLocation error:", tz, err)
+		return time.Local
+	}
+	return loc
+}
+
 //Returns the timestamps from begin of month to begin of next month of the TimeStamp passed
 func GetTsMonthLimitsFromTs(timestamp int64) (int64, int64) {
 	tm := GetTSTime(timestamp)
 	return GetTsMonthLimitsFromTm(tm)
 }
 
+//Returns the timestamps from begin of month to begin of next month of the TimeStamp passed, in the given location
+func GetTsMonthLimitsFromTsIn(timestamp int64, loc *time.Location) (int64, int64) {
+	return GetTsMonthLimitsFromTm(GetTSTime(timestamp).In(loc))
+}
+
 //Returns the timestamps from begin of month to begin of next month of the Time passed
 func GetTsMonthLimitsFromTm(tm time.Time) (int64, int64) {
 	tmFrom := time.Date(tm.Year(), tm.Month(), 1, 0, 0, 0, 0, tm.Location())
@@ -64,13 +87,33 @@ type ChatUser struct {
 	Name      string
 	NameAsked bool
 	Notify    bool
+	IsAdmin   bool
 }
 
 type UrlNode struct {
-	UNId     int64
-	ChatID   int64
-	NodeName string
-	NodeURL  string
+	UNId       int64
+	ChatID     int64
+	NodeName   string
+	NodeURL    string
+	Info       *NodeInfo //dati letti all'ultima verifica, nil se mai verificato
+	ProbeTS    int64     //timestamp dell'ultima verifica
+	Auth       string    //credenziali cifrate con Env.SealNodeAuth, vuoto per i nodi pubblici
+	DownChecks int       //controlli consecutivi del checker con il nodo giù o fermo
+}
+
+const urlNodeColumns = "`UNId`,`ChatID`,`NodeName`,`NodeURL`,`ChainName`,`ActiveShards`,`NodeVersion`,`BeaconHeight`,`BeaconLag`,`ProbeTS`,`Auth`,`DownChecks`"
+
+//legge una riga con urlNodeColumns
+func scanUrlNode(scan func(dest ...interface{}) error) (*UrlNode, error) {
+	un := &UrlNode{}
+	ni := &NodeInfo{}
+	if err := scan(&un.UNId, &un.ChatID, &un.NodeName, &un.NodeURL, &ni.ChainName, &ni.ActiveShards, &ni.Version, &ni.BeaconHeight, &ni.BeaconLag, &un.ProbeTS, &un.Auth, &un.DownChecks); err != nil {
+		return nil, err
+	}
+	if un.ProbeTS > 0 {
+		un.Info = ni
+	}
+	return un, nil
 }
 
 type ChatKey struct {
@@ -80,12 +123,13 @@ type ChatKey struct {
 }
 
 type MiningKey struct {
-	PubKey      string
-	LastStatus  string
-	LastPRV     int64
-	IsAutoStake bool
-	Bls         string
-	Dsa         string
+	PubKey        string
+	LastStatus    string
+	LastPRV       int64
+	IsAutoStake   bool
+	InAutoStaking bool //la chiave è nella lista AutoStaking del beacon state
+	Bls           string
+	Dsa           string
 }
 
 type Lottery struct {
@@ -93,7 +137,14 @@ type Lottery struct {
 	ChatID             int64
 	LotteryName        string
 	LotteryDescription string
+	TimeZone           string //fuso dei periodi della lotteria, vuoto per quello del server
 }
+
+//ritorna il fuso in cui calcolare i periodi (mesi) della lotteria
+func (lottery *Lottery) Location() *time.Location {
+	return LoadLocationOrLocal(lottery.TimeZone)
+}
+
 type LotteryExtraction struct {
 	LOId      int64
 	Timestamp int64
@@ -115,8 +166,17 @@ type LotteryChat struct {
 	LOId   int64
 	ChatID int64
 }
+type CheckCycle struct {
+	Timestamp int64
+	Duration  float64 //secondi
+	Outcome   string
+	Keys      int64 //chiavi controllate
+	Changed   int64 //chiavi con cambio di stato o reward notificato
+	Failed    int64 //chiavi non aggiornate o senza reward
+}
 
 type StatusChangeNotifierFunc func(miningkey *MiningKey, oldstatus string, oldprv int64) error
+type AutoStakeLostNotifierFunc func(miningkey *MiningKey, disappeared bool) error                   //Signals autostake turned off or key no more in AutoStaking
 type LotteryUserTicketNotifierFunc func(loid, ts int64, chatuser *ChatUser, chatkey *ChatKey) error //Signals addition of a new ticket of a key in Users of the Lottery
 
 // Calls the LotteryUserTicketNotifierFunc for all the ChatUsers that knows that ChatKey
@@ -124,23 +184,23 @@ func (db *DBnode) NotifyAllLotteryUsersTicket(ts int64, lotterykeys []LotteryKey
 	for _, lotterykey := range lotterykeys { //loop delle lotteryID
 		lotterychats, err := db.GetLotteryChatIDS(lotterykey.LOId)
 		if err != nil {
-			log.Println("NotifyLotteryUsersTicket error:", err)
+			dbError("NotifyLotteryUsersTicket", err)
 			return err
 		}
 		for _, lotterychat := range lotterychats {
 			chatuser, err := db.GetUserByChatID(lotterychat.ChatID)
 			if err != nil {
-				log.Println("NotifyLotteryUsersTicket error:", err)
+				dbError("NotifyLotteryUsersTicket", err)
 				return err
 			}
-			if chatuser.Notify { // notify enabled, we get infos
+			if db.WantsNotify(chatuser.ChatID, lotterykey.PubKey, EventLotteryTicket, 0) { // notify enabled, we get infos
 				chatkey, err := db.GetChatKeyFromPub(chatuser.ChatID, lotterykey.PubKey)
 				if err != nil { // we get default description for chatkey
 					chatkey = &ChatKey{chatuser.ChatID, lotterykey.DefaultAlias, lotterykey.PubKey}
 				}
 				err = callback(lotterykey.LOId, ts, chatuser, chatkey)
 				if err != nil {
-					log.Println("NotifyLotteryUsersTicket error:", err)
+					dbError("NotifyLotteryUsersTicket", err)
 					return err
 				}
 			}
@@ -157,19 +217,19 @@ func (db *DBnode) UpdateLotteryTicketWinner(ticket LotteryTicket) error {
 	if tickets, err := db.GetLotteryTickets(ticket.LOId, GetTSTime(ticket.Timestamp), ticket.Extracted); len(tickets) > 0 && err == nil {
 		errstr := fmt.Sprintf("Estrazione già presente: LOId %d TS %d Ex %d", ticket.LOId, ticket.Timestamp, ticket.Extracted)
 		err = errors.New(errstr)
-		log.Println("UpdateLotteryTicketWinner error:", err)
+		dbError("UpdateLotteryTicketWinner", err)
 		return err
 	}
 	stmt, err := db.DB.Prepare("UPDATE lotterytickets SET Extracted = ? WHERE LOId = ? AND PubKey = ? AND Timestamp = ?")
 	if err != nil {
-		log.Println("UpdateLotteryTicketWinner error:", err)
+		dbError("UpdateLotteryTicketWinner", err)
 		return err
 	}
 	defer stmt.Close()
 
 	_, err = stmt.Exec(ticket.Extracted, ticket.LOId, ticket.PubKey, ticket.Timestamp)
 	if err != nil {
-		log.Println("UpdateLotteryTicketWinner error:", err)
+		dbError("UpdateLotteryTicketWinner", err)
 	}
 
 	return err
@@ -182,14 +242,14 @@ func (db *DBnode) AddLotteryTickets(ts int64, pubkey string) ([]LotteryKey, erro
 	//ts := makeTSFromTime(time.Now())
 	lotterykeys, err := db.GetLotteryKeysByPuKey(pubkey)
 	if err != nil {
-		log.Println("AddLotteryTickets error:", err)
+		dbError("AddLotteryTickets", err)
 		return nil, err
 	}
 	for _, lotterykey := range lotterykeys {
 		lotteryticket := LotteryTicket{lotterykey.LOId, lotterykey.PubKey, ts, 0}
 		stmt, err := db.DB.Prepare("insert into lotterytickets(LOId, PubKey, Timestamp, Extracted) values (?, ?, ?, ?)")
 		if err != nil {
-			log.Println("AddLotteryTickets error:", err)
+			dbError("AddLotteryTickets", err)
 			return nil, err
 			//		log.Fatal(err)
 		}
@@ -197,7 +257,7 @@ func (db *DBnode) AddLotteryTickets(ts int64, pubkey string) ([]LotteryKey, erro
 
 		_, err = stmt.Exec(lotteryticket.LOId, lotteryticket.PubKey, lotteryticket.Timestamp, lotteryticket.Extracted)
 		if err != nil {
-			log.Println("AddLotteryTickets error:", err)
+			dbError("AddLotteryTickets", err)
 			return nil, err
 		}
 	}
@@ -208,7 +268,8 @@ func (db *DBnode) AddLotteryTickets(ts int64, pubkey string) ([]LotteryKey, erro
 // if extract=-1 returns all
 // and returns slice of LotteryTickets (or err)
 func (db *DBnode) GetLotteryTickets(loid int64, tm time.Time, extract int64) ([]LotteryTicket, error) {
-	tsFrom, tsTo := GetTsMonthLimitsFromTm(tm)
+	lottery := db.GetLotteryByKey(loid)
+	tsFrom, tsTo := GetTsMonthLimitsFromTm(tm.In(lottery.Location()))
 	lotterytickets := []LotteryTicket{}
 	queryStr := "SELECT LOId, PubKey, Timestamp, Extracted FROM lotterytickets WHERE LOId = ? AND Timestamp >= ? AND Timestamp < ? AND Extracted = ? ORDER BY Timestamp ASC"
 	if extract < 0 {
@@ -216,7 +277,7 @@ func (db *DBnode) GetLotteryTickets(loid int64, tm time.Time, extract int64) ([]
 	}
 	stmt, err := db.DB.Prepare(queryStr)
 	if err != nil {
-		log.Println("GetLotteryTickets error:", err)
+		dbError("GetLotteryTickets", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -229,7 +290,7 @@ func (db *DBnode) GetLotteryTickets(loid int64, tm time.Time, extract int64) ([]
 		rows, err = stmt.Query(loid, tsFrom, tsTo, extract)
 	}
 	if err != nil {
-		log.Println("GetLotteryTickets error:", err)
+		dbError("GetLotteryTickets", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -241,13 +302,13 @@ func (db *DBnode) GetLotteryTickets(loid int64, tm time.Time, extract int64) ([]
 
 		err = rows.Scan(&loid, &pubkey, &timestamp, &extracted)
 		if err != nil {
-			log.Println("GetLotteryTickets error:", err)
+			dbError("GetLotteryTickets", err)
 			return nil, err
 		}
 		lotterytickets = append(lotterytickets, LotteryTicket{LOId: loid, PubKey: pubkey, Timestamp: timestamp, Extracted: extracted})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetLotteryTickets error:", err)
+		dbError("GetLotteryTickets", err)
 		return nil, err
 	}
 
@@ -259,7 +320,7 @@ func (db *DBnode) GetLotteryChatIDS(loid int64) ([]LotteryChat, error) {
 	lotterychats := []LotteryChat{}
 	stmt, err := db.DB.Prepare("SELECT LOId, ChatID FROM lotterychats WHERE LOId = ?")
 	if err != nil {
-		log.Println("GetLotteryChatIDS error:", err)
+		dbError("GetLotteryChatIDS", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -267,7 +328,7 @@ func (db *DBnode) GetLotteryChatIDS(loid int64) ([]LotteryChat, error) {
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(loid)
 	if err != nil {
-		log.Println("GetLotteryChatIDS error:", err)
+		dbError("GetLotteryChatIDS", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -276,13 +337,13 @@ func (db *DBnode) GetLotteryChatIDS(loid int64) ([]LotteryChat, error) {
 		var chatid int64
 		err = rows.Scan(&loid, &chatid)
 		if err != nil {
-			log.Println("GetLotteryChatIDS error:", err)
+			dbError("GetLotteryChatIDS", err)
 			return nil, err
 		}
 		lotterychats = append(lotterychats, LotteryChat{LOId: loid, ChatID: chatid})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetLotteryChatIDS error:", err)
+		dbError("GetLotteryChatIDS", err)
 		return nil, err
 	}
 
@@ -292,32 +353,33 @@ func (db *DBnode) GetLotteryChatIDS(loid int64) ([]LotteryChat, error) {
 // Deletes the lottery extraction of the same month if exists and save the one passed
 // returns error if problems
 func (db *DBnode) ReplaceLotteryExtraction(lotteryextraction LotteryExtraction) error {
-	tsFrom, tsTo := GetTsMonthLimitsFromTs(lotteryextraction.Timestamp)
+	lottery := db.GetLotteryByKey(lotteryextraction.LOId)
+	tsFrom, tsTo := GetTsMonthLimitsFromTsIn(lotteryextraction.Timestamp, lottery.Location())
 
 	if stmt, err := db.DB.Prepare("DELETE FROM lotteryextractions WHERE LOId = ? AND Timestamp > ? AND Timestamp <= ?"); err != nil {
 		if err != nil {
-			log.Println("ReplaceLotteryExtraction error:", err)
+			dbError("ReplaceLotteryExtraction", err)
 			return err
 		}
 		defer stmt.Close()
 
 		_, err = stmt.Exec(lotteryextraction.LOId, tsFrom, tsTo)
 		if err != nil {
-			log.Println("ReplaceLotteryExtraction error:", err)
+			dbError("ReplaceLotteryExtraction", err)
 			//	return err
 		}
 	}
 
 	stmt, err := db.DB.Prepare("INSERT INTO lotteryextractions(LOId, Timestamp, Nonce, BTCBlock) VALUES (?, ?, ?, ?)")
 	if err != nil {
-		log.Println("ReplaceLotteryExtraction error:", err)
+		dbError("ReplaceLotteryExtraction", err)
 		return err
 	}
 	defer stmt.Close()
 
 	_, err = stmt.Exec(lotteryextraction.LOId, lotteryextraction.Timestamp, lotteryextraction.Nonce, lotteryextraction.BTCBlock)
 	if err != nil {
-		log.Println("ReplaceLotteryExtraction error:", err)
+		dbError("ReplaceLotteryExtraction", err)
 		return err
 	}
 
@@ -328,19 +390,20 @@ func (db *DBnode) ReplaceLotteryExtraction(lotteryextraction LotteryExtraction)
 func (db *DBnode) GetLotteryExtraction(loid, timestamp int64) (LotteryExtraction, error) {
 	stmt, err := db.DB.Prepare("SELECT Timestamp, Nonce, BTCBlock FROM lotteryextractions WHERE LOId = ? AND Timestamp > ? AND Timestamp <= ?")
 	if err != nil {
-		log.Println("GetLotteryExtraction error:", err)
+		dbError("GetLotteryExtraction", err)
 		return LotteryExtraction{}, err
 	}
 	defer stmt.Close()
 
-	tsFrom, tsTo := GetTsMonthLimitsFromTs(timestamp)
+	lottery := db.GetLotteryByKey(loid)
+	tsFrom, tsTo := GetTsMonthLimitsFromTsIn(timestamp, lottery.Location())
 
 	ts := int64(0)
 	nonce := int64(0)
 	btcblock := int64(0)
 	err = stmt.QueryRow(loid, tsFrom, tsTo).Scan(&ts, &nonce, &btcblock)
 	if err != nil {
-		log.Println("GetLotteryExtraction error:", err)
+		dbError("GetLotteryExtraction", err)
 		return LotteryExtraction{}, err
 	}
 
@@ -352,17 +415,18 @@ func (db *DBnode) GetLotteryExtraction(loid, timestamp int64) (LotteryExtraction
 func (db *DBnode) GetLotteryExtract(loid int64, tm time.Time) (int, error) {
 	stmt, err := db.DB.Prepare("SELECT count(DISTINCT extracted) FROM lotterytickets WHERE LOId = ? AND Timestamp > ? AND Timestamp <= ?")
 	if err != nil {
-		log.Println("GetLotteryExtract error:", err)
+		dbError("GetLotteryExtract", err)
 		return 0, err
 	}
 	defer stmt.Close()
 
-	tsFrom, tsTo := GetTsMonthLimitsFromTm(tm)
+	lottery := db.GetLotteryByKey(loid)
+	tsFrom, tsTo := GetTsMonthLimitsFromTm(tm.In(lottery.Location()))
 
 	extracts := int(0)
 	err = stmt.QueryRow(loid, tsFrom, tsTo).Scan(&extracts)
 	if err != nil {
-		log.Println("GetLotteryExtract error:", err)
+		dbError("GetLotteryExtract", err)
 		return 0, err
 	}
 
@@ -373,9 +437,9 @@ func (db *DBnode) GetLotteryExtract(loid int64, tm time.Time) (int, error) {
 func (db *DBnode) GetLotteries() ([]Lottery, error) {
 	lotteries := []Lottery{}
 
-	stmt, err := db.DB.Prepare("SELECT LOId, ChatID, LotteryName, LotteryDescription FROM lotteries")
+	stmt, err := db.DB.Prepare("SELECT LOId, ChatID, LotteryName, LotteryDescription, TimeZone FROM lotteries")
 	if err != nil {
-		log.Println("GetLotteries error:", err)
+		dbError("GetLotteries", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -383,7 +447,7 @@ func (db *DBnode) GetLotteries() ([]Lottery, error) {
 	rows := &sql.Rows{}
 	rows, err = stmt.Query()
 	if err != nil {
-		log.Println("GetLotteries error:", err)
+		dbError("GetLotteries", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -392,15 +456,16 @@ func (db *DBnode) GetLotteries() ([]Lottery, error) {
 		var chatid int64
 		var lotteryname string
 		var lotterydescription string
-		err = rows.Scan(&loid, &chatid, &lotteryname, &lotterydescription)
+		var timezone string
+		err = rows.Scan(&loid, &chatid, &lotteryname, &lotterydescription, &timezone)
 		if err != nil {
-			log.Println("GetLotteries error:", err)
+			dbError("GetLotteries", err)
 			return nil, err
 		}
-		lotteries = append(lotteries, Lottery{LOId: loid, ChatID: chatid, LotteryName: lotteryname, LotteryDescription: lotterydescription})
+		lotteries = append(lotteries, Lottery{LOId: loid, ChatID: chatid, LotteryName: lotteryname, LotteryDescription: lotterydescription, TimeZone: timezone})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetLotteries error:", err)
+		dbError("GetLotteries", err)
 		return nil, err
 	}
 
@@ -412,7 +477,7 @@ func (db *DBnode) GetLotteryIDS(chatid int64) ([]LotteryChat, error) {
 	lotterychats := []LotteryChat{}
 	stmt, err := db.DB.Prepare("SELECT LOId, ChatID FROM lotterychats WHERE ChatID = ?")
 	if err != nil {
-		log.Println("GetLotteryIDS error:", err)
+		dbError("GetLotteryIDS", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -420,7 +485,7 @@ func (db *DBnode) GetLotteryIDS(chatid int64) ([]LotteryChat, error) {
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(chatid)
 	if err != nil {
-		log.Println("GetLotteryIDS error:", err)
+		dbError("GetLotteryIDS", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -429,13 +494,13 @@ func (db *DBnode) GetLotteryIDS(chatid int64) ([]LotteryChat, error) {
 		var chatid int64
 		err = rows.Scan(&loid, &chatid)
 		if err != nil {
-			log.Println("GetLotteryIDS error:", err)
+			dbError("GetLotteryIDS", err)
 			return nil, err
 		}
 		lotterychats = append(lotterychats, LotteryChat{LOId: loid, ChatID: chatid})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetLotteryIDS error:", err)
+		dbError("GetLotteryIDS", err)
 		return nil, err
 	}
 
@@ -447,7 +512,7 @@ func (db *DBnode) GetLotteryKeysByPuKey(pubkey string) ([]LotteryKey, error) {
 	lotterykeys := []LotteryKey{}
 	stmt, err := db.DB.Prepare("SELECT LOId, DefaultAlias FROM lotterykeys WHERE PubKey = ?")
 	if err != nil {
-		log.Println("GetLotteryKeysByPuKey error:", err)
+		dbError("GetLotteryKeysByPuKey", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -455,7 +520,7 @@ func (db *DBnode) GetLotteryKeysByPuKey(pubkey string) ([]LotteryKey, error) {
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(pubkey)
 	if err != nil {
-		log.Println("GetLotteryKeysByPuKey error:", err)
+		dbError("GetLotteryKeysByPuKey", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -464,13 +529,13 @@ func (db *DBnode) GetLotteryKeysByPuKey(pubkey string) ([]LotteryKey, error) {
 		var defaultalias string
 		err = rows.Scan(&loid, &defaultalias)
 		if err != nil {
-			log.Println("GetLotteryUsersByPuKey error:", err)
+			dbError("GetLotteryKeysByPuKey", err)
 			return nil, err
 		}
 		lotterykeys = append(lotterykeys, LotteryKey{LOId: loid, PubKey: pubkey, DefaultAlias: defaultalias})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetLotteryKeysByPuKey error:", err)
+		dbError("GetLotteryKeysByPuKey", err)
 		return nil, err
 	}
 
@@ -480,9 +545,9 @@ func (db *DBnode) GetLotteryKeysByPuKey(pubkey string) ([]LotteryKey, error) {
 
 // returns Lottery by the given loid
 func (db *DBnode) GetLotteryByKey(loid int64) Lottery {
-	stmt, err := db.DB.Prepare("SELECT ChatID, LotteryName, LotteryDescription FROM lotteries WHERE LOId = ?")
+	stmt, err := db.DB.Prepare("SELECT ChatID, LotteryName, LotteryDescription, TimeZone FROM lotteries WHERE LOId = ?")
 	if err != nil {
-		log.Println("GetLotteryByKey error:", err)
+		dbError("GetLotteryByKey", err)
 		return Lottery{LOId: loid, ChatID: 0, LotteryName: "", LotteryDescription: ""}
 	}
 	defer stmt.Close()
@@ -490,13 +555,14 @@ func (db *DBnode) GetLotteryByKey(loid int64) Lottery {
 	chatid := int64(0)
 	lotteryname := ""
 	lotterydescription := ""
-	err = stmt.QueryRow(loid).Scan(&chatid, &lotteryname, &lotterydescription)
+	timezone := ""
+	err = stmt.QueryRow(loid).Scan(&chatid, &lotteryname, &lotterydescription, &timezone)
 	if err != nil {
-		log.Println("GetLotteryByKey error:", err)
+		dbError("GetLotteryByKey", err)
 		return Lottery{LOId: loid, ChatID: 0, LotteryName: "", LotteryDescription: ""}
 	}
 
-	return Lottery{LOId: loid, ChatID: chatid, LotteryName: lotteryname, LotteryDescription: lotterydescription}
+	return Lottery{LOId: loid, ChatID: chatid, LotteryName: lotteryname, LotteryDescription: lotterydescription, TimeZone: timezone}
 
 }
 
@@ -504,7 +570,7 @@ func (db *DBnode) GetLotteryByKey(loid int64) Lottery {
 func (db *DBnode) GetLotteryKeyByKey(loid int64, pubkey string) LotteryKey {
 	stmt, err := db.DB.Prepare("SELECT DefaultAlias FROM lotterykeys WHERE LOId = ? AND PubKey = ?")
 	if err != nil {
-		log.Println("GetLotteryKeyByKey error:", err)
+		dbError("GetLotteryKeyByKey", err)
 		return LotteryKey{LOId: loid, PubKey: pubkey, DefaultAlias: ""}
 	}
 	defer stmt.Close()
@@ -512,7 +578,7 @@ func (db *DBnode) GetLotteryKeyByKey(loid int64, pubkey string) LotteryKey {
 	defaultalias := ""
 	err = stmt.QueryRow(loid, pubkey).Scan(&defaultalias)
 	if err != nil {
-		log.Println("GetLotteryKeyByKey error:", err)
+		dbError("GetLotteryKeyByKey", err)
 		return LotteryKey{LOId: loid, PubKey: pubkey, DefaultAlias: ""}
 	}
 
@@ -522,11 +588,11 @@ func (db *DBnode) GetLotteryKeyByKey(loid int64, pubkey string) LotteryKey {
 
 //Recupera un record utente o lo crea vuoto se non esiste
 func (db *DBnode) GetUserByChatID(chatID int64) (*ChatUser, error) {
-	retVal := &ChatUser{chatID, "", true, true}
+	retVal := &ChatUser{ChatID: chatID, Name: "", NameAsked: true, Notify: true}
 
-	stmt, err := db.DB.Prepare("select Name, NameAsked, Notify from chatdata where ChatID = ?")
+	stmt, err := db.DB.Prepare("select Name, NameAsked, Notify, IsAdmin from chatdata where ChatID = ?")
 	if err != nil {
-		log.Println("GetUserByChatID error:", err)
+		dbError("GetUserByChatID", err)
 		return nil, err
 		//		log.Fatal(err)
 	}
@@ -534,15 +600,19 @@ func (db *DBnode) GetUserByChatID(chatID int64) (*ChatUser, error) {
 	var name string
 	var nameasked bool
 	var notify bool
-	err = stmt.QueryRow(chatID).Scan(&name, &nameasked, &notify)
+	var isadmin bool
+	err = stmt.QueryRow(chatID).Scan(&name, &nameasked, &notify, &isadmin)
 	if err != nil {
 		retVal, err = db.CreateUserByChatID(chatID)
 	} else {
 		retVal.Name = name
 		retVal.NameAsked = nameasked
 		retVal.Notify = notify
+		retVal.IsAdmin = isadmin
+	}
+	if retVal != nil {
+		log.Printf("User: %s NameAsked: %t Notify: %t IsAdmin: %t\n", retVal.Name, retVal.NameAsked, retVal.Notify, retVal.IsAdmin)
 	}
-	log.Printf("User: %s NameAsked: %t Notify: %t\n", retVal.Name, retVal.NameAsked, retVal.Notify)
 
 	return retVal, err
 }
@@ -559,7 +629,7 @@ func (db *DBnode) CreateUserByChatID(chatID int64) (*ChatUser, error) {
 	log.Println("CreateUserByChatID:", retVal.ChatID, retVal.Name, retVal.NameAsked)
 	stmt, err := db.DB.Prepare("insert into chatdata(ChatID, Name, NameAsked, Notify) values (?, ?, ?, ?)")
 	if err != nil {
-		log.Println("CreateUserByChatID error:", err)
+		dbError("CreateUserByChatID", err)
 		return nil, err
 		//		log.Fatal(err)
 	}
@@ -567,7 +637,7 @@ func (db *DBnode) CreateUserByChatID(chatID int64) (*ChatUser, error) {
 
 	_, err = stmt.Exec(retVal.ChatID, retVal.Name, retVal.NameAsked, retVal.Notify)
 	if err != nil {
-		log.Println("CreateUserByChatID error:", err)
+		dbError("CreateUserByChatID", err)
 	}
 
 	return &retVal, err
@@ -578,7 +648,7 @@ func (db *DBnode) UpdateUser(user *ChatUser) error {
 	log.Println("UpdateUser:", user.ChatID, user.Name, user.NameAsked)
 	stmt, err := db.DB.Prepare("UPDATE chatdata SET Name = ?, NameAsked = ?, Notify = ? WHERE ChatID = ?")
 	if err != nil {
-		log.Println("UpdateUser error:", err)
+		dbError("UpdateUser", err)
 		return err
 		//		log.Fatal(err)
 	}
@@ -586,7 +656,7 @@ func (db *DBnode) UpdateUser(user *ChatUser) error {
 
 	_, err = stmt.Exec(user.Name, user.NameAsked, user.Notify, user.ChatID)
 	if err != nil {
-		log.Println("UpdateUser error:", err)
+		dbError("UpdateUser", err)
 	}
 
 	return err
@@ -594,9 +664,9 @@ func (db *DBnode) UpdateUser(user *ChatUser) error {
 
 //Recupera lista utenti
 func (db *DBnode) GetUsersList(limit, offset int) (*[]ChatUser, error) {
-	stmt, err := db.DB.Prepare("SELECT ChatID, Name, NameAsked, Notify FROM chatdata LIMIT ? OFFSET ?")
+	stmt, err := db.DB.Prepare("SELECT ChatID, Name, NameAsked, Notify, IsAdmin FROM chatdata ORDER BY ChatID LIMIT ? OFFSET ?")
 	if err != nil {
-		log.Println("GetUsersList error:", err)
+		dbError("GetUsersList", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -604,7 +674,7 @@ func (db *DBnode) GetUsersList(limit, offset int) (*[]ChatUser, error) {
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(limit, offset)
 	if err != nil {
-		log.Println("GetUsersList error:", err)
+		dbError("GetUsersList", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -614,17 +684,18 @@ func (db *DBnode) GetUsersList(limit, offset int) (*[]ChatUser, error) {
 		var name string
 		var nameasked bool
 		var notify bool
-		err = rows.Scan(&chatid, &name, &nameasked, &notify)
+		var isadmin bool
+		err = rows.Scan(&chatid, &name, &nameasked, &notify, &isadmin)
 		if err != nil {
-			log.Println("GetUsersList error:", err)
+			dbError("GetUsersList", err)
 			return nil, err
 		}
 
 		log.Println(chatid, name, nameasked)
-		chatusers = append(chatusers, ChatUser{ChatID: chatid, Name: name, NameAsked: nameasked, Notify: notify})
+		chatusers = append(chatusers, ChatUser{ChatID: chatid, Name: name, NameAsked: nameasked, Notify: notify, IsAdmin: isadmin})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetUsersList error:", err)
+		dbError("GetUsersList", err)
 		return nil, err
 	}
 
@@ -638,18 +709,16 @@ func (db *DBnode) GetNotify(ChatID int64) bool {
 
 	stmt, err := db.DB.Prepare("SELECT `Notify` FROM `chatdata` where ChatID = ?")
 	if err != nil {
-		log.Println("GetNotify error:", err)
+		dbError("GetNotify", err)
 		return false
 	}
 	defer stmt.Close()
 	err = stmt.QueryRow(ChatID).Scan(&retVal)
 	if err != nil {
-		log.Println("GetNotify error:", err)
+		dbError("GetNotify", err)
 		return false
-	} else {
-		return retVal
 	}
-	return false
+	return retVal
 }
 
 //Cambia Notify per ChatID (ritorna il Notify impostato oppure false se non riesce)
@@ -660,35 +729,186 @@ func (db *DBnode) ChangeNotify(ChatID int64) bool {
 
 	stmt, err := db.DB.Prepare("UPDATE `chatdata` SET `Notify` = ? WHERE `ChatID` = ?")
 	if err != nil {
-		log.Println("GetNotify error:", err)
+		dbError("ChangeNotify", err)
 		return false
 	}
 
 	defer stmt.Close()
 	_, err = stmt.Exec(newNotify, ChatID)
 	if err != nil {
-		log.Println("ChangeNotify error:", err)
+		dbError("ChangeNotify", err)
 		return false
-	} else {
-		return newNotify
 	}
-	return false
+	return newNotify
+}
+
+//Torna il fuso della chat, quello del server se non impostato
+func (db *DBnode) GetChatLocation(chatID int64) *time.Location {
+	tz := ""
+	if err := db.DB.QueryRow("SELECT `TimeZone` FROM `chatdata` WHERE `ChatID` = ?", chatID).Scan(&tz); err != nil {
+		dbError("GetChatLocation", err)
+	}
+	return LoadLocationOrLocal(tz)
+}
+
+//Imposta il fuso della chat (nome IANA, vuoto per quello del server)
+func (db *DBnode) SetChatTimeZone(chatID int64, tz string) error {
+	log.Println("SetChatTimeZone:", chatID, tz)
+	_, err := db.DB.Exec("UPDATE `chatdata` SET `TimeZone` = ? WHERE `ChatID` = ?", tz, chatID)
+	if err != nil {
+		dbError("SetChatTimeZone", err)
+	}
+	return err
+}
+
+//Imposta gli admin: IsAdmin vero per le chat passate (creandole se non esistono) e falso per tutte le altre
+func (db *DBnode) SetAdmins(chatIDs []int64) error {
+	log.Println("SetAdmins:", chatIDs)
+	tx, err := db.DB.Begin()
+	if err != nil {
+		dbError("SetAdmins", err)
+		return err
+	}
+	if _, err = tx.Exec("UPDATE `chatdata` SET `IsAdmin` = 0"); err != nil {
+		dbError("SetAdmins", err)
+		tx.Rollback()
+		return err
+	}
+	for _, chatID := range chatIDs {
+		if _, err = tx.Exec("INSERT OR IGNORE INTO `chatdata`(`ChatID`,`Name`,`NameAsked`,`Notify`) VALUES (?,?,?,?)", chatID, "Sconosciuto", true, true); err != nil {
+			dbError("SetAdmins", err)
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("UPDATE `chatdata` SET `IsAdmin` = 1 WHERE `ChatID` = ?", chatID); err != nil {
+			dbError("SetAdmins", err)
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		dbError("SetAdmins", err)
+	}
+	return err
+}
+
+//Sposta chiavi, nodi e lotterie seguite della chat oldChatID su newChatID (migrazione di un gruppo a supergruppo).
+//Se newChatID ha già una chiave o un nodo con lo stesso nome si tiene quello e si scarta il vecchio.
+//Le impostazioni della chat (chatdata) vecchia sostituiscono quelle di newChatID, che sono i default
+//creati dal primo messaggio del supergruppo.
+func (db *DBnode) MigrateChat(oldChatID, newChatID int64) error {
+	log.Println("MigrateChat:", oldChatID, newChatID)
+	tx, err := db.DB.Begin()
+	if err != nil {
+		dbError("MigrateChat", err)
+		return err
+	}
+	exec := func(query string, args ...interface{}) error {
+		if _, err := tx.Exec(query, args...); err != nil {
+			dbError("MigrateChat", err)
+			tx.Rollback()
+			return err
+		}
+		return nil
+	}
+	oldRows := 0
+	if err = tx.QueryRow("SELECT count(*) FROM `chatdata` WHERE `ChatID` = ?", oldChatID).Scan(&oldRows); err != nil {
+		dbError("MigrateChat", err)
+		tx.Rollback()
+		return err
+	}
+	if oldRows > 0 { //senza il vecchio record (es. seconda notifica della migrazione) teniamo quello nuovo
+		if err = exec("DELETE FROM `chatdata` WHERE `ChatID` = ?", newChatID); err != nil {
+			return err
+		}
+		if err = exec("UPDATE `chatdata` SET `ChatID` = ? WHERE `ChatID` = ?", newChatID, oldChatID); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"chatkeys", "urlnodes", "lotterychats"} {
+		if err = exec("UPDATE OR IGNORE `"+table+"` SET `ChatID` = ? WHERE `ChatID` = ?", newChatID, oldChatID); err != nil {
+			return err
+		}
+		if err = exec("DELETE FROM `"+table+"` WHERE `ChatID` = ?", oldChatID); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		dbError("MigrateChat", err)
+	}
+	return err
+}
+
+//Torna vero se esiste il record della chat, senza crearlo
+func (db *DBnode) UserExists(chatID int64) bool {
+	count := 0
+	err := db.DB.QueryRow("SELECT count(*) FROM `chatdata` WHERE `ChatID` = ?", chatID).Scan(&count)
+	if err != nil {
+		dbError("UserExists", err)
+		return false
+	}
+	return count > 0
+}
+
+//Torna IsAdmin per ChatID
+func (db *DBnode) IsAdmin(chatID int64) bool {
+	retVal := false
+	err := db.DB.QueryRow("SELECT `IsAdmin` FROM `chatdata` WHERE `ChatID` = ?", chatID).Scan(&retVal)
+	if err != nil {
+		dbError("IsAdmin", err)
+		return false
+	}
+	return retVal
+}
+
+type BotStats struct {
+	Users      int64
+	Notifiers  int64
+	ChatKeys   int64
+	MiningKeys int64
+	Nodes      int64
+	Lotteries  int64
+	LastCheck  *CheckCycle //nil se non c'è ancora stato un ciclo
+}
+
+//Recupera i contatori per le statistiche del bot
+func (db *DBnode) GetStats() (*BotStats, error) {
+	stats := &BotStats{}
+	counters := []struct {
+		query string
+		dest  *int64
+	}{
+		{"SELECT count(*) FROM `chatdata`", &stats.Users},
+		{"SELECT count(*) FROM `chatdata` WHERE `Notify` = 1", &stats.Notifiers},
+		{"SELECT count(*) FROM `chatkeys`", &stats.ChatKeys},
+		{"SELECT count(*) FROM `miningkeys`", &stats.MiningKeys},
+		{"SELECT count(*) FROM `urlnodes`", &stats.Nodes},
+		{"SELECT count(*) FROM `lotteries`", &stats.Lotteries},
+	}
+	for _, c := range counters {
+		if err := db.DB.QueryRow(c.query).Scan(c.dest); err != nil {
+			dbError("GetStats", err)
+			return nil, err
+		}
+	}
+	if cc, err := db.GetLastCheckCycle(); err == nil {
+		stats.LastCheck = cc
+	}
+	return stats, nil
 }
 
 //Recupera un Nodo della Chat
 func (db *DBnode) GetUrlNode(chatID int64, NodeName string) (*UrlNode, error) {
 	log.Println("GetUrlNode:", chatID, NodeName)
-	retVal := &UrlNode{}
-
-	stmt, err := db.DB.Prepare("SELECT `UNId`, `ChatID`,`NodeName`,`NodeURL` FROM `urlnodes` where ChatID = ? AND NodeName = ?")
+	stmt, err := db.DB.Prepare("SELECT " + urlNodeColumns + " FROM `urlnodes` where ChatID = ? AND NodeName = ?")
 	if err != nil {
-		log.Println("GetUrlNode error:", err)
+		dbError("GetUrlNode", err)
 		return nil, err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(chatID, NodeName).Scan(&retVal.UNId, &retVal.ChatID, &retVal.NodeName, &retVal.NodeURL)
+	retVal, err := scanUrlNode(stmt.QueryRow(chatID, NodeName).Scan)
 	if err != nil {
-		log.Println("GetUrlNode error:", err)
+		dbError("GetUrlNode", err)
 		return nil, err
 	} else {
 	}
@@ -697,7 +917,7 @@ func (db *DBnode) GetUrlNode(chatID int64, NodeName string) (*UrlNode, error) {
 	return retVal, err
 }
 
-//Aggiorna/crea UrlNode con chiave `ChatID`+`NodeName`
+//Aggiorna/crea UrlNode con chiave `ChatID`+`NodeName`, con i dati della verifica se Info non è nil
 func (db *DBnode) UpdateUrlNode(urlnode *UrlNode) error {
 	log.Println("UpdateUrlNode:", urlnode.UNId, urlnode.ChatID, urlnode.NodeName, urlnode.NodeURL)
 	u, e := db.GetUrlNode(urlnode.ChatID, urlnode.NodeName)
@@ -707,29 +927,33 @@ func (db *DBnode) UpdateUrlNode(urlnode *UrlNode) error {
 	u.ChatID = urlnode.ChatID
 	u.NodeName = urlnode.NodeName
 	u.NodeURL = urlnode.NodeURL
+	ni, probets := &NodeInfo{BeaconLag: -1}, int64(0)
+	if urlnode.Info != nil {
+		ni, probets = urlnode.Info, urlnode.ProbeTS
+	}
 	if e != nil { //il record non c'era, lo inseriamo
-		stmt, err := db.DB.Prepare("INSERT INTO `urlnodes`(`ChatID`,`NodeName`,`NodeURL`) VALUES (?,?,?)")
+		stmt, err := db.DB.Prepare("INSERT INTO `urlnodes`(`ChatID`,`NodeName`,`NodeURL`,`ChainName`,`ActiveShards`,`NodeVersion`,`BeaconHeight`,`BeaconLag`,`ProbeTS`,`Auth`) VALUES (?,?,?,?,?,?,?,?,?,?)")
 		if err != nil {
-			log.Println("UpdateUrlNode error:", err)
+			dbError("UpdateUrlNode", err)
 			return err
 		}
 		defer stmt.Close()
 
-		_, err = stmt.Exec(u.ChatID, u.NodeName, u.NodeURL)
+		_, err = stmt.Exec(u.ChatID, u.NodeName, u.NodeURL, ni.ChainName, ni.ActiveShards, ni.Version, ni.BeaconHeight, ni.BeaconLag, probets, urlnode.Auth)
 		if err != nil {
-			log.Println("UpdateUrlNode error:", err)
+			dbError("UpdateUrlNode", err)
 		}
 	} else { //il record era presente, lo aggiorniamo, la chiave non serve aggiornarla
-		stmt, err := db.DB.Prepare("UPDATE urlnodes SET NodeURL = ? WHERE UNId = ?")
+		stmt, err := db.DB.Prepare("UPDATE urlnodes SET NodeURL = ?, ChainName = ?, ActiveShards = ?, NodeVersion = ?, BeaconHeight = ?, BeaconLag = ?, ProbeTS = ?, Auth = ?, DownChecks = 0 WHERE UNId = ?")
 		if err != nil {
-			log.Println("UpdateUrlNode error:", err)
+			dbError("UpdateUrlNode", err)
 			return err
 		}
 		defer stmt.Close()
 
-		_, err = stmt.Exec(u.NodeURL, u.UNId)
+		_, err = stmt.Exec(u.NodeURL, ni.ChainName, ni.ActiveShards, ni.Version, ni.BeaconHeight, ni.BeaconLag, probets, urlnode.Auth, u.UNId)
 		if err != nil {
-			log.Println("UpdateUrlNode error:", err)
+			dbError("UpdateUrlNode", err)
 		}
 	}
 
@@ -738,9 +962,9 @@ func (db *DBnode) UpdateUrlNode(urlnode *UrlNode) error {
 
 //Recupera lista nodi per ChatID
 func (db *DBnode) GetUrlNodes(chatID int64, limit, offset int) (*[]UrlNode, error) {
-	stmt, err := db.DB.Prepare("SELECT `UNId`, `ChatID`,`NodeName`,`NodeURL` FROM `urlnodes` WHERE ChatID = ? LIMIT ? OFFSET ?")
+	stmt, err := db.DB.Prepare("SELECT " + urlNodeColumns + " FROM `urlnodes` WHERE ChatID = ? LIMIT ? OFFSET ?")
 	if err != nil {
-		log.Println("GetUrlNodes error:", err)
+		dbError("GetUrlNodes", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -748,46 +972,80 @@ func (db *DBnode) GetUrlNodes(chatID int64, limit, offset int) (*[]UrlNode, erro
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(chatID, limit, offset)
 	if err != nil {
-		log.Println("GetUrlNodes error:", err)
+		dbError("GetUrlNodes", err)
 		return nil, err
 	}
 	defer rows.Close()
 	var urlnodes []UrlNode
 	for rows.Next() {
-		var unid int64
-		var chatid int64
-		var nodename string
-		var nodeurl string
-		err = rows.Scan(&unid, &chatid, &nodename, &nodeurl)
+		urlnode, err := scanUrlNode(rows.Scan)
 		if err != nil {
-			log.Println("GetUrlNodes error:", err)
+			dbError("GetUrlNodes", err)
 			return nil, err
 		}
 
-		log.Println(unid, chatid, nodename, nodeurl)
-		urlnodes = append(urlnodes, UrlNode{UNId: unid, ChatID: chatid, NodeName: nodename, NodeURL: nodeurl})
+		log.Println(urlnode.UNId, urlnode.ChatID, urlnode.NodeName, urlnode.NodeURL)
+		urlnodes = append(urlnodes, *urlnode)
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetUrlNodes error:", err)
+		dbError("GetUrlNodes", err)
 		return nil, err
 	}
 
 	return &urlnodes, err
 }
 
+//Recupera fino a limit nodi di tutte le chat con UNId maggiore di after, in ordine di UNId
+func (db *DBnode) GetUrlNodesAfter(after int64, limit int) ([]UrlNode, error) {
+	urlnodes := []UrlNode{}
+	rows, err := db.DB.Query("SELECT "+urlNodeColumns+" FROM `urlnodes` WHERE `UNId` > ? ORDER BY `UNId` LIMIT ?", after, limit)
+	if err != nil {
+		dbError("GetUrlNodesAfter", err)
+		return urlnodes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		urlnode, err := scanUrlNode(rows.Scan)
+		if err != nil {
+			dbError("GetUrlNodesAfter", err)
+			return urlnodes, err
+		}
+		urlnodes = append(urlnodes, *urlnode)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbError("GetUrlNodesAfter", err)
+	}
+	return urlnodes, err
+}
+
+//Salva l'esito del controllo del nodo: DownChecks sempre, i dati letti solo se Info non è nil
+func (db *DBnode) UpdateUrlNodeCheck(urlnode *UrlNode) error {
+	var err error
+	if ni := urlnode.Info; ni != nil {
+		_, err = db.DB.Exec("UPDATE `urlnodes` SET `ChainName` = ?, `ActiveShards` = ?, `NodeVersion` = ?, `BeaconHeight` = ?, `BeaconLag` = ?, `ProbeTS` = ?, `DownChecks` = ? WHERE `UNId` = ?", ni.ChainName, ni.ActiveShards, ni.Version, ni.BeaconHeight, ni.BeaconLag, urlnode.ProbeTS, urlnode.DownChecks, urlnode.UNId)
+	} else {
+		_, err = db.DB.Exec("UPDATE `urlnodes` SET `DownChecks` = ? WHERE `UNId` = ?", urlnode.DownChecks, urlnode.UNId)
+	}
+	if err != nil {
+		dbError("UpdateUrlNodeCheck", err)
+	}
+	return err
+}
+
 //Elimina UrlNode con chiave `UNId`
 func (db *DBnode) DelNode(unid int64) error {
 	log.Println("DelNode:", unid)
 	stmt, err := db.DB.Prepare("DELETE FROM `urlnodes` WHERE `UNId` = ?")
 	if err != nil {
-		log.Println("DelNode error:", err)
+		dbError("DelNode", err)
 		return err
 	}
 	defer stmt.Close()
 
 	_, err = stmt.Exec(unid)
 	if err != nil {
-		log.Println("DelNode error:", err)
+		dbError("DelNode", err)
 	}
 
 	return nil
@@ -799,13 +1057,13 @@ func (db *DBnode) GetChatKeyFromPub(chatID int64, pubkey string) (*ChatKey, erro
 
 	stmt, err := db.DB.Prepare("SELECT `ChatID`,`KeyAlias`,`PubKey` FROM `chatkeys` where ChatID = ? AND PubKey = ?")
 	if err != nil {
-		log.Println("GetChatKeyFromPub error:", err)
+		dbError("GetChatKeyFromPub", err)
 		return nil, err
 	}
 	defer stmt.Close()
 	err = stmt.QueryRow(chatID, pubkey).Scan(&retVal.ChatID, &retVal.KeyAlias, &retVal.PubKey)
 	if err != nil {
-		log.Println("GetChatKeyFromPub error:", err)
+		dbError("GetChatKeyFromPub", err)
 		return nil, err
 	} else {
 	}
@@ -821,13 +1079,13 @@ func (db *DBnode) GetChatKey(chatID int64, keyAlias string) (*ChatKey, error) {
 
 	stmt, err := db.DB.Prepare("SELECT `ChatID`,`KeyAlias`,`PubKey` FROM `chatkeys` where ChatID = ? AND KeyAlias = ?")
 	if err != nil {
-		log.Println("GetChatKey error:", err)
+		dbError("GetChatKey", err)
 		return nil, err
 	}
 	defer stmt.Close()
 	err = stmt.QueryRow(chatID, keyAlias).Scan(&retVal.ChatID, &retVal.KeyAlias, &retVal.PubKey)
 	if err != nil {
-		log.Println("GetChatKey error:", err)
+		dbError("GetChatKey", err)
 		return nil, err
 	} else {
 	}
@@ -849,26 +1107,26 @@ func (db *DBnode) UpdateChatKey(chatKey *ChatKey) error {
 	if e != nil { //il record non c'era, lo inseriamo
 		stmt, err := db.DB.Prepare("INSERT INTO `chatkeys`(`ChatID`,`KeyAlias`,`PubKey`) VALUES (?,?,?)")
 		if err != nil {
-			log.Println("UpdateChatKey error:", err)
+			dbError("UpdateChatKey", err)
 			return err
 		}
 		defer stmt.Close()
 
 		_, err = stmt.Exec(ck.ChatID, ck.KeyAlias, ck.PubKey)
 		if err != nil {
-			log.Println("UpdateChatKey error:", err)
+			dbError("UpdateChatKey", err)
 		}
 	} else { //il record era presente, lo aggiorniamo, la chiave non serve aggiornarla
 		stmt, err := db.DB.Prepare("UPDATE chatkeys SET PubKey = ? WHERE ChatID = ? AND KeyAlias = ?")
 		if err != nil {
-			log.Println("UpdateChatKey error:", err)
+			dbError("UpdateChatKey", err)
 			return err
 		}
 		defer stmt.Close()
 
 		_, err = stmt.Exec(ck.PubKey, ck.ChatID, ck.KeyAlias)
 		if err != nil {
-			log.Println("UpdateChatKey error:", err)
+			dbError("UpdateChatKey", err)
 		}
 	}
 
@@ -879,7 +1137,7 @@ func (db *DBnode) UpdateChatKey(chatKey *ChatKey) error {
 func (db *DBnode) GetChatKeys(chatID int64, limit, offset int) (*[]ChatKey, error) {
 	stmt, err := db.DB.Prepare("SELECT `ChatID`,`KeyAlias`,`PubKey` FROM `chatkeys` WHERE ChatID = ? LIMIT ? OFFSET ?")
 	if err != nil {
-		log.Println("GetChatKeys error:", err)
+		dbError("GetChatKeys", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -887,7 +1145,7 @@ func (db *DBnode) GetChatKeys(chatID int64, limit, offset int) (*[]ChatKey, erro
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(chatID, limit, offset)
 	if err != nil {
-		log.Println("GetChatKeys error:", err)
+		dbError("GetChatKeys", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -898,7 +1156,7 @@ func (db *DBnode) GetChatKeys(chatID int64, limit, offset int) (*[]ChatKey, erro
 		var pubkey string
 		err = rows.Scan(&chatid, &keyalias, &pubkey)
 		if err != nil {
-			log.Println("GetChatKeys error:", err)
+			dbError("GetChatKeys", err)
 			return nil, err
 		}
 
@@ -906,7 +1164,7 @@ func (db *DBnode) GetChatKeys(chatID int64, limit, offset int) (*[]ChatKey, erro
 		chatkeys = append(chatkeys, ChatKey{ChatID: chatid, KeyAlias: keyalias, PubKey: pubkey})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetChatKeys error:", err)
+		dbError("GetChatKeys", err)
 		return nil, err
 	}
 
@@ -915,9 +1173,9 @@ func (db *DBnode) GetChatKeys(chatID int64, limit, offset int) (*[]ChatKey, erro
 
 //Recupera lista chiavi Chat per PubKey
 func (db *DBnode) GetChatKeysByPubKey(pubkey string, limit, offset int) (*[]ChatKey, error) {
-	stmt, err := db.DB.Prepare("SELECT `ChatID`,`KeyAlias`,`PubKey` FROM `chatkeys` WHERE PubKey = ? LIMIT ? OFFSET ?")
+	stmt, err := db.DB.Prepare("SELECT `ChatID`,`KeyAlias`,`PubKey` FROM `chatkeys` WHERE PubKey = ? ORDER BY `ChatID` LIMIT ? OFFSET ?")
 	if err != nil {
-		log.Println("GetChatKeysByPubKey error:", err)
+		dbError("GetChatKeysByPubKey", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -925,7 +1183,7 @@ func (db *DBnode) GetChatKeysByPubKey(pubkey string, limit, offset int) (*[]Chat
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(pubkey, limit, offset)
 	if err != nil {
-		log.Println("GetChatKeysByPubKey error:", err)
+		dbError("GetChatKeysByPubKey", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -936,7 +1194,7 @@ func (db *DBnode) GetChatKeysByPubKey(pubkey string, limit, offset int) (*[]Chat
 		var pubkey string
 		err = rows.Scan(&chatid, &keyalias, &pubkey)
 		if err != nil {
-			log.Println("GetChatKeys error:", err)
+			dbError("GetChatKeysByPubKey", err)
 			return nil, err
 		}
 
@@ -944,7 +1202,7 @@ func (db *DBnode) GetChatKeysByPubKey(pubkey string, limit, offset int) (*[]Chat
 		chatkeys = append(chatkeys, ChatKey{ChatID: chatid, KeyAlias: keyalias, PubKey: pubkey})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetChatKeysByPubKey error:", err)
+		dbError("GetChatKeysByPubKey", err)
 		return nil, err
 	}
 
@@ -956,14 +1214,14 @@ func (db *DBnode) DelChatKey(chatID int64, keyAlias string) error {
 	log.Println("DelChatKey:", chatID, keyAlias)
 	stmt, err := db.DB.Prepare("DELETE FROM `chatkeys` WHERE ChatID = ? AND KeyAlias = ?")
 	if err != nil {
-		log.Println("DelChatKey error:", err)
+		dbError("DelChatKey", err)
 		return err
 	}
 	defer stmt.Close()
 
 	_, err = stmt.Exec(chatID, keyAlias)
 	if err != nil {
-		log.Println("DelChatKey error:", err)
+		dbError("DelChatKey", err)
 	}
 
 	return nil
@@ -974,15 +1232,15 @@ func (db *DBnode) GetMiningKey(pubkey string) (*MiningKey, error) {
 	log.Println("GetMiningKey:", pubkey)
 	retVal := &MiningKey{}
 
-	stmt, err := db.DB.Prepare("SELECT `PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`Bls`,`Dsa` FROM `miningkeys` where PubKey = ?")
+	stmt, err := db.DB.Prepare("SELECT `PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`InAutoStaking`,`Bls`,`Dsa` FROM `miningkeys` where PubKey = ?")
 	if err != nil {
-		log.Println("GetMiningKey error:", err)
+		dbError("GetMiningKey", err)
 		return nil, err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(pubkey).Scan(&retVal.PubKey, &retVal.LastStatus, &retVal.LastPRV, &retVal.IsAutoStake, &retVal.Bls, &retVal.Dsa)
+	err = stmt.QueryRow(pubkey).Scan(&retVal.PubKey, &retVal.LastStatus, &retVal.LastPRV, &retVal.IsAutoStake, &retVal.InAutoStaking, &retVal.Bls, &retVal.Dsa)
 	if err != nil {
-		log.Println("GetMiningKey error:", err)
+		dbError("GetMiningKey", err)
 		return nil, err
 	} else {
 	}
@@ -991,50 +1249,69 @@ func (db *DBnode) GetMiningKey(pubkey string) (*MiningKey, error) {
 	return retVal, err
 }
 
-//Aggiorna/crea MiningKey con chiave `PubKey`
-func (db *DBnode) UpdateMiningKey(miningkey *MiningKey, callback StatusChangeNotifierFunc) error {
+//Aggiorna/crea MiningKey con chiave `PubKey`, chiama callback se cambia stato o PRV ed ascallback
+//(al posto di callback) se la chiave perde l'autostake o sparisce da AutoStaking.
+//Con ascallback nil (stato non letto dal checker) IsAutoStake ed InAutoStaking restano quelli salvati
+//(false per una chiave nuova) e la perdita dell'autostake non viene cercata.
+func (db *DBnode) UpdateMiningKey(miningkey *MiningKey, callback StatusChangeNotifierFunc, ascallback AutoStakeLostNotifierFunc) error {
 	log.Printf("UpdateMiningKey: %+v\n", miningkey)
 	mk, e := db.GetMiningKey(miningkey.PubKey) //prendiamo la MiningKey prima di aggiornarla
 	var precLastStatus = "missing"
 	var precPRV int64 = 0
+	autostakeLost, disappeared := false, false
 	if e == nil { //se c'era ci salviamo lo stato precedente e lo aggiorniamo (esclusa la chiave)
 		if miningkey.LastPRV == -1 { //non ci stanno passando i PRV, assumiamo che non cambiano
 			miningkey.LastPRV = mk.LastPRV
 		}
 		precLastStatus = mk.LastStatus //salviamo il vecchio LastStatus prima di aggiornare
 		precPRV = mk.LastPRV           //salviamo il vecchio PRV prima di aggiornare
-		stmt, err := db.DB.Prepare("UPDATE miningkeys SET LastStatus = ?, LastPRV = ?, IsAutoStake = ?, Bls = ?, Dsa = ? WHERE PubKey = ?")
+		if ascallback == nil {
+			miningkey.IsAutoStake, miningkey.InAutoStaking = mk.IsAutoStake, mk.InAutoStaking
+		}
+		disappeared = mk.InAutoStaking && !miningkey.InAutoStaking
+		autostakeLost = disappeared || (mk.IsAutoStake && !miningkey.IsAutoStake && miningkey.InAutoStaking)
+		stmt, err := db.DB.Prepare("UPDATE miningkeys SET LastStatus = ?, LastPRV = ?, IsAutoStake = ?, InAutoStaking = ?, Bls = ?, Dsa = ? WHERE PubKey = ?")
 		if err != nil {
-			log.Println("UpdateMiningKey error:", err)
+			dbError("UpdateMiningKey", err)
 			return err
 		}
 		defer stmt.Close()
 
-		_, err = stmt.Exec(miningkey.LastStatus, miningkey.LastPRV, miningkey.IsAutoStake, miningkey.Bls, miningkey.Dsa, miningkey.PubKey)
+		_, err = stmt.Exec(miningkey.LastStatus, miningkey.LastPRV, miningkey.IsAutoStake, miningkey.InAutoStaking, miningkey.Bls, miningkey.Dsa, miningkey.PubKey)
 		if err != nil {
-			log.Println("UpdateMiningKey error:", err)
+			dbError("UpdateMiningKey", err)
 		}
 	} else { //il record non c'era, lo inseriamo
 		if miningkey.LastPRV == -1 { //non ci stanno passando i PRV, azzeriamo su nuovo record
 			miningkey.LastPRV = 0
 		}
+		if ascallback == nil {
+			miningkey.IsAutoStake, miningkey.InAutoStaking = false, false
+		}
 		precLastStatus = "missing" //non abbiano un LastStatus precedente
-		stmt, err := db.DB.Prepare("INSERT INTO `miningkeys`(`PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`Bls`,`Dsa`) VALUES (?,?,?,?,?,?)")
+		stmt, err := db.DB.Prepare("INSERT INTO `miningkeys`(`PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`InAutoStaking`,`Bls`,`Dsa`) VALUES (?,?,?,?,?,?,?)")
 		if err != nil {
-			log.Println("UpdateMiningKey error:", err)
+			dbError("UpdateMiningKey", err)
 			return err
 		}
 		defer stmt.Close()
 
-		_, err = stmt.Exec(miningkey.PubKey, miningkey.LastStatus, miningkey.LastPRV, miningkey.IsAutoStake, miningkey.Bls, miningkey.Dsa)
+		_, err = stmt.Exec(miningkey.PubKey, miningkey.LastStatus, miningkey.LastPRV, miningkey.IsAutoStake, miningkey.InAutoStaking, miningkey.Bls, miningkey.Dsa)
 		if err != nil {
-			log.Println("UpdateMiningKey error:", err)
+			dbError("UpdateMiningKey", err)
 		}
 	}
 
-	log.Printf("UpdateMiningKey STATUS: (%s)=(%s) (%d)=(%d)\n", precLastStatus, miningkey.LastStatus, precPRV, miningkey.LastPRV)
-	if (precLastStatus != miningkey.LastStatus) || (precPRV != miningkey.LastPRV) { //status changed, must notify
+	log.Printf("UpdateMiningKey STATUS: (%s)=(%s) (%s)=(%s)\n", precLastStatus, miningkey.LastStatus, PRVAmount(precPRV), PRVAmount(miningkey.LastPRV))
+	if autostakeLost { //evento prioritario, sostituisce la notifica di cambio stato
+		log.Printf("UpdateMiningKey key %s lost autostake (disappeared: %t)", miningkey.PubKey, disappeared)
+		db.AddMiningKeyHistory(miningkey, EventAutoStakeOff)
+		if err := ascallback(miningkey, disappeared); err != nil {
+			log.Println("UpdateMiningKey Err in autostake callback: ", err)
+		}
+	} else if (precLastStatus != miningkey.LastStatus) || PRVAmount(precPRV).Cmp(PRVAmount(miningkey.LastPRV)) != 0 { //status changed, must notify
 		log.Printf("UpdateMiningKey found status change for key %s: from \"%s\" to\" %s\".", miningkey.PubKey, precLastStatus, miningkey.LastStatus)
+		db.AddMiningKeyHistory(miningkey, StatusChangeEvent(precLastStatus, miningkey.LastStatus, precPRV, miningkey.LastPRV))
 		err := callback(miningkey, precLastStatus, precPRV)
 		if err != nil {
 			log.Println("UpdateMiningKey Err in callback: ", err)
@@ -1045,11 +1322,36 @@ func (db *DBnode) UpdateMiningKey(miningkey *MiningKey, callback StatusChangeNot
 	return nil
 }
 
+//Salva Bls e Dsa di una MiningKey senza toccarne lo stato e senza notifiche, creandola se non esiste
+func (db *DBnode) SaveMiningKeyInfo(pubkey, bls, dsa string, isautostake bool) error {
+	log.Println("SaveMiningKeyInfo:", pubkey, bls)
+	_, err := db.DB.Exec("INSERT OR IGNORE INTO `miningkeys`(`PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`Bls`,`Dsa`) VALUES (?,?,?,?,?,?)", pubkey, "missing", 0, isautostake, bls, dsa)
+	if err != nil {
+		dbError("SaveMiningKeyInfo", err)
+		return err
+	}
+	_, err = db.DB.Exec("UPDATE `miningkeys` SET `Bls` = ?, `Dsa` = ? WHERE `PubKey` = ?", bls, dsa, pubkey)
+	if err != nil {
+		dbError("SaveMiningKeyInfo", err)
+	}
+	return err
+}
+
+//Salva nello storico della chiave l'evento ed il nuovo stato
+func (db *DBnode) AddMiningKeyHistory(miningkey *MiningKey, event NotifyEvent) error {
+	_, err := db.DB.Exec("INSERT INTO `miningkeyhistory`(`PubKey`,`Timestamp`,`Event`,`Status`,`PRV`,`IsAutoStake`,`InAutoStaking`) VALUES (?,?,?,?,?,?,?)",
+		miningkey.PubKey, MakeTSFromTime(time.Now()), string(event), miningkey.LastStatus, miningkey.LastPRV, miningkey.IsAutoStake, miningkey.InAutoStaking)
+	if err != nil {
+		dbError("AddMiningKeyHistory", err)
+	}
+	return err
+}
+
 //Recupera lista chiavi mining
 func (db *DBnode) GetMiningKeys(limit, offset int) (*[]MiningKey, error) {
 	stmt, err := db.DB.Prepare("SELECT `PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`Bls`,`Dsa` FROM `miningkeys` LIMIT ? OFFSET ?")
 	if err != nil {
-		log.Println("GetMiningKeys error:", err)
+		dbError("GetMiningKeys", err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -1057,7 +1359,7 @@ func (db *DBnode) GetMiningKeys(limit, offset int) (*[]MiningKey, error) {
 	rows := &sql.Rows{}
 	rows, err = stmt.Query(limit, offset)
 	if err != nil {
-		log.Println("GetMiningKeys error:", err)
+		dbError("GetMiningKeys", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -1071,7 +1373,7 @@ func (db *DBnode) GetMiningKeys(limit, offset int) (*[]MiningKey, error) {
 		var dsa string
 		err = rows.Scan(&pubkey, &laststatus, &lastprv, &isautostake, &bls, &dsa)
 		if err != nil {
-			log.Println("GetMiningKeys error:", err)
+			dbError("GetMiningKeys", err)
 			return nil, err
 		}
 
@@ -1079,13 +1381,93 @@ func (db *DBnode) GetMiningKeys(limit, offset int) (*[]MiningKey, error) {
 		miningkeys = append(miningkeys, MiningKey{PubKey: pubkey, LastStatus: laststatus, LastPRV: lastprv, IsAutoStake: isautostake, Bls: bls, Dsa: dsa})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println("GetMiningKeys error:", err)
+		dbError("GetMiningKeys", err)
 		return nil, err
 	}
 
 	return &miningkeys, err
 }
 
+//Recupera una pagina di chiavi mining in ordine di PubKey a partire dalla chiave successiva ad after
+//("" per la prima pagina): a differenza di OFFSET non salta chiavi se la tabella cambia durante il ciclo
+func (db *DBnode) GetMiningKeysAfter(after string, limit int) ([]MiningKey, error) {
+	rows, err := db.DB.Query("SELECT `PubKey`,`LastStatus`,`LastPRV`,`IsAutoStake`,`InAutoStaking`,`Bls`,`Dsa` FROM `miningkeys` WHERE `PubKey` > ? ORDER BY `PubKey` LIMIT ?", after, limit)
+	if err != nil {
+		dbError("GetMiningKeysAfter", err)
+		return nil, err
+	}
+	defer rows.Close()
+	miningkeys := []MiningKey{}
+	for rows.Next() {
+		var mk MiningKey
+		if err := rows.Scan(&mk.PubKey, &mk.LastStatus, &mk.LastPRV, &mk.IsAutoStake, &mk.InAutoStaking, &mk.Bls, &mk.Dsa); err != nil {
+			dbError("GetMiningKeysAfter", err)
+			return nil, err
+		}
+		miningkeys = append(miningkeys, mk)
+	}
+	if err := rows.Err(); err != nil {
+		dbError("GetMiningKeysAfter", err)
+		return nil, err
+	}
+	return miningkeys, nil
+}
+
+//Chiama f per ogni chiave mining leggendo la tabella a pagine di pageSize chiavi,
+//si ferma al primo errore di f o del db
+func (db *DBnode) ForEachMiningKeysPage(pageSize int, f func(page []MiningKey) error) error {
+	after := ""
+	for {
+		page, err := db.GetMiningKeysAfter(after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		if err := f(page); err != nil {
+			return err
+		}
+		if len(page) < pageSize {
+			return nil
+		}
+		after = page[len(page)-1].PubKey
+	}
+}
+
+//Salva l'esito di un ciclo di controllo delle chiavi di mining
+func (db *DBnode) AddCheckCycle(cc *CheckCycle) error {
+	stmt, err := db.DB.Prepare("INSERT INTO `checkcycles`(`Timestamp`,`Duration`,`Outcome`,`Keys`,`Changed`,`Failed`) VALUES (?,?,?,?,?,?)")
+	if err != nil {
+		dbError("AddCheckCycle", err)
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(cc.Timestamp, cc.Duration, cc.Outcome, cc.Keys, cc.Changed, cc.Failed)
+	if err != nil {
+		dbError("AddCheckCycle", err)
+	}
+	return err
+}
+
+//Recupera l'ultimo ciclo di controllo delle chiavi di mining
+func (db *DBnode) GetLastCheckCycle() (*CheckCycle, error) {
+	retVal := &CheckCycle{}
+	stmt, err := db.DB.Prepare("SELECT `Timestamp`,`Duration`,`Outcome`,`Keys`,`Changed`,`Failed` FROM `checkcycles` ORDER BY `Timestamp` DESC LIMIT 1")
+	if err != nil {
+		dbError("GetLastCheckCycle", err)
+		return nil, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow().Scan(&retVal.Timestamp, &retVal.Duration, &retVal.Outcome, &retVal.Keys, &retVal.Changed, &retVal.Failed)
+	if err != nil {
+		dbError("GetLastCheckCycle", err)
+		return nil, err
+	}
+	return retVal, nil
+}
+
 func (db *DBnode) GetRingraziamentoText() string {
 	f := []string{
 		"\nIl Giorno del Ringraziamento è una tipica festa americana!😂😂😂Comunque mi risulta che in Italia si sia festaggiato una volta il 9/9/2020",
@@ -1254,15 +1636,148 @@ func (db *DBnode) CreateTablesIfNotExists() error {
 	"ChatID"	INTEGER NOT NULL,
 	PRIMARY KEY("LOId","ChatID")
 )`,
+		`CREATE TABLE IF NOT EXISTS "pendingimports" (
+	"ChatID"	INTEGER NOT NULL,
+	"Payload"	TEXT,
+	"Timestamp"	INTEGER,
+	PRIMARY KEY("ChatID")
+)`,
+		`CREATE TABLE IF NOT EXISTS "notifyprefs" (
+	"ChatID"	INTEGER NOT NULL,
+	"PubKey"	TEXT NOT NULL DEFAULT '',
+	"Event"	TEXT NOT NULL,
+	"Enabled"	INTEGER DEFAULT 1,
+	"Threshold"	INTEGER DEFAULT 0,
+	PRIMARY KEY("ChatID","PubKey","Event")
+)`,
+		`CREATE TABLE IF NOT EXISTS "notifyqueue" (
+	"NQId"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"ChatID"	INTEGER NOT NULL,
+	"Event"	TEXT,
+	"Text"	TEXT,
+	"Timestamp"	INTEGER
+)`,
+		`CREATE TABLE IF NOT EXISTS "miningkeyhistory" (
+	"PubKey"	TEXT NOT NULL,
+	"Timestamp"	INTEGER NOT NULL,
+	"Event"	TEXT,
+	"Status"	TEXT,
+	"PRV"	INTEGER,
+	"IsAutoStake"	INTEGER,
+	"InAutoStaking"	INTEGER
+)`,
+		`CREATE TABLE IF NOT EXISTS "prices" (
+	"Symbol"	TEXT NOT NULL,
+	"Fiat"	TEXT NOT NULL,
+	"Price"	REAL,
+	"Timestamp"	INTEGER,
+	PRIMARY KEY("Symbol","Fiat")
+)`,
+		`CREATE TABLE IF NOT EXISTS "tokens" (
+	"ID"	TEXT NOT NULL,
+	"Symbol"	TEXT,
+	"Name"	TEXT,
+	"Decimals"	INTEGER DEFAULT 9,
+	"Timestamp"	INTEGER,
+	PRIMARY KEY("ID")
+)`,
+		`CREATE TABLE IF NOT EXISTS "updates" (
+	"UpdateID"	INTEGER NOT NULL,
+	"ChatID"	INTEGER,
+	"Timestamp"	INTEGER,
+	PRIMARY KEY("UpdateID")
+)`,
+		`CREATE TABLE IF NOT EXISTS "committeesnapshots" (
+	"Shard"	TEXT NOT NULL,
+	"Epoch"	INTEGER,
+	"Keys"	TEXT,
+	PRIMARY KEY("Shard")
+)`,
+		`CREATE TABLE IF NOT EXISTS "shardswaps" (
+	"Epoch"	INTEGER NOT NULL,
+	"Shard"	TEXT NOT NULL,
+	"SwapIn"	INTEGER DEFAULT 0,
+	"Epochs"	INTEGER DEFAULT 1,
+	PRIMARY KEY("Epoch","Shard")
+)`,
+		`CREATE TABLE IF NOT EXISTS "checkcycles" (
+	"Timestamp"	INTEGER NOT NULL,
+	"Duration"	REAL,
+	"Outcome"	TEXT,
+	"Keys"	INTEGER DEFAULT 0
+)`,
+	}
+	//colonne aggiunte dopo la creazione delle tabelle: table, column, definition
+	var add_columns = [...][3]string{
+		{"chatdata", "IsAdmin", "INTEGER DEFAULT 0"},
+		{"chatdata", "TimeZone", "TEXT DEFAULT ''"},
+		{"chatdata", "QuietStart", "INTEGER DEFAULT 0"},
+		{"chatdata", "QuietEnd", "INTEGER DEFAULT 0"},
+		{"chatdata", "Digest", "TEXT DEFAULT 'off'"},
+		{"chatdata", "LastDigest", "INTEGER DEFAULT 0"},
+		{"chatdata", "LastDigestEpoch", "INTEGER DEFAULT 0"},
+		{"lotteries", "TimeZone", "TEXT DEFAULT ''"},
+		{"miningkeys", "InAutoStaking", "INTEGER DEFAULT 0"},
+		{"chatdata", "Fiat", "TEXT DEFAULT ''"},
+		{"checkcycles", "Changed", "INTEGER DEFAULT 0"},
+		{"checkcycles", "Failed", "INTEGER DEFAULT 0"},
+		{"urlnodes", "ChainName", "TEXT DEFAULT ''"},
+		{"urlnodes", "ActiveShards", "INTEGER DEFAULT 0"},
+		{"urlnodes", "NodeVersion", "TEXT DEFAULT ''"},
+		{"urlnodes", "BeaconHeight", "INTEGER DEFAULT 0"},
+		{"urlnodes", "BeaconLag", "INTEGER DEFAULT -1"},
+		{"urlnodes", "ProbeTS", "INTEGER DEFAULT 0"},
+		{"urlnodes", "Auth", "TEXT DEFAULT ''"},
+		{"urlnodes", "DownChecks", "INTEGER DEFAULT 0"},
 	}
 	var err error = nil
 	for _, statement := range create_statements {
 		//log.Println(statement)
 		_, err = db.DB.Exec(statement)
 		if err != nil {
-			log.Println("CreateTablesIfNotExists error:", err)
+			dbError("CreateTablesIfNotExists", err)
 			return err
 		}
 	}
+	for _, column := range add_columns {
+		err = db.addColumnIfNotExists(column[0], column[1], column[2])
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+//aggiunge la colonna alla tabella se non è già presente
+func (db *DBnode) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := db.DB.Query("PRAGMA table_info(`" + table + "`)")
+	if err != nil {
+		dbError("addColumnIfNotExists", err)
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			dbError("addColumnIfNotExists", err)
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return nil
+	}
+	log.Printf("addColumnIfNotExists: adding %s.%s\n", table, column)
+	_, err = db.DB.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + column + "` " + definition)
+	if err != nil {
+		dbError("addColumnIfNotExists", err)
+	}
 	return err
 }
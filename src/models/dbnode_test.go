@@ -0,0 +1,173 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestForEachMiningKeysPage(t *testing.T) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	db.DB.SetMaxOpenConns(1) //ogni connessione a :memory: è un db diverso
+	if err := db.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	noop := func(*MiningKey, string, int64) error { return nil }
+	noopAS := func(*MiningKey, bool) error { return nil }
+	for i := 0; i < 250; i++ {
+		mk := &MiningKey{PubKey: fmt.Sprintf("key%03d", i), LastStatus: RoleWaiting}
+		if err := db.UpdateMiningKey(mk, noop, noopAS); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := map[string]bool{}
+	pages := 0
+	err = db.ForEachMiningKeysPage(100, func(page []MiningKey) error {
+		pages++
+		for _, mk := range page {
+			if seen[mk.PubKey] {
+				t.Errorf("%s seen twice", mk.PubKey)
+			}
+			seen[mk.PubKey] = true
+		}
+		if pages == 1 { //una chiave aggiunta prima del cursore non sposta le pagine successive (con OFFSET key099 tornerebbe due volte)
+			db.UpdateMiningKey(&MiningKey{PubKey: "key000a"}, noop, noopAS)
+		}
+		return nil
+	})
+	if err != nil || pages != 3 || len(seen) != 250 {
+		t.Errorf("got %d pages, %d keys, err %v", pages, len(seen), err)
+	}
+
+	stop := errors.New("stop")
+	pages = 0
+	err = db.ForEachMiningKeysPage(100, func(page []MiningKey) error {
+		pages++
+		return stop
+	})
+	if err != stop || pages != 1 {
+		t.Errorf("got %d pages, err %v", pages, err)
+	}
+}
+
+func TestUpdateUrlNodeInfo(t *testing.T) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	db.DB.SetMaxOpenConns(1)
+	if err := db.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	ni := &NodeInfo{ChainName: "mainnet", ActiveShards: 8, Version: "1.2.3", BeaconHeight: 1000, BeaconLag: 2}
+	if err := db.UpdateUrlNode(&UrlNode{ChatID: 1, NodeName: "n1", NodeURL: "http://a:9334", Info: ni, ProbeTS: 42}); err != nil {
+		t.Fatal(err)
+	}
+	un, err := db.GetUrlNode(1, "n1")
+	if err != nil || un.Info == nil || *un.Info != *ni || un.ProbeTS != 42 {
+		t.Fatalf("got %+v %v", un, err)
+	}
+	//aggiornato senza verifica: i dati vecchi non valgono più
+	if err := db.UpdateUrlNode(&UrlNode{ChatID: 1, NodeName: "n1", NodeURL: "http://b:9334"}); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := db.GetUrlNodes(1, 10, 0)
+	if err != nil || len(*nodes) != 1 || (*nodes)[0].Info != nil || (*nodes)[0].NodeURL != "http://b:9334" {
+		t.Errorf("got %+v %v", nodes, err)
+	}
+	//esito del checker: solo DownChecks se il nodo non ha risposto
+	un = &(*nodes)[0]
+	un.DownChecks = 2
+	if err := db.UpdateUrlNodeCheck(un); err != nil {
+		t.Fatal(err)
+	}
+	db.UpdateUrlNode(&UrlNode{ChatID: 2, NodeName: "n2", NodeURL: "http://c:9334"})
+	all, err := db.GetUrlNodesAfter(0, 10)
+	if err != nil || len(all) != 2 || all[0].DownChecks != 2 || all[0].Info != nil || all[1].ChatID != 2 {
+		t.Errorf("got %+v %v", all, err)
+	}
+	if rest, _ := db.GetUrlNodesAfter(all[0].UNId, 10); len(rest) != 1 || rest[0].UNId != all[1].UNId {
+		t.Errorf("after %d got %+v", all[0].UNId, rest)
+	}
+	//nodo aggiunto di nuovo con /addnode: si riparte da zero
+	db.UpdateUrlNode(&UrlNode{ChatID: 1, NodeName: "n1", NodeURL: "http://b:9334"})
+	if un, _ := db.GetUrlNode(1, "n1"); un.DownChecks != 0 {
+		t.Errorf("DownChecks not reset: %d", un.DownChecks)
+	}
+}
+
+func TestMigrateChatExistingDestination(t *testing.T) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	db.DB.SetMaxOpenConns(1)
+	if err := db.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := db.GetUserByChatID(-100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Name, old.Notify = "Gruppo", false
+	db.UpdateUser(old)
+	db.SetChatFiat(-100, "EUR")
+	db.UpdateUrlNode(&UrlNode{ChatID: -100, NodeName: "n1", NodeURL: "http://a:9334"})
+	if _, err := db.GetUserByChatID(-1001234); err != nil { //il primo messaggio del supergruppo crea la chat coi default
+		t.Fatal(err)
+	}
+	if err := db.MigrateChat(-100, -1001234); err != nil {
+		t.Fatal(err)
+	}
+	if db.UserExists(-100) {
+		t.Errorf("old chat still there")
+	}
+	migrated, err := db.GetUserByChatID(-1001234)
+	if err != nil || migrated.Name != "Gruppo" || migrated.Notify || db.GetChatFiat(-1001234) != "EUR" {
+		t.Errorf("settings not migrated: %+v %v fiat %s", migrated, err, db.GetChatFiat(-1001234))
+	}
+	if un, err := db.GetUrlNode(-1001234, "n1"); err != nil || un.NodeURL != "http://a:9334" {
+		t.Errorf("node not migrated: %+v %v", un, err)
+	}
+	//la seconda notifica della migrazione non deve toccare nulla
+	if err := db.MigrateChat(-100, -1001234); err != nil || !db.UserExists(-1001234) {
+		t.Errorf("second migration: %v", err)
+	}
+}
+
+func TestUpdateMiningKeyWithoutAutoStakeCheck(t *testing.T) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	db.DB.SetMaxOpenConns(1)
+	if err := db.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	noop := func(*MiningKey, string, int64) error { return nil }
+	lost := 0
+	countLost := func(*MiningKey, bool) error { lost++; return nil }
+	if err := db.UpdateMiningKey(&MiningKey{PubKey: "k1", LastStatus: RoleWaiting, IsAutoStake: true, InAutoStaking: true}, noop, countLost); err != nil {
+		t.Fatal(err)
+	}
+	//stato letto fuori dal checker: la chiave sembra sparita da AutoStaking ma non cambia nulla
+	if err := db.UpdateMiningKey(&MiningKey{PubKey: "k1", LastStatus: RoleWaiting}, noop, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mk, err := db.GetMiningKey("k1"); err != nil || !mk.IsAutoStake || !mk.InAutoStaking {
+		t.Errorf("autostake overwritten: %+v %v", mk, err)
+	}
+	if err := db.UpdateMiningKey(&MiningKey{PubKey: "k1", LastStatus: RoleWaiting}, noop, countLost); err != nil {
+		t.Fatal(err)
+	}
+	if lost != 1 {
+		t.Errorf("autostake lost notified %d times", lost)
+	}
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DigestOff    = "off"   //notifiche subito (salvo le ore di silenzio)
+	DigestDaily  = "daily" //un riepilogo al giorno
+	DigestEpoch  = "epoch" //un riepilogo ad ogni nuova epoch
+	digestMaxLen = 4000    //caratteri massimi di un messaggio di riepilogo, sotto i 4096 di Telegram con margine
+)
+
+// Come e quando consegnare le notifiche di una chat: ore di silenzio nel fuso della chat e modalità riepilogo
+type NotifySchedule struct {
+	ChatID          int64
+	QuietStart      int    //ora di inizio del silenzio (0-23)
+	QuietEnd        int    //ora di fine del silenzio (0-23), uguale a QuietStart vuol dire nessun silenzio
+	TimeZone        string //nome IANA del fuso, vuoto per quello del server
+	Digest          string //DigestOff, DigestDaily o DigestEpoch
+	LastDigest      int64  //timestamp dell'ultimo riepilogo mandato
+	LastDigestEpoch int64  //epoch dell'ultimo riepilogo mandato
+}
+
+// Notifica in coda in attesa del riepilogo o della fine delle ore di silenzio
+type QueuedNotify struct {
+	NQId      int64
+	ChatID    int64
+	Event     NotifyEvent
+	Text      string
+	Timestamp int64
+}
+
+//ritorna vero per gli eventi che vanno notificati subito anche nelle ore di silenzio o in modalità riepilogo
+func IsCriticalEvent(event NotifyEvent) bool {
+	return event == EventMissing || event == EventAutoStakeOff || event == EventNodeDown
+}
+
+//ritorna il fuso della chat, quello del server se non impostato o non valido
+func (ns *NotifySchedule) Location() *time.Location {
+	return LoadLocationOrLocal(ns.TimeZone)
+}
+
+//ritorna vero se t cade nelle ore di silenzio della chat
+func (ns *NotifySchedule) InQuietHours(t time.Time) bool {
+	if ns.QuietStart == ns.QuietEnd {
+		return false
+	}
+	h := t.In(ns.Location()).Hour()
+	if ns.QuietStart < ns.QuietEnd {
+		return h >= ns.QuietStart && h < ns.QuietEnd
+	}
+	return h >= ns.QuietStart || h < ns.QuietEnd //a cavallo della mezzanotte
+}
+
+//ritorna vero se le notifiche in coda vanno mandate ora, epoch è quella corrente (0 se non nota)
+func (ns *NotifySchedule) DigestDue(now time.Time, epoch int64) bool {
+	if ns.InQuietHours(now) {
+		return false
+	}
+	switch ns.Digest {
+	case DigestDaily:
+		loc := ns.Location()
+		return ns.LastDigest == 0 || GetTSTime(ns.LastDigest).In(loc).Format("2006-01-02") != now.In(loc).Format("2006-01-02")
+	case DigestEpoch:
+		return epoch > ns.LastDigestEpoch
+	default:
+		return true
+	}
+}
+
+//Recupera orari e modalità di consegna delle notifiche della chat (i default se non c'è la chat)
+func (db *DBnode) GetNotifySchedule(chatID int64) (*NotifySchedule, error) {
+	ns := &NotifySchedule{ChatID: chatID, Digest: DigestOff}
+	err := db.DB.QueryRow("SELECT `QuietStart`, `QuietEnd`, `TimeZone`, `Digest`, `LastDigest`, `LastDigestEpoch` FROM `chatdata` WHERE `ChatID` = ?", chatID).Scan(&ns.QuietStart, &ns.QuietEnd, &ns.TimeZone, &ns.Digest, &ns.LastDigest, &ns.LastDigestEpoch)
+	if err != nil {
+		dbError("GetNotifySchedule", err)
+	}
+	return ns, err
+}
+
+//Salva orari e modalità di consegna delle notifiche della chat
+func (db *DBnode) SetNotifySchedule(ns *NotifySchedule) error {
+	log.Printf("SetNotifySchedule: %+v\n", ns)
+	_, err := db.DB.Exec("UPDATE `chatdata` SET `QuietStart` = ?, `QuietEnd` = ?, `TimeZone` = ?, `Digest` = ?, `LastDigest` = ?, `LastDigestEpoch` = ? WHERE `ChatID` = ?", ns.QuietStart, ns.QuietEnd, ns.TimeZone, ns.Digest, ns.LastDigest, ns.LastDigestEpoch, ns.ChatID)
+	if err != nil {
+		dbError("SetNotifySchedule", err)
+	}
+	return err
+}
+
+//Mette in coda una notifica
+func (db *DBnode) QueueNotify(qn *QueuedNotify) error {
+	log.Printf("QueueNotify: %d %s\n", qn.ChatID, qn.Event)
+	_, err := db.DB.Exec("INSERT INTO `notifyqueue`(`ChatID`,`Event`,`Text`,`Timestamp`) VALUES (?,?,?,?)", qn.ChatID, string(qn.Event), qn.Text, qn.Timestamp)
+	if err != nil {
+		dbError("QueueNotify", err)
+	}
+	return err
+}
+
+//Recupera le chat con notifiche in coda
+func (db *DBnode) GetQueuedChatIDs() ([]int64, error) {
+	chatIDs := []int64{}
+	rows, err := db.DB.Query("SELECT DISTINCT `ChatID` FROM `notifyqueue` ORDER BY `ChatID`")
+	if err != nil {
+		dbError("GetQueuedChatIDs", err)
+		return chatIDs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chatID int64
+		if err = rows.Scan(&chatID); err != nil {
+			dbError("GetQueuedChatIDs", err)
+			return chatIDs, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbError("GetQueuedChatIDs", err)
+	}
+	return chatIDs, err
+}
+
+//Recupera le notifiche in coda della chat in ordine di arrivo
+func (db *DBnode) GetQueuedNotifies(chatID int64) ([]QueuedNotify, error) {
+	queued := []QueuedNotify{}
+	rows, err := db.DB.Query("SELECT `NQId`, `Event`, `Text`, `Timestamp` FROM `notifyqueue` WHERE `ChatID` = ? ORDER BY `NQId`", chatID)
+	if err != nil {
+		dbError("GetQueuedNotifies", err)
+		return queued, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		qn := QueuedNotify{ChatID: chatID}
+		var event string
+		if err = rows.Scan(&qn.NQId, &event, &qn.Text, &qn.Timestamp); err != nil {
+			dbError("GetQueuedNotifies", err)
+			return queued, err
+		}
+		qn.Event = NotifyEvent(event)
+		queued = append(queued, qn)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbError("GetQueuedNotifies", err)
+	}
+	return queued, err
+}
+
+//Elimina le notifiche in coda della chat fino a maxNQId compreso
+func (db *DBnode) DelQueuedNotifies(chatID, maxNQId int64) error {
+	_, err := db.DB.Exec("DELETE FROM `notifyqueue` WHERE `ChatID` = ? AND `NQId` <= ?", chatID, maxNQId)
+	if err != nil {
+		dbError("DelQueuedNotifies", err)
+	}
+	return err
+}
+
+//Consegna una notifica già filtrata con WantsNotify: subito se critica o se la chat non è in silenzio
+//e non vuole il riepilogo, altrimenti la mette in coda per FlushNotifyQueue
+func (env *Env) DeliverNotify(chatID int64, event NotifyEvent, text string) error {
+	now := time.Now()
+	if !IsCriticalEvent(event) {
+		ns, err := env.Db.GetNotifySchedule(chatID)
+		if err == nil && (ns.Digest == DigestDaily || ns.Digest == DigestEpoch || ns.InQuietHours(now)) {
+			return env.Db.QueueNotify(&QueuedNotify{ChatID: chatID, Event: event, Text: text, Timestamp: MakeTSFromTime(now)})
+		}
+	}
+	log.Printf("Notify chat: %d %s %s", chatID, event, text)
+	return env.SayText(chatID, text)
+}
+
+// Messaggio di un riepilogo con l'ultima notifica che contiene
+type digestChunk struct {
+	text     string
+	lastNQId int64
+}
+
+//divide le notifiche in coda in messaggi di al massimo digestMaxLen caratteri,
+//una notifica più lunga da sola viene troncata
+func digestChunks(queued []QueuedNotify, loc *time.Location) []digestChunk {
+	chunks := []digestChunk{}
+	header := fmt.Sprintf("Riepilogo notifiche (%d):", len(queued))
+	chunk := digestChunk{text: header}
+	for i, qn := range queued {
+		line := fmt.Sprintf("%s %s", GetTSTime(qn.Timestamp).In(loc).Format("01-02 15:04"), qn.Text)
+		if i > 0 && utf8.RuneCountInString(chunk.text)+1+utf8.RuneCountInString(line) > digestMaxLen {
+			chunks = append(chunks, chunk)
+			chunk = digestChunk{text: "Riepilogo notifiche (segue):"}
+		}
+		if max := digestMaxLen - utf8.RuneCountInString(chunk.text) - 1; utf8.RuneCountInString(line) > max {
+			line = string([]rune(line)[:max-1]) + "…"
+		}
+		chunk.text += "\n" + line
+		chunk.lastNQId = qn.NQId
+	}
+	return append(chunks, chunk)
+}
+
+//Manda il riepilogo, diviso in più messaggi se troppo lungo, alle chat con notifiche in coda per cui è il momento,
+//epoch è quella corrente del beacon (0 se non nota)
+func (env *Env) FlushNotifyQueue(epoch int64) {
+	chatIDs, err := env.Db.GetQueuedChatIDs()
+	if err != nil {
+		log.Println("FlushNotifyQueue error:", err)
+		return
+	}
+	now := time.Now()
+	for _, chatID := range chatIDs {
+		ns, err := env.Db.GetNotifySchedule(chatID)
+		if err != nil || !ns.DigestDue(now, epoch) {
+			continue
+		}
+		queued, err := env.Db.GetQueuedNotifies(chatID)
+		if err != nil || len(queued) == 0 {
+			continue
+		}
+		sent := true
+		for _, chunk := range digestChunks(queued, ns.Location()) {
+			if err := env.SayText(chatID, chunk.text); err != nil {
+				log.Println("FlushNotifyQueue error in sending:", chatID, err)
+				sent = false
+				break
+			}
+			env.Db.DelQueuedNotifies(chatID, chunk.lastNQId) //le parti mandate non vanno ripetute
+		}
+		if !sent {
+			continue
+		}
+		ns.LastDigest = MakeTSFromTime(now)
+		if epoch > 0 {
+			ns.LastDigestEpoch = epoch
+		}
+		env.Db.SetNotifySchedule(ns)
+	}
+}
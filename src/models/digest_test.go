@@ -0,0 +1,61 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestNotifyScheduleQuietAndDigest(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	ns := &NotifySchedule{QuietStart: 23, QuietEnd: 7, TimeZone: "Europe/Rome", Digest: DigestOff}
+	night := time.Date(2021, 1, 10, 2, 0, 0, 0, loc)
+	day := time.Date(2021, 1, 10, 12, 0, 0, 0, loc)
+	if !ns.InQuietHours(night) || ns.InQuietHours(day) {
+		t.Errorf("quiet 23-07: night %t day %t", ns.InQuietHours(night), ns.InQuietHours(day))
+	}
+	if ns.DigestDue(night, 0) || !ns.DigestDue(day, 0) {
+		t.Errorf("digest off: due at night or not due at day")
+	}
+
+	ns.Digest = DigestDaily
+	ns.LastDigest = MakeTSFromTime(day.Add(-time.Hour))
+	if ns.DigestDue(day, 0) {
+		t.Errorf("daily: due twice the same day")
+	}
+	if !ns.DigestDue(day.Add(24*time.Hour), 0) {
+		t.Errorf("daily: not due the next day")
+	}
+
+	ns.Digest = DigestEpoch
+	ns.LastDigestEpoch = 100
+	if ns.DigestDue(day, 100) || !ns.DigestDue(day, 101) {
+		t.Errorf("epoch: wrong due on epoch change")
+	}
+}
+
+func TestDigestChunks(t *testing.T) {
+	queued := []QueuedNotify{}
+	for i := 1; i <= 300; i++ {
+		queued = append(queued, QueuedNotify{NQId: int64(i), Text: strings.Repeat("è", 30)})
+	}
+	queued = append(queued, QueuedNotify{NQId: 301, Text: strings.Repeat("x", 5000)})
+	chunks := digestChunks(queued, time.UTC)
+	if len(chunks) < 3 {
+		t.Fatalf("want at least 3 chunks, got %d", len(chunks))
+	}
+	lines := 0
+	for _, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk.text); n > digestMaxLen {
+			t.Errorf("chunk of %d characters", n)
+		}
+		lines += strings.Count(chunk.text, "\n")
+	}
+	if lines != len(queued) || chunks[len(chunks)-1].lastNQId != 301 {
+		t.Errorf("lost notifications: %d lines, last %d", lines, chunks[len(chunks)-1].lastNQId)
+	}
+}
@@ -0,0 +1,266 @@
+package models
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	EndpointMaxFailures   = 3           //errori consecutivi dopo cui l'endpoint è giù
+	EndpointRetryAfter    = time.Minute //dopo quanto un endpoint giù torna ad essere provato
+	EndpointMaxBeaconLag  = 5           //blocchi beacon di ritardo oltre cui l'endpoint non è in sync
+	EndpointProbeInterval = time.Minute //ogni quanto il bot interroga gli endpoint
+	endpointLatencyWeight = 0.3         //peso dell'ultima misura nella media della latenza
+	EndpointRoleNode      = "node"      //nodi per beacon e blockchain info
+	EndpointRoleFullnode  = "fullnode"  //fullnode per reward e token
+)
+
+type endpoint struct {
+	url         string
+	latency     time.Duration //media mobile delle chiamate riuscite
+	failures    int           //errori consecutivi
+	lastErr     string
+	lastErrTime time.Time
+	lastOK      time.Time
+	height      int64 //altezza del beacon all'ultimo probe, 0 se sconosciuta
+	calls       int64
+	errors      int64
+}
+
+// Stato di un endpoint come mostrato da /endpoints
+type EndpointStatus struct {
+	URL         string
+	Up          bool //meno di EndpointMaxFailures errori consecutivi o ultimo errore più vecchio di EndpointRetryAfter
+	InSync      bool //beacon al massimo EndpointMaxBeaconLag blocchi dietro il migliore (o altezza sconosciuta)
+	Latency     time.Duration
+	Height      int64
+	Failures    int
+	LastError   string
+	LastErrTime time.Time
+	LastOK      time.Time
+	Calls       int64
+	Errors      int64
+}
+
+// Insieme di endpoint con lo stesso ruolo: le chiamate vanno al più sano e in caso di errore ad un altro
+type EndpointPool struct {
+	Role      string
+	mutex     sync.Mutex
+	endpoints []*endpoint
+}
+
+func NewEndpointPool(role string, urls []string) *EndpointPool {
+	pool := &EndpointPool{Role: role}
+	for _, u := range urls {
+		pool.endpoints = append(pool.endpoints, &endpoint{url: u})
+		registerNodeLabel(u)
+		EndpointUp.WithLabelValues(role, RedactURL(u)).Set(1)
+	}
+	return pool
+}
+
+//Ritorna l'url senza password né valori della query, da usare nei log, nelle metriche e in /endpoints
+func RedactURL(rawurl string) string {
+	return redactURLQuery(rawurl)
+}
+
+//ritorna lo stato degli endpoint in ordine di preferenza:
+//prima quelli su ed in sync, poi su ma indietro, poi giù; a parità la latenza minore
+func (pool *EndpointPool) Status() []EndpointStatus {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	now := time.Now()
+	var maxHeight int64
+	for _, ep := range pool.endpoints {
+		if ep.height > maxHeight {
+			maxHeight = ep.height
+		}
+	}
+	statuses := make([]EndpointStatus, 0, len(pool.endpoints))
+	for _, ep := range pool.endpoints {
+		statuses = append(statuses, EndpointStatus{
+			URL:         ep.url,
+			Up:          ep.failures < EndpointMaxFailures || now.Sub(ep.lastErrTime) >= EndpointRetryAfter,
+			InSync:      ep.height == 0 || maxHeight-ep.height <= EndpointMaxBeaconLag,
+			Latency:     ep.latency,
+			Height:      ep.height,
+			Failures:    ep.failures,
+			LastError:   ep.lastErr,
+			LastErrTime: ep.lastErrTime,
+			LastOK:      ep.lastOK,
+			Calls:       ep.calls,
+			Errors:      ep.errors,
+		})
+	}
+	rank := func(st EndpointStatus) int {
+		switch {
+		case st.Up && st.InSync:
+			return 0
+		case st.Up:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if rank(statuses[i]) != rank(statuses[j]) {
+			return rank(statuses[i]) < rank(statuses[j])
+		}
+		return statuses[i].Latency < statuses[j].Latency
+	})
+	return statuses
+}
+
+//url dell'endpoint preferito
+func (pool *EndpointPool) Best() string {
+	if statuses := pool.Status(); len(statuses) > 0 {
+		return statuses[0].URL
+	}
+	return ""
+}
+
+//Esegue call sugli endpoint in ordine di preferenza finché una non riesce, saltando quelli giù
+//se ce ne sono di su. Da usare solo per chiamate idempotenti (letture), perché possono essere ripetute.
+func (pool *EndpointPool) Do(call func(reqUrl string) error) error {
+	candidates := []string{}
+	down := []string{}
+	for _, st := range pool.Status() {
+		if st.Up {
+			candidates = append(candidates, st.URL)
+		} else {
+			down = append(down, st.URL)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = down
+	}
+	var err error
+	for i, reqUrl := range candidates {
+		if i > 0 {
+			log.Printf("EndpointPool %s: retrying on %s after error: %v", pool.Role, RedactURL(reqUrl), err)
+			RPCFailovers.WithLabelValues(pool.Role).Inc()
+		}
+		start := time.Now()
+		err = call(reqUrl)
+		pool.record(reqUrl, time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+//aggiorna salute e latenza dell'endpoint con l'esito di una chiamata
+func (pool *EndpointPool) record(reqUrl string, d time.Duration, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, ep := range pool.endpoints {
+		if ep.url != reqUrl {
+			continue
+		}
+		ep.calls++
+		if err != nil {
+			ep.errors++
+			ep.failures++
+			ep.lastErr = err.Error()
+			ep.lastErrTime = time.Now()
+			if ep.failures == EndpointMaxFailures {
+				log.Printf("EndpointPool %s: %s is down: %v", pool.Role, RedactURL(reqUrl), err)
+				EndpointUp.WithLabelValues(pool.Role, RedactURL(reqUrl)).Set(0)
+			}
+			return
+		}
+		if ep.failures >= EndpointMaxFailures {
+			log.Printf("EndpointPool %s: %s is up again", pool.Role, RedactURL(reqUrl))
+		}
+		ep.failures = 0
+		ep.lastOK = time.Now()
+		if ep.latency == 0 {
+			ep.latency = d
+		} else {
+			ep.latency = time.Duration(endpointLatencyWeight*float64(d) + (1-endpointLatencyWeight)*float64(ep.latency))
+		}
+		EndpointUp.WithLabelValues(pool.Role, RedactURL(reqUrl)).Set(1)
+		return
+	}
+}
+
+func (pool *EndpointPool) setHeight(reqUrl string, height int64) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, ep := range pool.endpoints {
+		if ep.url == reqUrl {
+			ep.height = height
+		}
+	}
+}
+
+//Interroga in parallelo tutti gli endpoint con getblockchaininfo per aggiornarne salute,
+//latenza ed altezza del beacon, anche con un solo endpoint (stato in /endpoints e nelle metriche).
+func (pool *EndpointPool) Probe() {
+	var wg sync.WaitGroup
+	for _, ep := range pool.endpoints {
+		wg.Add(1)
+		go func(reqUrl string) {
+			defer wg.Done()
+			bci := BCI{}
+			start := time.Now()
+			err := GetBlockChainInfo(reqUrl, &bci)
+			pool.record(reqUrl, time.Since(start), err)
+			if err == nil {
+				pool.setHeight(reqUrl, bci.Result.BestBlocks[BeaconBestBlockKey].Height)
+			}
+		}(ep.url)
+	}
+	wg.Wait()
+}
+
+//aggiorna lo stato di nodi e fullnode
+func (env *Env) ProbeEndpoints() {
+	env.NodePool.Probe()
+	env.FullnodePool.Probe()
+}
+
+//Stato del beacon (condiviso, da non modificare) dal nodo node o, se nil, dal pool dei nodi
+func (env *Env) GetBeaconSnapshot(node *RPCNode, bbsd *BBSD) error {
+	if node != nil {
+		return env.RPCCache.GetBeaconSnapshot(*node, bbsd)
+	}
+	return env.NodePool.Do(func(reqUrl string) error {
+		return env.RPCCache.GetBeaconSnapshot(RPCNode{URL: reqUrl}, bbsd)
+	})
+}
+
+//Stato del beacon appena letto (senza cache) dal pool dei nodi
+func (env *Env) GetBeaconBestStateDetail(bbsd *BBSD) error {
+	return env.NodePool.Do(func(reqUrl string) error {
+		*bbsd = BBSD{}
+		return GetBeaconBestStateDetail(reqUrl, bbsd)
+	})
+}
+
+//Blockchain info dal nodo node o, se nil, dal pool dei nodi
+func (env *Env) GetBlockChainInfo(node *RPCNode, bci *BCI) error {
+	if node != nil {
+		return node.GetBlockChainInfo(bci)
+	}
+	return env.NodePool.Do(func(reqUrl string) error {
+		*bci = BCI{}
+		return GetBlockChainInfo(reqUrl, bci)
+	})
+}
+
+//Reward delle chiavi bls letti dal pool dei fullnode con al massimo REWARD_WORKERS richieste in parallelo,
+//le chiavi in errore su tutti i fullnode mancano
+func (env *Env) GetMinerRewards(blsKeys []string) map[string]TMinerReward {
+	return getMinerRewards(env.REWARD_WORKERS, blsKeys, func(bls string) (TMinerReward, error) {
+		var reward TMinerReward
+		err := env.FullnodePool.Do(func(reqUrl string) error {
+			var err error
+			reward, err = env.RPCCache.GetMinerReward(reqUrl, bls)
+			return err
+		})
+		return reward, err
+	})
+}
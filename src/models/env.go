@@ -1,10 +1,11 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,10 +18,34 @@ type Env struct {
 	TOKEN                string
 	TGTOKEN              string
 	API                  string
+	FILE_API             string
 	BOT_NAME             string
 	BOT_CMDS             []Cmd
+	ADMIN_CMDS           []Cmd
+	ADMIN_CHATIDS        []int64
 	DEFAULT_NODE_URL     string
 	DEFAULT_FULLNODE_URL string
+	METRICS_ADDR         string
+	PRICE_URL            string
+	WEBHOOK_SECRET       string
+	WORKERS              int
+	QUEUE_SIZE           int
+	PUBLIC_URL           string
+	UPLOAD_CERT          bool
+	ALLOWED_UPDATES      []string
+	LISTEN_ADDR          string
+	CERT_FILE            string
+	KEY_FILE             string
+	LIST_LIMIT           int //massimo di chiavi e nodi letti per chat
+	CHECK_KEYS_LIMIT     int //chiavi lette per pagina nel ciclo di controllo
+	CHECK_WORKERS        int //chiavi controllate in parallelo
+	REWARD_WORKERS       int //richieste di reward in parallelo
+	Config               *Config
+	NodePool             *EndpointPool  //default_node_url e node_urls
+	FullnodePool         *EndpointPool  //default_fullnode_url e fullnode_urls
+	Credentials          *CredentialBox //nil se secret_key non è impostata
+	Prices               *PriceCache    //nil se PRICE_URL non è impostato
+	RPCCache             *RPCCache      //reward e stato del beacon letti di recente
 }
 
 type Cmd struct {
@@ -29,17 +54,24 @@ type Cmd struct {
 }
 
 func (env *Env) GetSendMessageUrl() string {
-	return env.API + env.TOKEN + "/sendMessage"
+	return env.GetApiUrl("sendMessage")
 }
 
-func NewEnv() *Env {
+func (env *Env) GetApiUrl(method string) string {
+	return env.API + env.TOKEN + "/" + method
+}
+
+//Crea l'ambiente dalla configurazione già validata (LoadConfig) ed apre il DB
+func NewEnv(cfg *Config) *Env {
+	RPCTimeout = cfg.RPCTimeout
 	env := &Env{
-		DBFILE:   os.Getenv("DBFILE"),
+		DBFILE:   cfg.DBFile,
 		Db:       nil,
-		TOKEN:    os.Getenv("TOKEN"),
-		TGTOKEN:  os.Getenv("TGTOKEN"),
+		TOKEN:    cfg.Token,
+		TGTOKEN:  cfg.TGToken,
 		API:      "https://api.telegram.org/bot",
-		BOT_NAME: "@incognito_node_bot",
+		FILE_API: "https://api.telegram.org/file/bot",
+		BOT_NAME: cfg.BotName,
 		BOT_CMDS: []Cmd{
 			Cmd{Cmd: "/start", Descr: "inizializza il bot"},
 			Cmd{Cmd: "/help", Descr: "elenco comandi bot"},
@@ -47,16 +79,50 @@ func NewEnv() *Env {
 			Cmd{Cmd: "/addnode", Descr: "[nodo] [urlnodo]: salva o aggiorna url del tuo nodo"},
 			Cmd{Cmd: "/delnode", Descr: "[nodo]: elimina il tuo nodo"},
 			Cmd{Cmd: "/listnodes", Descr: "elenca i tuoi nodi"},
-			Cmd{Cmd: "/addkey", Descr: "[alias] [pubkey]: salva o aggiorna public key del tuo miner"},
+			Cmd{Cmd: "/addkey", Descr: "[alias] [pubkey|bls:chiave]: salva o aggiorna public key del tuo miner"},
 			Cmd{Cmd: "/delkey", Descr: "[alias]: elimina la public key"},
 			Cmd{Cmd: "/listkeys", Descr: "elenca le tue public keys"},
 			Cmd{Cmd: "/status", Descr: "[nodo]: elenca lo stato delle tue key di mining"},
+			Cmd{Cmd: "/eta", Descr: "[alias]: posizione in coda e stima di ingresso in committee"},
 			Cmd{Cmd: "/balance", Descr: "[alias_chiave]: reward accurato della chiave di mining"},
+			Cmd{Cmd: "/fiat", Descr: "[EUR|USD|...|off]: currency used to value rewards"},
 			Cmd{Cmd: "/notify", Descr: "turns notifications off or on"},
+			Cmd{Cmd: "/settings", Descr: "[all|alias] [event] [on|off]: notifications per key and per event"},
+			Cmd{Cmd: "/tz", Descr: "[timezone|off]: timezone of the chat (e.g. Europe/Rome)"},
+			Cmd{Cmd: "/quiet", Descr: "[hh-hh|off] [timezone]: quiet hours for non critical notifications"},
+			Cmd{Cmd: "/digest", Descr: "[off|daily|epoch]: non critical notifications in one summary"},
 			Cmd{Cmd: "/lstickets", Descr: "[aaaa-mm] lists all lottery tickets"},
+			Cmd{Cmd: "/export", Descr: "[json|csv]: sends your keys and nodes as a file"},
+			Cmd{Cmd: "/import", Descr: "[confirm|cancel]: send a file with caption /import to replace your keys and nodes"},
 		},
-		DEFAULT_NODE_URL:     os.Getenv("DEFAULT_NODE_URL"),
-		DEFAULT_FULLNODE_URL: os.Getenv("DEFAULT_FULLNODE_URL"),
+		ADMIN_CMDS: []Cmd{
+			Cmd{Cmd: "/stats", Descr: "bot statistics"},
+			Cmd{Cmd: "/broadcast", Descr: "[text]: sends text to every chat with notifications on"},
+			Cmd{Cmd: "/user", Descr: "[chatid]: shows keys and nodes of a chat"},
+			Cmd{Cmd: "/endpoints", Descr: "health of the Incognito node endpoints"},
+		},
+		ADMIN_CHATIDS:        cfg.AdminChatIDs,
+		DEFAULT_NODE_URL:     cfg.DefaultNodeURL,
+		DEFAULT_FULLNODE_URL: cfg.DefaultFullnodeURL,
+		METRICS_ADDR:         cfg.MetricsAddr,
+		PRICE_URL:            cfg.PriceURL,
+		WEBHOOK_SECRET:       cfg.WebhookSecret,
+		WORKERS:              cfg.Workers,
+		QUEUE_SIZE:           cfg.QueueSize,
+		PUBLIC_URL:           strings.TrimRight(cfg.PublicURL, "/"),
+		UPLOAD_CERT:          cfg.UploadCert,
+		ALLOWED_UPDATES:      cfg.AllowedUpdates,
+		LISTEN_ADDR:          cfg.ListenAddr,
+		CERT_FILE:            cfg.CertFile,
+		KEY_FILE:             cfg.KeyFile,
+		LIST_LIMIT:           cfg.ListLimit,
+		CHECK_KEYS_LIMIT:     cfg.CheckKeysLimit,
+		CHECK_WORKERS:        cfg.CheckWorkers,
+		REWARD_WORKERS:       cfg.RewardWorkers,
+		Config:               cfg,
+		NodePool:             NewEndpointPool(EndpointRoleNode, cfg.NodeEndpoints()),
+		FullnodePool:         NewEndpointPool(EndpointRoleFullnode, cfg.FullnodeEndpoints()),
+		RPCCache:             NewRPCCache(cfg.RewardCacheTTL, cfg.BeaconCacheTTL),
 	}
 	log.Println("DBFILE: " + env.DBFILE)
 	db, err := NewDB("sqlite3", env.DBFILE)
@@ -64,15 +130,40 @@ func NewEnv() *Env {
 		log.Fatal(err)
 	}
 	env.Db = db
+	if cfg.SecretKey != "" {
+		if env.Credentials, err = NewCredentialBox(cfg.SecretKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if env.PRICE_URL != "" {
+		env.Prices = NewPriceCache(db, NewHTTPPriceProvider(env.PRICE_URL))
+	}
 
-	log.Println("SendMessageUrl: " + env.GetSendMessageUrl())
 	return env
 }
 
+//ritorna i ChatID di una lista separata da virgole o spazi, errore al primo non valido
+func parseChatIDs(list string) ([]int64, error) {
+	chatIDs := []int64{}
+	for _, s := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		chatID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat id %q", s)
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, nil
+}
+
+//ritorna tutti i comandi riconosciuti, compresi quelli degli admin
+func (env *Env) allCmds() []Cmd {
+	return append(append([]Cmd{}, env.BOT_CMDS...), env.ADMIN_CMDS...)
+}
+
 //ritorna il comando,se presente, e senza @nomebot tutto minuscolo. Altrimenti stringa vuota
 func (env *Env) StrCmd(text string) string {
 	t := strings.ToLower(strings.TrimLeft(text, " "))
-	for _, cmd := range env.BOT_CMDS {
+	for _, cmd := range env.allCmds() {
 		cmdbot := cmd.Cmd + env.BOT_NAME
 		if strings.HasPrefix(t, cmdbot) || strings.HasPrefix(t, cmd.Cmd) {
 			return cmd.Cmd
@@ -81,11 +172,19 @@ func (env *Env) StrCmd(text string) string {
 	return ""
 }
 
+//ritorna il comando da usare come label nelle metriche, "none" se il testo non è un comando
+func (env *Env) CmdLabel(text string) string {
+	if cmd := env.StrCmd(text); cmd != "" {
+		return cmd
+	}
+	return "none"
+}
+
 //ritorna la stringa dopo aver rimosso il comando o comando@nomebot
 func (env *Env) RemoveCmd(text string) string {
 	txt := strings.TrimLeft(text, " ")
 	t := strings.ToLower(txt)
-	for _, cmd := range env.BOT_CMDS {
+	for _, cmd := range env.allCmds() {
 		cmdbot := cmd.Cmd + env.BOT_NAME
 		switch {
 		case strings.HasPrefix(t, cmdbot):
@@ -102,11 +201,11 @@ func (env *Env) RemoveCmd(text string) string {
 }
 
 func (env *Env) NotifyTicket(loid, ts int64, chatuser *ChatUser, chatkey *ChatKey) error {
-	tmstring := GetTSString(ts)
+	tmstring := GetTSStringIn(ts, env.Db.GetChatLocation(chatkey.ChatID))
 	lottery := env.Db.GetLotteryByKey(loid)
 	log.Printf("%s \"%s\" %t->New Ticket for %s %s\n", lottery.LotteryName, chatuser.Name, chatuser.Notify, chatkey.KeyAlias, tmstring)
 	messaggio := fmt.Sprintf("Lottery %s\n*🎫 %s->%s", lottery.LotteryName, chatkey.KeyAlias, tmstring)
-	if err := env.SayText(chatkey.ChatID, messaggio); err != nil {
+	if err := env.DeliverNotify(chatkey.ChatID, EventLotteryTicket, messaggio); err != nil {
 		log.Println("error in sending reply:", err)
 	}
 	return nil
@@ -116,12 +215,13 @@ func (env *Env) StatusChanged(miningkey *MiningKey, oldstat string, oldprv int64
 	pubkey := miningkey.PubKey
 	newstat := miningkey.LastStatus
 	newprv := miningkey.LastPRV
-	log.Printf("Status Changed: %s %s %s %.9fPRV %.9fPRV", pubkey, oldstat, newstat, BIG_COINS.GetFloat64Val("PRV", newprv), BIG_COINS.GetFloat64Val("PRV", oldprv))
+	newAmount, oldAmount := PRVAmount(newprv), PRVAmount(oldprv)
+	log.Printf("Status Changed: %s %s %s %sPRV %sPRV", pubkey, oldstat, newstat, newAmount, oldAmount)
 	icons := []string{"🥳", "👍", "😇", "🤑", "🙌", "💰", "💶", "💵", "💸"}
 	i := rand.Intn(len(icons))
 
 	newst := strings.ToLower(strings.TrimLeft(newstat, " "))
-	if strings.HasPrefix(newst, "committe") && newprv >= oldprv { // this is a new round
+	if strings.HasPrefix(newst, "committe") && newAmount.Cmp(oldAmount) >= 0 { // this is a new round
 		var tm = time.Now()
 		ts := MakeTSFromTime(tm)
 		lotterykeys, err := env.Db.AddLotteryTickets(ts, pubkey)
@@ -133,26 +233,104 @@ func (env *Env) StatusChanged(miningkey *MiningKey, oldstat string, oldprv int64
 			log.Println("Status Changed: error NotifyAllLotteryUsersTicket:", err)
 		}
 	}
-	chatkeys, err := env.Db.GetChatKeysByPubKey(pubkey, 100, 0)
+	chatkeys, err := env.chatKeysByPubKey(pubkey)
 	if err != nil {
 		return err
 	}
-	for _, chatkey := range *chatkeys {
-		messaggio := fmt.Sprintf("\"%s\" %s -> %s%s %.9fPRV", chatkey.KeyAlias, oldstat, newstat, icons[i], BIG_COINS.GetFloat64Val("PRV", newprv))
-		if env.Db.GetNotify(chatkey.ChatID) {
-			log.Printf("Notify chat: %d %s", chatkey.ChatID, messaggio)
-			if err = env.SayText(chatkey.ChatID, messaggio); err != nil {
-				log.Println("error in sending reply:", err)
-			}
-		} else {
-			log.Printf("Notify off for chat: %d (%s)", chatkey.ChatID, messaggio)
+	event := StatusChangeEvent(oldstat, newstat, oldprv, newprv)
+	delta, _ := newAmount.Sub(oldAmount)
+	for _, chatkey := range chatkeys {
+		if !env.Db.WantsNotify(chatkey.ChatID, pubkey, event, delta.Units) {
+			continue
+		}
+		messaggio := fmt.Sprintf("\"%s\" %s -> %s%s %sPRV", chatkey.KeyAlias, oldstat, newstat, icons[i], newAmount)
+		if prices, fiat := env.ChatPrices(chatkey.ChatID, []string{"PRV"}); prices != nil {
+			price := prices["PRV"]
+			messaggio = fmt.Sprintf("%s ≈ %.2f %s (%+.2f %s)", messaggio, newAmount.Float64()*price, fiat, delta.Float64()*price, fiat)
+		}
+		if err = env.DeliverNotify(chatkey.ChatID, event, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
+	}
+	return err
+}
 
+//tutte le chat che seguono la chiave, lette a pagine di LIST_LIMIT
+func (env *Env) chatKeysByPubKey(pubkey string) ([]ChatKey, error) {
+	all := []ChatKey{}
+	for offset := 0; ; offset += env.LIST_LIMIT {
+		chatkeys, err := env.Db.GetChatKeysByPubKey(pubkey, env.LIST_LIMIT, offset)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *chatkeys...)
+		if len(*chatkeys) < env.LIST_LIMIT {
+			return all, nil
 		}
+	}
+}
 
+//notifica ai proprietari che la chiave ha perso l'autostake (o non è più in AutoStaking):
+//il validatore verrà tolto dallo stake alla fine del turno corrente
+func (env *Env) AutoStakeLost(miningkey *MiningKey, disappeared bool) error {
+	log.Printf("AutoStake Lost: %s %s disappeared: %t", miningkey.PubKey, miningkey.LastStatus, disappeared)
+	chatkeys, err := env.chatKeysByPubKey(miningkey.PubKey)
+	if err != nil {
+		return err
+	}
+	motivo := "ha l'autostake disattivato"
+	if disappeared {
+		motivo = "non è più nella lista AutoStaking"
+	}
+	for _, chatkey := range chatkeys {
+		if !env.Db.WantsNotify(chatkey.ChatID, miningkey.PubKey, EventAutoStakeOff, 0) {
+			continue
+		}
+		messaggio := fmt.Sprintf("⚠️ \"%s\" %s: il validatore verrà tolto dallo stake alla fine del turno corrente (%s).", chatkey.KeyAlias, motivo, miningkey.LastStatus)
+		if err = env.DeliverNotify(chatkey.ChatID, EventAutoStakeOff, messaggio); err != nil {
+			log.Println("error in sending reply:", err)
+		}
 	}
 	return err
 }
 
+const BroadcastInterval = 50 * time.Millisecond //tra due messaggi di un broadcast, sotto il limite di ~30 messaggi al secondo di telegram
+
+var ErrBroadcastStopped = errors.New("broadcast stopped")
+
+//Manda il testo a tutte le chat con le notifiche attive, un messaggio ogni BroadcastInterval, rispettando
+//ore di silenzio e riepiloghi delle chat. Si ferma con ErrBroadcastStopped se stop viene chiuso.
+//Ritorna a quante chat è stato mandato o messo in coda.
+func (env *Env) Broadcast(text string, stop <-chan struct{}) (int, error) {
+	sent := 0
+	ticker := time.NewTicker(BroadcastInterval)
+	defer ticker.Stop()
+	for offset := 0; ; offset += env.LIST_LIMIT {
+		chatusers, err := env.Db.GetUsersList(env.LIST_LIMIT, offset)
+		if err != nil {
+			return sent, err
+		}
+		for _, chatuser := range *chatusers {
+			if !chatuser.Notify {
+				continue
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return sent, ErrBroadcastStopped
+			}
+			if err := env.DeliverNotify(chatuser.ChatID, EventBroadcast, text); err != nil {
+				log.Println("Broadcast error:", chatuser.ChatID, err)
+				continue
+			}
+			sent++
+		}
+		if len(*chatusers) < env.LIST_LIMIT {
+			return sent, nil
+		}
+	}
+}
+
 func (env *Env) PrintBOT_CMDS() string {
 	text := "Prova questi comandi:"
 	for _, cmd := range env.BOT_CMDS {
@@ -161,3 +339,12 @@ func (env *Env) PrintBOT_CMDS() string {
 
 	return text
 }
+
+func (env *Env) PrintADMIN_CMDS() string {
+	text := "Comandi admin:"
+	for _, cmd := range env.ADMIN_CMDS {
+		text = fmt.Sprintf("%s\n%s\t%s", text, cmd.Cmd, cmd.Descr)
+	}
+
+	return text
+}
@@ -0,0 +1,221 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BeaconBlockTime       = 40 * time.Second //tempo medio di un blocco beacon
+	DefaultEpochBlocks    = 350              //blocchi beacon per epoch se il nodo non lo dice
+	SwapHistoryEpochs     = 20               //quanti record di shardswaps usare per il tasso di scambio
+	BeaconBestBlockKey    = "-1"             //chiave del beacon in getblockchaininfo BestBlocks
+	committeeKeySeparator = ","
+)
+
+// Stima dell'ingresso in committee di una chiave in waiting o pending
+type KeyETA struct {
+	Role            string
+	Shard           string
+	Position        int     //posizione nella coda (1 = prima)
+	QueueLen        int     //lunghezza della coda
+	SwapRate        float64 //chiavi che entrano in committee per epoch (nello shard o in media), 0 se non abbiamo storico
+	RemainingBlocks int     //blocchi alla fine dell'epoch corrente
+	Epochs          int     //epoch stimate prima di entrare in committee (compresa quella corrente)
+	ETA             time.Duration
+}
+
+//ritorna vero se abbiamo abbastanza storico per la stima
+func (ke *KeyETA) Known() bool {
+	return ke.SwapRate > 0
+}
+
+//descrizione breve per /status
+func (ke *KeyETA) Short() string {
+	if !ke.Known() {
+		return fmt.Sprintf("%d/%d", ke.Position, ke.QueueLen)
+	}
+	return fmt.Sprintf("%d/%d ETA ~%s", ke.Position, ke.QueueLen, FormatETA(ke.ETA))
+}
+
+//descrizione completa per /eta
+func (ke *KeyETA) String() string {
+	queue := "waiting"
+	if ke.Shard != "" {
+		queue = "pending shard " + ke.Shard
+	}
+	text := fmt.Sprintf("posizione %d di %d in %s, fine epoch tra %d blocchi", ke.Position, ke.QueueLen, queue, ke.RemainingBlocks)
+	if !ke.Known() {
+		return text + "\nETA non disponibile: manca lo storico degli ingressi in committee"
+	}
+	return fmt.Sprintf("%s\ningressi in committee ~%.1f per epoch, ~%d epoch\nETA ~%s", text, ke.SwapRate, ke.Epochs, FormatETA(ke.ETA))
+}
+
+//formatta una durata in giorni/ore/minuti
+func FormatETA(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	if days > 0 {
+		return fmt.Sprintf("%dd%dh", days, hours)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+//ritorna la posizione (1 = prima) della chiave nella lista e la lunghezza della lista, 0 se non c'è
+func keyPosition(pubkey string, arr []TPubKey) (int, int) {
+	for i, tpk := range arr {
+		if tpk.IncPubKey == pubkey {
+			return i + 1, len(arr)
+		}
+	}
+	return 0, len(arr)
+}
+
+//calcola le epoch necessarie per passare position chiavi in coda a rate chiavi per epoch
+func epochsFor(position int, rate float64) int {
+	return int(math.Ceil(float64(position) / rate))
+}
+
+//Stima quando una chiave in waiting o pending shard entrerà in committee. rates sono i tassi di ingresso
+//per shard (GetShardSwapRates), remaining ed epochBlocks vengono dal beacon in getblockchaininfo.
+//Ritorna nil se la chiave non è in una coda di shard.
+func ComputeKeyETA(bbsd *BBSD, pubkey string, rates map[string]float64, remaining, epochBlocks int) *KeyETA {
+	if epochBlocks <= 0 {
+		epochBlocks = DefaultEpochBlocks
+	}
+	role, shard := GetPubKeyRole(bbsd, pubkey)
+	ke := &KeyETA{Role: role, Shard: shard, RemainingBlocks: remaining}
+	blocks := 0
+	switch role {
+	case RolePending:
+		ke.Position, ke.QueueLen = keyPosition(pubkey, bbsd.Result.ShardPendingValidator[shard])
+		ke.SwapRate = rates[shard]
+		if !ke.Known() {
+			return ke
+		}
+		//entrano a fine epoch: la corrente più quelle necessarie alle chiavi davanti
+		ke.Epochs = epochsFor(ke.Position, ke.SwapRate)
+		blocks = remaining + (ke.Epochs-1)*epochBlocks
+	case RoleWaiting:
+		ke.Position, ke.QueueLen = keyPosition(pubkey, bbsd.Result.CandidateShardWaitingForNextRandom)
+		if ke.Position == 0 {
+			ke.Position, ke.QueueLen = keyPosition(pubkey, bbsd.Result.CandidateShardWaitingForCurrentRandom)
+		}
+		//non sappiamo in che shard finirà: usiamo la coda pending ed il tasso medi
+		pending, sum, n := 0, 0.0, 0
+		for s, arr := range bbsd.Result.ShardPendingValidator {
+			pending += len(arr)
+			if rates[s] > 0 {
+				sum += rates[s]
+				n++
+			}
+		}
+		if n == 0 {
+			return ke
+		}
+		ke.SwapRate = sum / float64(n)
+		shards := len(bbsd.Result.ShardPendingValidator)
+		if shards == 0 {
+			shards = 1
+		}
+		//un'epoch per l'assegnazione allo shard, poi la coda pending media
+		ke.Epochs = 1 + epochsFor(pending/shards+1, ke.SwapRate)
+		blocks = remaining + (ke.Epochs-1)*epochBlocks
+	default:
+		return nil
+	}
+	ke.ETA = time.Duration(blocks) * BeaconBlockTime
+	return ke
+}
+
+//Salva lo snapshot dei committee degli shard e, quando cambia epoch, quante chiavi sono entrate
+//in ciascun committee rispetto allo snapshot precedente (tabella shardswaps)
+func (db *DBnode) RecordCommittees(bbsd *BBSD) error {
+	epoch := int64(bbsd.Result.Epoch)
+	shards := make([]string, 0, len(bbsd.Result.ShardCommittee))
+	for shard := range bbsd.Result.ShardCommittee {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	for _, shard := range shards {
+		keys := []string{}
+		for _, tpk := range bbsd.Result.ShardCommittee[shard] {
+			keys = append(keys, tpk.IncPubKey)
+		}
+		var oldEpoch int64
+		var oldKeys string
+		err := db.DB.QueryRow("SELECT `Epoch`, `Keys` FROM `committeesnapshots` WHERE `Shard` = ?", shard).Scan(&oldEpoch, &oldKeys)
+		if err == nil && oldEpoch < epoch { //nuova epoch: contiamo chi è entrato
+			old := map[string]bool{}
+			for _, k := range strings.Split(oldKeys, committeeKeySeparator) {
+				old[k] = true
+			}
+			swapIn := 0
+			for _, k := range keys {
+				if !old[k] {
+					swapIn++
+				}
+			}
+			log.Printf("RecordCommittees: shard %s epoch %d->%d swap in %d\n", shard, oldEpoch, epoch, swapIn)
+			if _, err := db.DB.Exec("INSERT OR REPLACE INTO `shardswaps`(`Epoch`,`Shard`,`SwapIn`,`Epochs`) VALUES (?,?,?,?)", epoch, shard, swapIn, epoch-oldEpoch); err != nil {
+				dbError("RecordCommittees", err)
+				return err
+			}
+		} else if err != nil && err != sql.ErrNoRows { //ErrNoRows: primo snapshot dello shard
+			dbError("RecordCommittees", err)
+		}
+		if _, err := db.DB.Exec("INSERT OR REPLACE INTO `committeesnapshots`(`Shard`,`Epoch`,`Keys`) VALUES (?,?,?)", shard, epoch, strings.Join(keys, committeeKeySeparator)); err != nil {
+			dbError("RecordCommittees", err)
+			return err
+		}
+	}
+	return nil
+}
+
+//Ritorna per ogni shard quante chiavi sono entrate in committee in media per epoch nelle ultime SwapHistoryEpochs rilevazioni
+func (db *DBnode) GetShardSwapRates() (map[string]float64, error) {
+	rates := map[string]float64{}
+	rows, err := db.DB.Query("SELECT `Shard`, `SwapIn`, `Epochs` FROM `shardswaps` ORDER BY `Epoch` DESC")
+	if err != nil {
+		dbError("GetShardSwapRates", err)
+		return rates, err
+	}
+	defer rows.Close()
+	swaps := map[string]int64{}
+	epochs := map[string]int64{}
+	records := map[string]int{}
+	for rows.Next() {
+		var shard string
+		var swapIn, n int64
+		if err = rows.Scan(&shard, &swapIn, &n); err != nil {
+			dbError("GetShardSwapRates", err)
+			return rates, err
+		}
+		if records[shard] >= SwapHistoryEpochs || n <= 0 {
+			continue
+		}
+		records[shard]++
+		swaps[shard] += swapIn
+		epochs[shard] += n
+	}
+	if err = rows.Err(); err != nil {
+		dbError("GetShardSwapRates", err)
+		return rates, err
+	}
+	for shard, n := range epochs {
+		rates[shard] = float64(swaps[shard]) / float64(n)
+	}
+	return rates, nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeKeyETA(t *testing.T) {
+	bbsd := &BBSD{}
+	bbsd.Result.ShardPendingValidator = map[string][]TPubKey{
+		"0": {{IncPubKey: "a"}, {IncPubKey: "b"}, {IncPubKey: "c"}, {IncPubKey: "d"}, {IncPubKey: "e"}},
+		"1": {{IncPubKey: "f"}},
+	}
+	bbsd.Result.CandidateShardWaitingForNextRandom = []TPubKey{{IncPubKey: "w1"}, {IncPubKey: "w2"}}
+	rates := map[string]float64{"0": 2, "1": 2}
+
+	ke := ComputeKeyETA(bbsd, "e", rates, 100, 350)
+	if ke == nil || ke.Position != 5 || ke.QueueLen != 5 || ke.Epochs != 3 {
+		t.Fatalf("pending e: got %+v", ke)
+	}
+	if want := time.Duration(100+2*350) * BeaconBlockTime; ke.ETA != want {
+		t.Errorf("pending e: ETA %s, want %s", ke.ETA, want)
+	}
+
+	ke = ComputeKeyETA(bbsd, "w2", rates, 100, 350)
+	if ke == nil || ke.Position != 2 || ke.Epochs != 3 {
+		t.Errorf("waiting w2: got %+v", ke)
+	}
+
+	if ke = ComputeKeyETA(bbsd, "f", map[string]float64{}, 100, 350); ke == nil || ke.Known() {
+		t.Errorf("pending f without history: got %+v", ke)
+	}
+	if ke = ComputeKeyETA(bbsd, "missing", rates, 100, 350); ke != nil {
+		t.Errorf("missing key: got %+v", ke)
+	}
+}
+
+func TestRecordCommittees(t *testing.T) {
+	db, err := NewDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DB.Close()
+	db.DB.SetMaxOpenConns(1)
+	if err := db.CreateTablesIfNotExists(); err != nil {
+		t.Fatal(err)
+	}
+	bbsd := &BBSD{}
+	bbsd.Result.Epoch = 10
+	bbsd.Result.ShardCommittee = map[string][]TPubKey{"0": {{IncPubKey: "a"}, {IncPubKey: "b"}}}
+	if err := db.RecordCommittees(bbsd); err != nil { //nessuno snapshot precedente
+		t.Fatal(err)
+	}
+	if rates, err := db.GetShardSwapRates(); err != nil || len(rates) != 0 {
+		t.Errorf("rates %v %v, want none after the first snapshot", rates, err)
+	}
+	bbsd.Result.Epoch = 12
+	bbsd.Result.ShardCommittee = map[string][]TPubKey{"0": {{IncPubKey: "a"}, {IncPubKey: "c"}}}
+	if err := db.RecordCommittees(bbsd); err != nil {
+		t.Fatal(err)
+	}
+	if rates, err := db.GetShardSwapRates(); err != nil || rates["0"] != 0.5 {
+		t.Errorf("rates %v %v, want 0.5 for shard 0", rates, err)
+	}
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const ExporterNamespace = "incognito"
+
+// Stato di una chiave di mining da esportare
+type ValidatorState struct {
+	PubKey      string
+	Role        string
+	Shard       string
+	IsAutoStake bool
+	Rewards     TMinerReward //nil se non siamo riusciti a leggerli
+}
+
+// Collector prometheus con lo stato dei validatori e del beacon dell'ultimo ciclo di controllo.
+// I valori vengono sostituiti tutti insieme da Update, così uno scrape non vede mai un ciclo a metà.
+type ValidatorExporter struct {
+	mu         sync.Mutex
+	beacon     *TBeaconStateResult
+	validators []ValidatorState
+}
+
+var (
+	descValidatorRole = prometheus.NewDesc(ExporterNamespace+"_validator_role",
+		"Current role of the mining key (1 for the role and shard it is in).",
+		[]string{"pubkey", "role", "shard"}, nil)
+	descValidatorAutoStake = prometheus.NewDesc(ExporterNamespace+"_validator_autostake",
+		"1 if the mining key has autostake enabled.",
+		[]string{"pubkey"}, nil)
+	descValidatorReward = prometheus.NewDesc(ExporterNamespace+"_validator_unclaimed_reward",
+		"Unclaimed reward of the mining key, by coin.",
+		[]string{"pubkey", "coin"}, nil)
+	descBeaconHeight = prometheus.NewDesc(ExporterNamespace+"_beacon_height",
+		"Beacon chain height.", nil, nil)
+	descEpoch = prometheus.NewDesc(ExporterNamespace+"_epoch",
+		"Current epoch.", nil, nil)
+	descShardHeight = prometheus.NewDesc(ExporterNamespace+"_shard_height",
+		"Best height of each shard as seen by the beacon.",
+		[]string{"shard"}, nil)
+	descCommitteeSize = prometheus.NewDesc(ExporterNamespace+"_committee_size",
+		"Committee size, by shard (\"beacon\" for the beacon committee).",
+		[]string{"shard"}, nil)
+	descPendingSize = prometheus.NewDesc(ExporterNamespace+"_pending_validators",
+		"Pending validators, by shard (\"beacon\" for the beacon).",
+		[]string{"shard"}, nil)
+	descWaitingSize = prometheus.NewDesc(ExporterNamespace+"_waiting_candidates",
+		"Length of the candidate waiting queues.",
+		[]string{"queue"}, nil)
+	descAutoStaking = prometheus.NewDesc(ExporterNamespace+"_autostaking_keys",
+		"Keys in the AutoStaking list, by autostake flag.",
+		[]string{"autostake"}, nil)
+)
+
+func NewValidatorExporter() *ValidatorExporter {
+	return &ValidatorExporter{}
+}
+
+// Sostituisce lo stato esportato con quello dell'ultimo ciclo
+func (ve *ValidatorExporter) Update(beacon *TBeaconStateResult, validators []ValidatorState) {
+	ve.mu.Lock()
+	defer ve.mu.Unlock()
+	ve.beacon = beacon
+	ve.validators = validators
+}
+
+func (ve *ValidatorExporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descValidatorRole, descValidatorAutoStake, descValidatorReward,
+		descBeaconHeight, descEpoch, descShardHeight, descCommitteeSize, descPendingSize, descWaitingSize, descAutoStaking} {
+		ch <- d
+	}
+}
+
+func (ve *ValidatorExporter) Collect(ch chan<- prometheus.Metric) {
+	ve.mu.Lock()
+	defer ve.mu.Unlock()
+	gauge := func(desc *prometheus.Desc, val float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val, labels...)
+	}
+	boolVal := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	for _, v := range ve.validators {
+		gauge(descValidatorRole, 1, v.PubKey, v.Role, v.Shard)
+		gauge(descValidatorAutoStake, boolVal(v.IsAutoStake), v.PubKey)
+		for _, id := range v.Rewards.GetValueIDs() {
+			coin, val := v.Rewards.GetNameValuePair(id)
+			gauge(descValidatorReward, BIG_COINS.GetFloat64Val(coin, val), v.PubKey, coin)
+		}
+	}
+
+	b := ve.beacon
+	if b == nil {
+		return
+	}
+	gauge(descBeaconHeight, float64(b.BeaconHeight))
+	gauge(descEpoch, float64(b.Epoch))
+	for shard, height := range b.BestShardHeight {
+		gauge(descShardHeight, float64(height), shard)
+	}
+	gauge(descCommitteeSize, float64(len(b.BeaconCommittee)), "beacon")
+	for shard, committee := range b.ShardCommittee {
+		gauge(descCommitteeSize, float64(len(committee)), shard)
+	}
+	gauge(descPendingSize, float64(len(b.BeaconPendingValidator)), "beacon")
+	for shard, pending := range b.ShardPendingValidator {
+		gauge(descPendingSize, float64(len(pending)), shard)
+	}
+	gauge(descWaitingSize, float64(len(b.CandidateShardWaitingForNextRandom)), "shard_next_random")
+	gauge(descWaitingSize, float64(len(b.CandidateShardWaitingForCurrentRandom)), "shard_current_random")
+	gauge(descWaitingSize, float64(len(b.CandidateBeaconWaitingForNextRandom)), "beacon_next_random")
+	gauge(descWaitingSize, float64(len(b.CandidateBeaconWaitingForCurrentRandom)), "beacon_current_random")
+	autostaking := 0
+	for _, tpka := range b.AutoStaking {
+		if tpka.IsAutoStake {
+			autostaking++
+		}
+	}
+	gauge(descAutoStaking, float64(autostaking), "true")
+	gauge(descAutoStaking, float64(len(b.AutoStaking)-autostaking), "false")
+}
@@ -2,4 +2,9 @@ module github.com/robotrongt/incognito_node_bot/src/models
 
 go 1.15
 
-require github.com/mattn/go-sqlite3 v1.14.4
+require (
+	github.com/mattn/go-sqlite3 v1.14.4
+	github.com/prometheus/client_golang v1.9.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	gopkg.in/yaml.v2 v2.4.0
+)
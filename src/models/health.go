@@ -0,0 +1,44 @@
+package models
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const ReadyRPCMaxAge = 5 * time.Minute //oltre questo tempo dall'ultima RPC riuscita /readyz interroga il nodo
+
+var lastRPCSuccess int64 //unix nano dell'ultima chiamata RPC riuscita
+
+func markRPCSuccess() {
+	atomic.StoreInt64(&lastRPCSuccess, time.Now().UnixNano())
+}
+
+//ritorna quando è riuscita l'ultima chiamata RPC ai nodi, zero se mai
+func LastRPCSuccess() time.Time {
+	ns := atomic.LoadInt64(&lastRPCSuccess)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+//Controlla che il DB risponda e che ci sia stata una RPC riuscita di recente,
+//altrimenti interroga i nodi. Ritorna nil se il processo è pronto.
+func (env *Env) CheckReady() error {
+	if err := env.Db.DB.Ping(); err != nil {
+		return fmt.Errorf("db: %v", err)
+	}
+	if time.Since(LastRPCSuccess()) <= ReadyRPCMaxAge {
+		return nil
+	}
+	bci := BCI{}
+	if err := env.GetBlockChainInfo(nil, &bci); err != nil {
+		last := "never"
+		if !LastRPCSuccess().IsZero() {
+			last = LastRPCSuccess().Format(time.RFC3339)
+		}
+		return fmt.Errorf("rpc: %v (last success: %s)", err, last)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const MetricsNamespace = "incbot"
+
+var (
+	// updates ricevuti da telegram per comando
+	UpdatesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "updates_processed_total",
+		Help:      "Telegram updates processed, by command.",
+	}, []string{"command"})
+	UpdatesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "updates_rejected_total",
+		Help:      "Telegram updates not processed, by reason (secret, duplicate, queue_full, shutting_down, bad_request).",
+	}, []string{"reason"})
+	UpdateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "update_duration_seconds",
+		Help:      "Time spent processing a Telegram update, by command.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"command"})
+
+	// chiamate alle API di telegram
+	TelegramRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "telegram_request_duration_seconds",
+		Help:      "Latency of Telegram Bot API calls, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	TelegramRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "telegram_request_errors_total",
+		Help:      "Failed Telegram Bot API calls, by method.",
+	}, []string{"method"})
+
+	// chiamate RPC ai nodi incognito
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of Incognito RPC calls, by method and node.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "node"})
+	RPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed Incognito RPC calls, by method and node.",
+	}, []string{"method", "node"})
+
+	RPCFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "rpc_failovers_total",
+		Help:      "Incognito RPC calls retried on another endpoint, by endpoint role.",
+	}, []string{"role"})
+	EndpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "endpoint_up",
+		Help:      "1 if the Incognito endpoint is considered healthy, by role and endpoint.",
+	}, []string{"role", "endpoint"})
+
+	// errori nelle query al db
+	DBErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "db_errors_total",
+		Help:      "Database errors, by operation.",
+	}, []string{"op"})
+
+	// cicli di controllo delle chiavi di mining
+	CheckCycles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "check_cycles_total",
+		Help:      "Mining key check cycles, by outcome.",
+	}, []string{"outcome"})
+	CheckCycleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "check_cycle_duration_seconds",
+		Help:      "Duration of mining key check cycles, by outcome.",
+		Buckets:   []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"outcome"})
+)
+
+// esiti possibili di un ciclo di controllo
+const (
+	CheckOutcomeOK       = "ok"
+	CheckOutcomeRPCError = "rpc_error"
+	CheckOutcomeDBError  = "db_error"
+)
+
+func init() {
+	prometheus.MustRegister(
+		UpdatesProcessed,
+		UpdatesRejected,
+		UpdateDuration,
+		TelegramRequestDuration,
+		TelegramRequestErrors,
+		RPCDuration,
+		RPCErrors,
+		RPCFailovers,
+		EndpointUp,
+		DBErrors,
+		CheckCycles,
+		CheckCycleDuration,
+	)
+}
+
+const userNodeLabel = "user" //label dei nodi aggiunti dalle chat con /addnode
+
+var (
+	nodeHostsMutex sync.RWMutex
+	nodeHosts      = map[string]bool{} //host degli endpoint configurati, gli unici con la loro label
+)
+
+//registra l'host di un endpoint configurato come label delle metriche RPC
+func registerNodeLabel(rawurl string) {
+	if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+		nodeHostsMutex.Lock()
+		nodeHosts[u.Host] = true
+		nodeHostsMutex.Unlock()
+	}
+}
+
+//ritorna l'host del nodo da usare come label, mai l'url completo: solo per gli endpoint configurati,
+//gli altri nodi hanno tutti userNodeLabel così le label non crescono con i nodi delle chat
+func nodeLabel(u *url.URL) string {
+	if u == nil || u.Host == "" {
+		return "unknown"
+	}
+	nodeHostsMutex.RLock()
+	defer nodeHostsMutex.RUnlock()
+	if nodeHosts[u.Host] {
+		return u.Host
+	}
+	return userNodeLabel
+}
+
+//logga l'errore di una funzione del db e lo conta nelle metriche (esclusi i record non trovati)
+func dbError(op string, err error) {
+	log.Println(op+" error:", err)
+	if err != sql.ErrNoRows {
+		DBErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// Registra l'esito di un ciclo di controllo nelle metriche
+func ObserveCheckCycle(start time.Time, outcome string) {
+	CheckCycles.WithLabelValues(outcome).Inc()
+	CheckCycleDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
+// Espone le gauge dell'ultimo ciclo di controllo salvato nel db dal checker
+func (db *DBnode) RegisterCheckCycleMetrics() {
+	last := func(f func(cc *CheckCycle) float64) func() float64 {
+		return func() float64 {
+			cc, err := db.GetLastCheckCycle()
+			if err != nil {
+				return 0
+			}
+			return f(cc)
+		}
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_cycle_last_timestamp_seconds",
+			Help:      "Start time of the last mining key check cycle.",
+		}, last(func(cc *CheckCycle) float64 { return float64(cc.Timestamp) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_cycle_last_duration_seconds",
+			Help:      "Duration of the last mining key check cycle.",
+		}, last(func(cc *CheckCycle) float64 { return cc.Duration })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_cycle_last_keys",
+			Help:      "Mining keys checked in the last check cycle.",
+		}, last(func(cc *CheckCycle) float64 { return float64(cc.Keys) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_cycle_last_changed_keys",
+			Help:      "Mining keys whose status or rewards changed in the last check cycle.",
+		}, last(func(cc *CheckCycle) float64 { return float64(cc.Changed) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_cycle_last_failed_keys",
+			Help:      "Mining keys not updated or without rewards in the last check cycle.",
+		}, last(func(cc *CheckCycle) float64 { return float64(cc.Failed) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "check_cycle_last_success",
+			Help:      "1 if the last mining key check cycle completed without errors.",
+		}, last(func(cc *CheckCycle) float64 {
+			if cc.Outcome == CheckOutcomeOK {
+				return 1
+			}
+			return 0
+		})),
+	)
+}
+
+// Avvia in background il server http non TLS che espone /metrics su addr
+func ServeMetrics(addr string) {
+	if addr == "" {
+		log.Println("ServeMetrics: no address, metrics disabled")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Println("ServeMetrics listening on", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("ServeMetrics error:", err)
+		}
+	}()
+}
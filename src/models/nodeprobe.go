@@ -0,0 +1,206 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var ErrNotIncognitoNode = errors.New("the url does not answer like an Incognito node")
+
+const NodeDownChecks = 2 //controlli consecutivi falliti prima di notificare che un nodo è giù
+
+// Dati di un nodo letti con ProbeNode
+type NodeInfo struct {
+	ChainName    string //mainnet, testnet, ...
+	ActiveShards int
+	Version      string //vuota se il nodo non la espone
+	BeaconHeight int64
+	BeaconLag    int64 //blocchi beacon dietro il fullnode di riferimento, -1 se non confrontato
+}
+
+type NI struct {
+	Id      int
+	Result  struct{ Version interface{} }
+	Error   interface{}
+	Params  []string
+	Method  string
+	Jsonrpc string
+}
+
+//Ritorna la versione del nodo da getnetworkinfo
+func (node RPCNode) GetNodeVersion() (string, error) {
+	myClient := &http.Client{Timeout: RPCTimeout}
+	req, err := node.newRequest("getnetworkinfo", "[]")
+	if err != nil {
+		return "", err
+	}
+
+	ni := NI{}
+	if err = getJson(myClient, req, "getnetworkinfo", &ni); err != nil {
+		return "", err
+	}
+	if ni.Result.Version == nil {
+		return "", nil
+	}
+	return fmt.Sprint(ni.Result.Version), nil
+}
+
+//Interroga il nodo con getblockchaininfo e ritorna i suoi dati (BeaconLag -1),
+//ErrNotIncognitoNode se risponde ma non come un nodo Incognito
+func (node RPCNode) Probe() (*NodeInfo, error) {
+	u, err := url.Parse(node.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a http(s) url", RedactURL(node.URL))
+	}
+	bci := BCI{}
+	if err := node.GetBlockChainInfo(&bci); err != nil {
+		if _, ok := err.(*url.Error); ok || errors.Is(err, ErrRPCUnauthorized) { //il nodo non risponde o vuole credenziali
+			return nil, err
+		}
+		return nil, ErrNotIncognitoNode //risponde ma non con il json di un nodo
+	}
+	beacon, ok := bci.Result.BestBlocks[BeaconBestBlockKey]
+	if bci.Result.ChainName == "" || !ok || beacon.Height <= 0 {
+		return nil, ErrNotIncognitoNode
+	}
+	ni := &NodeInfo{
+		ChainName:    bci.Result.ChainName,
+		ActiveShards: bci.Result.ActiveShards,
+		BeaconHeight: beacon.Height,
+		BeaconLag:    -1,
+	}
+	ni.Version, _ = node.GetNodeVersion() //non tutti i nodi la espongono
+	return ni, nil
+}
+
+//Come RPCNode.Probe, confrontando in più l'altezza del beacon con quella dei fullnode del bot
+//(solo se sono sulla stessa chain)
+func (env *Env) ProbeNode(node RPCNode) (*NodeInfo, error) {
+	ni, err := node.Probe()
+	if err != nil {
+		return nil, err
+	}
+	ni.compare(env.referenceBCI())
+	return ni, nil
+}
+
+//blockchain info dai fullnode del bot, nil se non risponde nessuno
+func (env *Env) referenceBCI() *BCI {
+	ref := BCI{}
+	err := env.FullnodePool.Do(func(reqUrl string) error {
+		ref = BCI{}
+		return GetBlockChainInfo(reqUrl, &ref)
+	})
+	if err != nil {
+		return nil
+	}
+	return &ref
+}
+
+//calcola BeaconLag rispetto a ref se è sulla stessa chain
+func (ni *NodeInfo) compare(ref *BCI) {
+	if ref == nil || ref.Result.ChainName != ni.ChainName {
+		return
+	}
+	if refHeight := ref.Result.BestBlocks[BeaconBestBlockKey].Height; refHeight > 0 {
+		ni.BeaconLag = refHeight - ni.BeaconHeight
+	}
+}
+
+//vero se il nodo era indietro rispetto al fullnode di riferimento di più di EndpointMaxBeaconLag blocchi
+func (ni *NodeInfo) Behind() bool {
+	return ni.BeaconLag > EndpointMaxBeaconLag
+}
+
+//Aggiorna i controlli consecutivi falliti del nodo con l'esito dell'ultimo (up vero se risponde ed è in sync)
+//e ritorna se notificare che è giù (al NodeDownChecks-esimo fallito) o che è tornato a posto
+func nodeCheckTransition(downChecks int, up bool) (newDownChecks int, notifyDown, notifyUp bool) {
+	if up {
+		return 0, false, downChecks >= NodeDownChecks
+	}
+	return downChecks + 1, downChecks+1 == NodeDownChecks, false
+}
+
+//Controlla i nodi di tutte le chat, CHECK_WORKERS alla volta, notificando EventNodeDown alla chat quando un nodo
+//non risponde o è indietro di più di EndpointMaxBeaconLag blocchi per NodeDownChecks controlli di fila,
+//e quando torna a posto. Ritorna i nodi controllati e quelli giù.
+func (env *Env) CheckUrlNodes() (checked, down int) {
+	ref := env.referenceBCI()
+	var mutex sync.Mutex
+	var after int64
+	for {
+		page, err := env.Db.GetUrlNodesAfter(after, env.CHECK_KEYS_LIMIT)
+		if err != nil {
+			log.Println("CheckUrlNodes error:", err)
+			return
+		}
+		jobs := make(chan *UrlNode)
+		var wg sync.WaitGroup
+		for w := 0; w < env.CHECK_WORKERS && w < len(page); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for urlnode := range jobs {
+					if env.checkUrlNode(urlnode, ref) {
+						mutex.Lock()
+						down++
+						mutex.Unlock()
+					}
+				}
+			}()
+		}
+		for i := range page {
+			jobs <- &page[i]
+		}
+		close(jobs)
+		wg.Wait()
+		checked += len(page)
+		if len(page) < env.CHECK_KEYS_LIMIT {
+			return
+		}
+		after = page[len(page)-1].UNId
+	}
+}
+
+//controlla un nodo e ritorna vero se è giù o fermo
+func (env *Env) checkUrlNode(urlnode *UrlNode, ref *BCI) bool {
+	node, err := env.RPCNode(urlnode)
+	if err != nil { //credenziali non leggibili: il nodo non è giù, non possiamo controllarlo
+		log.Println("checkUrlNode error:", urlnode.UNId, err)
+		return false
+	}
+	problem := ""
+	ni, err := node.Probe()
+	if err != nil {
+		problem = "non risponde"
+	} else {
+		ni.compare(ref)
+		if ni.Behind() {
+			problem = fmt.Sprintf("è fermo, %d blocchi beacon dietro il fullnode di riferimento", ni.BeaconLag)
+		}
+		urlnode.Info, urlnode.ProbeTS = ni, MakeTSFromTime(time.Now())
+	}
+	var notifyDown, notifyUp bool
+	urlnode.DownChecks, notifyDown, notifyUp = nodeCheckTransition(urlnode.DownChecks, problem == "")
+	env.Db.UpdateUrlNodeCheck(urlnode)
+	messaggio := ""
+	switch {
+	case notifyDown:
+		log.Printf("checkUrlNode: node %d %s %s: %v", urlnode.UNId, RedactURL(urlnode.NodeURL), problem, err)
+		messaggio = fmt.Sprintf("🔴 Il nodo \"%s\" %s.", urlnode.NodeName, problem)
+	case notifyUp:
+		log.Printf("checkUrlNode: node %d %s is up again", urlnode.UNId, RedactURL(urlnode.NodeURL))
+		messaggio = fmt.Sprintf("🟢 Il nodo \"%s\" è di nuovo a posto.", urlnode.NodeName)
+	}
+	if messaggio != "" && env.Db.WantsNotify(urlnode.ChatID, "", EventNodeDown, 0) {
+		if err := env.DeliverNotify(urlnode.ChatID, EventNodeDown, messaggio); err != nil {
+			log.Println("checkUrlNode error in sending:", err)
+		}
+	}
+	return problem != ""
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbeNode(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct{ Method string }{}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "getblockchaininfo":
+			json.NewEncoder(w).Encode(map[string]interface{}{"Result": map[string]interface{}{
+				"ChainName":    "testnet",
+				"ActiveShards": 8,
+				"BestBlocks":   map[string]interface{}{BeaconBestBlockKey: map[string]int64{"Height": 123456}},
+			}})
+		case "getnetworkinfo":
+			json.NewEncoder(w).Encode(map[string]interface{}{"Result": map[string]interface{}{"version": "1.2.3"}})
+		}
+	}))
+	defer node.Close()
+	ni, err := (RPCNode{URL: node.URL}).Probe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ni.ChainName != "testnet" || ni.ActiveShards != 8 || ni.Version != "1.2.3" || ni.BeaconHeight != 123456 || ni.BeaconLag != -1 {
+		t.Errorf("unexpected info %+v", ni)
+	}
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<html><body>hello</body></html>")
+	}))
+	defer web.Close()
+	if _, err := (RPCNode{URL: web.URL}).Probe(); err != ErrNotIncognitoNode {
+		t.Errorf("web page: got %v", err)
+	}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"jsonrpc":"2.0","result":"0x1"}`)
+	}))
+	defer other.Close()
+	if _, err := (RPCNode{URL: other.URL}).Probe(); err != ErrNotIncognitoNode {
+		t.Errorf("other json rpc: got %v", err)
+	}
+	web.Close()
+	if _, err := (RPCNode{URL: web.URL}).Probe(); err == nil || err == ErrNotIncognitoNode {
+		t.Errorf("closed server: got %v", err)
+	}
+	if _, err := (RPCNode{URL: "127.0.0.1:9334"}).Probe(); err == nil {
+		t.Errorf("url without scheme accepted")
+	}
+}
+
+func TestNodeCheckTransition(t *testing.T) {
+	downChecks := 0
+	notified := 0
+	for i := 0; i < 4; i++ { //giù per più controlli: una sola notifica, al NodeDownChecks-esimo
+		var notifyDown, notifyUp bool
+		downChecks, notifyDown, notifyUp = nodeCheckTransition(downChecks, false)
+		if notifyDown {
+			notified++
+			if downChecks != NodeDownChecks {
+				t.Errorf("down notified after %d checks", downChecks)
+			}
+		}
+		if notifyUp {
+			t.Errorf("up notified while down")
+		}
+	}
+	if notified != 1 {
+		t.Errorf("down notified %d times", notified)
+	}
+	downChecks, notifyDown, notifyUp := nodeCheckTransition(downChecks, true)
+	if downChecks != 0 || notifyDown || !notifyUp {
+		t.Errorf("recovery: %d %t %t", downChecks, notifyDown, notifyUp)
+	}
+	if _, _, notifyUp := nodeCheckTransition(NodeDownChecks-1, true); notifyUp {
+		t.Errorf("up notified for a node never reported down")
+	}
+}
+
+func TestGetBeaconBestStateDetailRejectsEmpty(t *testing.T) {
+	for _, reply := range []string{
+		`{"Result":null,"Error":"-1: node is syncing"}`,
+		`{"Result":{}}`,
+		`{"Result":{"BeaconHeight":100,"AutoStaking":[]}}`,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, reply)
+		}))
+		bbsd := BBSD{}
+		if err := (RPCNode{URL: srv.URL}).GetBeaconBestStateDetail(&bbsd); err == nil {
+			t.Errorf("%s: accepted", reply)
+		}
+		srv.Close()
+	}
+}
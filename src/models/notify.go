@@ -0,0 +1,172 @@
+package models
+
+import (
+	"log"
+	"strings"
+)
+
+// Tipo di evento per cui una chat può scegliere se ricevere notifiche
+type NotifyEvent string
+
+const (
+	EventCommitteeIn   NotifyEvent = "committee_in"   //la chiave entra in committee
+	EventCommitteeOut  NotifyEvent = "committee_out"  //la chiave esce dal committee
+	EventPending       NotifyEvent = "pending"        //la chiave passa in pending
+	EventWaiting       NotifyEvent = "waiting"        //la chiave passa in waiting
+	EventMissing       NotifyEvent = "missing"        //la chiave non è più nel beacon state
+	EventAutoStakeOff  NotifyEvent = "autostake_off"  //la chiave perde l'autostake
+	EventReward        NotifyEvent = "reward"         //cambia il reward della chiave (sopra la soglia)
+	EventLotteryTicket NotifyEvent = "lottery_ticket" //nuovo biglietto della lotteria
+	EventLotteryDraw   NotifyEvent = "lottery_draw"   //estrazione della lotteria
+	EventNodeDown      NotifyEvent = "node_down"      //un nodo della chat non risponde o è fermo, e quando torna a posto
+	EventBroadcast     NotifyEvent = "broadcast"      //messaggio degli admin a tutte le chat, non configurabile in /settings
+)
+
+// Descrizione degli eventi nell'ordine in cui li mostriamo in /settings
+var NOTIFY_EVENTS = []struct {
+	Event NotifyEvent
+	Descr string
+}{
+	{EventCommitteeIn, "key enters committee"},
+	{EventCommitteeOut, "key leaves committee"},
+	{EventPending, "key becomes pending"},
+	{EventWaiting, "key becomes waiting"},
+	{EventMissing, "key is missing"},
+	{EventAutoStakeOff, "key loses autostake"},
+	{EventReward, "reward change above threshold"},
+	{EventLotteryTicket, "new lottery ticket"},
+	{EventLotteryDraw, "lottery draw"},
+	{EventNodeDown, "node is down or stalled"},
+}
+
+//ritorna l'evento corrispondente al nome (case insensitive) e se esiste
+func ParseNotifyEvent(name string) (NotifyEvent, bool) {
+	for _, ev := range NOTIFY_EVENTS {
+		if strings.EqualFold(string(ev.Event), name) {
+			return ev.Event, true
+		}
+	}
+	return "", false
+}
+
+// Preferenza di notifica di una chat per un evento: PubKey vuota vale per tutte le chiavi della chat,
+// altrimenti per la sola chiave e vince su quella generale
+type NotifyPref struct {
+	ChatID    int64
+	PubKey    string
+	Event     NotifyEvent
+	Enabled   bool
+	Threshold int64 //solo per EventReward: variazione minima in nano PRV
+}
+
+//ritorna il ruolo (Role*) contenuto in uno status salvato in miningkeys.LastStatus
+func StatusRole(status string) string {
+	status = strings.TrimLeft(status, " ")
+	//i ruoli beacon prima, contengono quelli shard come suffisso ma non come prefisso
+	for _, role := range []string{RoleBeaconCommittee, RoleBeaconPending, RoleBeaconWaiting, RoleCommittee, RolePending, RoleWaiting} {
+		if strings.HasPrefix(strings.ToLower(status), strings.ToLower(role)) {
+			return role
+		}
+	}
+	return RoleMissing
+}
+
+func isCommitteeRole(role string) bool {
+	return role == RoleCommittee || role == RoleBeaconCommittee
+}
+
+//classifica il cambio di stato di una chiave nell'evento da notificare
+func StatusChangeEvent(oldstat, newstat string, oldprv, newprv int64) NotifyEvent {
+	if oldstat == newstat {
+		return EventReward
+	}
+	oldrole, newrole := StatusRole(oldstat), StatusRole(newstat)
+	switch {
+	case newrole == RoleMissing:
+		return EventMissing
+	case oldrole == newrole && strings.HasSuffix(oldstat, "👆") && strings.HasSuffix(newstat, "👇"):
+		return EventAutoStakeOff
+	case isCommitteeRole(newrole) && !isCommitteeRole(oldrole):
+		return EventCommitteeIn
+	case isCommitteeRole(oldrole) && !isCommitteeRole(newrole):
+		return EventCommitteeOut
+	case oldrole == newrole && PRVAmount(oldprv).Cmp(PRVAmount(newprv)) != 0: //stesso ruolo (es. cambia shard), conta il reward
+		return EventReward
+	case isCommitteeRole(newrole):
+		return EventCommitteeIn
+	case newrole == RolePending || newrole == RoleBeaconPending:
+		return EventPending
+	default:
+		return EventWaiting
+	}
+}
+
+//Torna se la chat vuole la notifica dell'evento per la chiave pubkey (vuota per eventi non legati a una chiave).
+//amount è la variazione in nano PRV, usata solo per EventReward. Con /notify off non notifichiamo nulla.
+func (db *DBnode) WantsNotify(chatID int64, pubkey string, event NotifyEvent, amount int64) bool {
+	if !db.GetNotify(chatID) {
+		log.Printf("WantsNotify: notify off for chat %d\n", chatID)
+		return false
+	}
+	var enabled bool
+	var threshold int64
+	err := db.DB.QueryRow("SELECT `Enabled`, `Threshold` FROM `notifyprefs` WHERE `ChatID` = ? AND `Event` = ? AND `PubKey` IN (?, '') ORDER BY `PubKey` DESC LIMIT 1", chatID, string(event), pubkey).Scan(&enabled, &threshold)
+	if err != nil { //nessuna preferenza (o errore): notifichiamo
+		dbError("WantsNotify", err)
+		return true
+	}
+	if !enabled {
+		log.Printf("WantsNotify: %s off for chat %d key %s\n", event, chatID, pubkey)
+		return false
+	}
+	if event == EventReward {
+		return PRVAmount(amount).Abs().Cmp(PRVAmount(threshold)) >= 0
+	}
+	return true
+}
+
+//Recupera le preferenze di notifica della chat, prima quelle generali
+func (db *DBnode) GetNotifyPrefs(chatID int64) (*[]NotifyPref, error) {
+	prefs := []NotifyPref{}
+	rows, err := db.DB.Query("SELECT `PubKey`, `Event`, `Enabled`, `Threshold` FROM `notifyprefs` WHERE `ChatID` = ? ORDER BY `PubKey`, `Event`", chatID)
+	if err != nil {
+		dbError("GetNotifyPrefs", err)
+		return &prefs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pref := NotifyPref{ChatID: chatID}
+		var event string
+		if err = rows.Scan(&pref.PubKey, &event, &pref.Enabled, &pref.Threshold); err != nil {
+			dbError("GetNotifyPrefs", err)
+			return &prefs, err
+		}
+		pref.Event = NotifyEvent(event)
+		prefs = append(prefs, pref)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbError("GetNotifyPrefs", err)
+	}
+	return &prefs, err
+}
+
+//Salva (crea o sostituisce) una preferenza di notifica
+func (db *DBnode) SetNotifyPref(pref *NotifyPref) error {
+	log.Printf("SetNotifyPref: %+v\n", pref)
+	_, err := db.DB.Exec("INSERT OR REPLACE INTO `notifyprefs`(`ChatID`,`PubKey`,`Event`,`Enabled`,`Threshold`) VALUES (?,?,?,?,?)", pref.ChatID, pref.PubKey, string(pref.Event), pref.Enabled, pref.Threshold)
+	if err != nil {
+		dbError("SetNotifyPref", err)
+	}
+	return err
+}
+
+//Elimina le preferenze di notifica della chat per pubkey (vuota per quelle generali)
+func (db *DBnode) DelNotifyPrefs(chatID int64, pubkey string) error {
+	log.Println("DelNotifyPrefs:", chatID, pubkey)
+	_, err := db.DB.Exec("DELETE FROM `notifyprefs` WHERE `ChatID` = ? AND `PubKey` = ?", chatID, pubkey)
+	if err != nil {
+		dbError("DelNotifyPrefs", err)
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestStatusChangeEvent(t *testing.T) {
+	tests := []struct {
+		oldstat, newstat string
+		oldprv, newprv   int64
+		want             NotifyEvent
+	}{
+		{"Committee shard 1👆", "Committee shard 1👆", 10, 20, EventReward},
+		{"Pending shard 1👆", "Committee shard 1👆", 10, 10, EventCommitteeIn},
+		{"Committee shard 1👆", "Waiting👆", 10, 20, EventCommitteeOut},
+		{"Waiting👆", "Pending shard 3👆", 0, 0, EventPending},
+		{"missing", "Waiting👆", 0, 0, EventWaiting},
+		{"Committee shard 1👆", "missing", 10, 10, EventMissing},
+		{"Committee shard 1👆", "Committee shard 1👇", 10, 10, EventAutoStakeOff},
+		{"Committee shard 1👆", "Committee shard 2👆", 10, 20, EventReward},
+		{"BeaconPending👆", "BeaconCommittee👆", 0, 0, EventCommitteeIn},
+	}
+	for _, tt := range tests {
+		if got := StatusChangeEvent(tt.oldstat, tt.newstat, tt.oldprv, tt.newprv); got != tt.want {
+			t.Errorf("%q -> %q: got %s, want %s", tt.oldstat, tt.newstat, got, tt.want)
+		}
+	}
+}
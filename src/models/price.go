@@ -0,0 +1,189 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultFiat = "USD"            //valuta usata se la chat non ne ha scelta una
+	FiatOff     = "off"            //la chat non vuole i valori in valuta
+	PriceTTL    = 10 * time.Minute //dopo quanto un prezzo in cache va aggiornato
+)
+
+// Sorgente dei prezzi delle monete in valuta
+type PriceProvider interface {
+	//ritorna il prezzo in fiat di ciascun simbolo che conosce
+	GetPrices(symbols []string, fiat string) (map[string]float64, error)
+}
+
+// PriceProvider via HTTP: GET URL?symbols=PRV,BTC&fiat=USD che risponde {"PRV": 0.5, "BTC": 30000}
+type HTTPPriceProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPPriceProvider(priceURL string) *HTTPPriceProvider {
+	return &HTTPPriceProvider{URL: priceURL, Client: &http.Client{Timeout: RPCTimeout}}
+}
+
+func (hp *HTTPPriceProvider) GetPrices(symbols []string, fiat string) (map[string]float64, error) {
+	query := url.Values{}
+	query.Set("symbols", strings.Join(symbols, ","))
+	query.Set("fiat", fiat)
+	sep := "?"
+	if strings.Contains(hp.URL, "?") {
+		sep = "&"
+	}
+	resp, err := hp.Client.Get(hp.URL + sep + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("price provider: %s", resp.Status)
+	}
+	prices := map[string]float64{}
+	if err := json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+// Prezzi con cache nel DB (tabella prices) davanti ad un PriceProvider
+type PriceCache struct {
+	Db       *DBnode
+	Provider PriceProvider
+	TTL      time.Duration
+}
+
+func NewPriceCache(db *DBnode, provider PriceProvider) *PriceCache {
+	return &PriceCache{Db: db, Provider: provider, TTL: PriceTTL}
+}
+
+//Ritorna i prezzi in fiat dei simboli: quelli in cache se recenti, gli altri dal provider.
+//Se il provider non risponde usa quelli in cache anche se vecchi.
+func (pc *PriceCache) GetPrices(symbols []string, fiat string) (map[string]float64, error) {
+	fiat = strings.ToUpper(fiat)
+	cached, err := pc.Db.GetCachedPrices(fiat)
+	if err != nil {
+		cached = map[string]CachedPrice{}
+	}
+	now := time.Now()
+	prices := map[string]float64{}
+	missing := []string{}
+	for _, symbol := range symbols {
+		if cp, ok := cached[symbol]; ok && now.Sub(GetTSTime(cp.Timestamp)) < pc.TTL {
+			prices[symbol] = cp.Price
+		} else {
+			missing = append(missing, symbol)
+		}
+	}
+	if len(missing) == 0 {
+		return prices, nil
+	}
+	fresh, err := pc.Provider.GetPrices(missing, fiat)
+	if err != nil {
+		log.Println("GetPrices error:", err)
+		for _, symbol := range missing {
+			if cp, ok := cached[symbol]; ok {
+				prices[symbol] = cp.Price
+			}
+		}
+		return prices, err
+	}
+	ts := MakeTSFromTime(now)
+	for _, symbol := range missing {
+		price, ok := fresh[symbol]
+		if !ok {
+			continue
+		}
+		prices[symbol] = price
+		pc.Db.SetCachedPrice(symbol, fiat, price, ts)
+	}
+	return prices, nil
+}
+
+// Prezzo salvato nella tabella prices
+type CachedPrice struct {
+	Price     float64
+	Timestamp int64
+}
+
+//Recupera i prezzi in cache per la valuta fiat
+func (db *DBnode) GetCachedPrices(fiat string) (map[string]CachedPrice, error) {
+	prices := map[string]CachedPrice{}
+	rows, err := db.DB.Query("SELECT `Symbol`, `Price`, `Timestamp` FROM `prices` WHERE `Fiat` = ?", fiat)
+	if err != nil {
+		dbError("GetCachedPrices", err)
+		return prices, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var symbol string
+		cp := CachedPrice{}
+		if err = rows.Scan(&symbol, &cp.Price, &cp.Timestamp); err != nil {
+			dbError("GetCachedPrices", err)
+			return prices, err
+		}
+		prices[symbol] = cp
+	}
+	err = rows.Err()
+	if err != nil {
+		dbError("GetCachedPrices", err)
+	}
+	return prices, err
+}
+
+//Salva in cache il prezzo del simbolo nella valuta fiat
+func (db *DBnode) SetCachedPrice(symbol, fiat string, price float64, ts int64) error {
+	_, err := db.DB.Exec("INSERT OR REPLACE INTO `prices`(`Symbol`,`Fiat`,`Price`,`Timestamp`) VALUES (?,?,?,?)", symbol, fiat, price, ts)
+	if err != nil {
+		dbError("SetCachedPrice", err)
+	}
+	return err
+}
+
+//Torna la valuta scelta dalla chat, DefaultFiat se non impostata, FiatOff se non la vuole
+func (db *DBnode) GetChatFiat(chatID int64) string {
+	fiat := ""
+	if err := db.DB.QueryRow("SELECT `Fiat` FROM `chatdata` WHERE `ChatID` = ?", chatID).Scan(&fiat); err != nil {
+		dbError("GetChatFiat", err)
+	}
+	if fiat == "" {
+		return DefaultFiat
+	}
+	return fiat
+}
+
+//Imposta la valuta della chat (vuota per quella di default, FiatOff per nessuna)
+func (db *DBnode) SetChatFiat(chatID int64, fiat string) error {
+	log.Println("SetChatFiat:", chatID, fiat)
+	_, err := db.DB.Exec("UPDATE `chatdata` SET `Fiat` = ? WHERE `ChatID` = ?", fiat, chatID)
+	if err != nil {
+		dbError("SetChatFiat", err)
+	}
+	return err
+}
+
+//Ritorna i prezzi dei simboli nella valuta della chat e la valuta, nil se i prezzi non sono
+//configurati (PRICE_URL), la chat non li vuole o non ne abbiamo
+func (env *Env) ChatPrices(chatID int64, symbols []string) (map[string]float64, string) {
+	if env.Prices == nil {
+		return nil, ""
+	}
+	fiat := env.Db.GetChatFiat(chatID)
+	if fiat == FiatOff {
+		return nil, ""
+	}
+	prices, _ := env.Prices.GetPrices(symbols, fiat)
+	if len(prices) == 0 {
+		return nil, ""
+	}
+	return prices, fiat
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	base58Alphabet  = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	base58Version   = byte(0) //versione usata da incognito per le chiavi
+	checkSumLen     = 4
+	incPubKeyLen    = 32
+	BlsMiningKeyPfx = "bls:"
+)
+
+var (
+	ErrBase58Char     = errors.New("invalid base58 character")
+	ErrBase58CheckSum = errors.New("invalid checksum")
+	ErrBase58Version  = errors.New("invalid version byte")
+	ErrPubKeyLen      = errors.New("invalid public key length")
+)
+
+//decodifica una stringa base58 (alfabeto bitcoin)
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, ErrBase58Char
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	decoded := n.Bytes()
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), decoded...), nil
+}
+
+//ritorna i checksum accettati da incognito: sha3 (nuovo) e doppio sha256 (vecchio)
+func base58CheckSums(data []byte) [][]byte {
+	h3 := sha3.Sum256(data)
+	h1 := sha256.Sum256(data)
+	h2 := sha256.Sum256(h1[:])
+	return [][]byte{h3[:checkSumLen], h2[:checkSumLen]}
+}
+
+//decodifica una stringa base58check ritornando versione e dati
+func base58CheckDecode(s string) (byte, []byte, error) {
+	decoded, err := base58Decode(s)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(decoded) < 1+checkSumLen {
+		return 0, nil, ErrBase58CheckSum
+	}
+	data := decoded[:len(decoded)-checkSumLen]
+	cksum := decoded[len(decoded)-checkSumLen:]
+	for _, expected := range base58CheckSums(data) {
+		if bytes.Equal(cksum, expected) {
+			return data[0], data[1:], nil
+		}
+	}
+	return 0, nil, ErrBase58CheckSum
+}
+
+//controlla che pubkey sia una public key incognito valida (base58check, versione 0, 32 byte)
+func ValidateIncPubKey(pubkey string) error {
+	version, payload, err := base58CheckDecode(pubkey)
+	if err != nil {
+		return fmt.Errorf("public key %q: %s", pubkey, err)
+	}
+	if version != base58Version {
+		return fmt.Errorf("public key %q: %s %d", pubkey, ErrBase58Version, version)
+	}
+	if len(payload) != incPubKeyLen {
+		return fmt.Errorf("public key %q: %s %d", pubkey, ErrPubKeyLen, len(payload))
+	}
+	return nil
+}
+
+//ritorna vero se la chiave passata è una chiave di mining bls ("bls:...")
+func IsBlsMiningKey(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), BlsMiningKeyPfx)
+}
+
+//cerca la chiave di mining bls nella lista AutoStaking del beacon state e ritorna la TPubKeyAuto o nil
+func FindPubKeyByBls(bbsd *BBSD, bls string) *TPubKeyAuto {
+	if IsBlsMiningKey(bls) {
+		bls = bls[len(BlsMiningKeyPfx):]
+	}
+	if tpka := bbsd.Index().LookupBls(bls); tpka != nil {
+		pka := *tpka
+		return &pka
+	}
+	return nil
+}
+
+// Chiave risolta da /addkey: public key incognito più le informazioni trovate nel beacon state
+type ResolvedKey struct {
+	IncPubKey string
+	Status    string       //stato nel beacon state, "" se non abbiamo il beacon state
+	Info      *TPubKeyInfo //nil se la chiave non è nel beacon state
+}
+
+//ritorna vero se la chiave è presente nel beacon state
+func (rk *ResolvedKey) Known() bool {
+	return rk.Info != nil
+}
+
+//valida la chiave passata dall'utente (public key incognito o chiave di mining "bls:...") e
+//la risolve nella public key incognito usando il beacon state bbsd, che può essere nil se non disponibile
+func ResolvePubKey(bbsd *BBSD, key string) (*ResolvedKey, error) {
+	rk := &ResolvedKey{IncPubKey: key}
+	if IsBlsMiningKey(key) {
+		if bbsd == nil {
+			return nil, errors.New("cannot resolve a BLS mining key without the beacon state")
+		}
+		tpka := FindPubKeyByBls(bbsd, key)
+		if tpka == nil {
+			return nil, fmt.Errorf("BLS mining key %q not found in AutoStaking", key)
+		}
+		rk.IncPubKey = tpka.IncPubKey
+	} else if err := ValidateIncPubKey(key); err != nil {
+		return nil, err
+	}
+	if bbsd != nil {
+		rk.Status, rk.Info = GetPubKeyStatus(bbsd, rk.IncPubKey)
+	}
+	return rk, nil
+}
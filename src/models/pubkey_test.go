@@ -0,0 +1,71 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+)
+
+//codifica in base58check con il checksum sha3 usato da incognito, solo per i test
+func base58CheckEncode(version byte, payload []byte) string {
+	data := append([]byte{version}, payload...)
+	data = append(data, base58CheckSums(data)[0]...)
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	out := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append([]byte{base58Alphabet[mod.Int64()]}, out...)
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append([]byte{base58Alphabet[0]}, out...)
+	}
+	return string(out)
+}
+
+func TestValidateIncPubKey(t *testing.T) {
+	payload := make([]byte, incPubKeyLen)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	valid := base58CheckEncode(base58Version, payload)
+	if err := ValidateIncPubKey(valid); err != nil {
+		t.Errorf("valid key %s: %s", valid, err)
+	}
+
+	tests := map[string]string{
+		"empty":        "",
+		"bad char":     valid[:10] + "0" + valid[11:],
+		"bad checksum": valid[:len(valid)-1] + string(base58Alphabet[(len(valid))%58]),
+		"bad version":  base58CheckEncode(1, payload),
+		"short":        base58CheckEncode(base58Version, payload[:20]),
+	}
+	for name, key := range tests {
+		if key == valid {
+			continue
+		}
+		if err := ValidateIncPubKey(key); err == nil {
+			t.Errorf("%s: %q accepted", name, key)
+		}
+	}
+}
+
+func TestFindPubKeyByBls(t *testing.T) {
+	bbsd := &BBSD{}
+	bbsd.Result.AutoStaking = []TPubKeyAuto{
+		{IncPubKey: "inc1", MiningPubKey: TMiningPubKey{Bls: "blsA"}, IsAutoStake: true},
+		{IncPubKey: "inc2", MiningPubKey: TMiningPubKey{Bls: "blsB"}},
+	}
+	if tpka := FindPubKeyByBls(bbsd, "bls:blsB"); tpka == nil || tpka.IncPubKey != "inc2" {
+		t.Errorf("bls:blsB: got %+v", tpka)
+	}
+	if tpka := FindPubKeyByBls(bbsd, "blsA"); tpka == nil || tpka.IncPubKey != "inc1" {
+		t.Errorf("blsA: got %+v", tpka)
+	}
+	if tpka := FindPubKeyByBls(bbsd, "bls:missing"); tpka != nil {
+		t.Errorf("bls:missing: got %+v", tpka)
+	}
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+type rewardEntry struct {
+	reward TMinerReward
+	ts     time.Time
+}
+
+type beaconEntry struct {
+	bbsd BBSD
+	ts   time.Time
+}
+
+// Reward e stato del beacon già letti, riusati per RewardTTL e BeaconTTL
+type RPCCache struct {
+	RewardTTL time.Duration
+	BeaconTTL time.Duration
+	mutex     sync.Mutex
+	rewards   map[string]rewardEntry //per url del fullnode e chiave bls
+	beacons   map[string]beaconEntry //per url e credenziali del nodo
+}
+
+func NewRPCCache(rewardTTL, beaconTTL time.Duration) *RPCCache {
+	return &RPCCache{
+		RewardTTL: rewardTTL,
+		BeaconTTL: beaconTTL,
+		rewards:   map[string]rewardEntry{},
+		beacons:   map[string]beaconEntry{},
+	}
+}
+
+//Come GetBeaconBestStateDetail ma riusa per BeaconTTL lo stato già letto dallo stesso nodo.
+//Lo stato è condiviso: non va modificato.
+func (rc *RPCCache) GetBeaconSnapshot(node RPCNode, bbsd *BBSD) error {
+	key := node.cacheKey()
+	rc.mutex.Lock()
+	entry, ok := rc.beacons[key]
+	rc.mutex.Unlock()
+	if ok && time.Since(entry.ts) < rc.BeaconTTL {
+		*bbsd = entry.bbsd
+		return nil
+	}
+	fresh := BBSD{}
+	if err := node.GetBeaconBestStateDetail(&fresh); err != nil {
+		return err
+	}
+	rc.mutex.Lock()
+	for k, e := range rc.beacons { //togliamo quelli scaduti, anche dei nodi delle chat che non vengono più letti
+		if time.Since(e.ts) >= rc.BeaconTTL {
+			delete(rc.beacons, k)
+		}
+	}
+	rc.beacons[key] = beaconEntry{bbsd: fresh, ts: time.Now()}
+	rc.mutex.Unlock()
+	*bbsd = fresh
+	return nil
+}
+
+//Ritorna i reward della chiave bls (senza prefisso "bls:"), dalla cache se letti da meno di RewardTTL
+func (rc *RPCCache) GetMinerReward(reqUrl, bls string) (TMinerReward, error) {
+	key := reqUrl + "|" + bls
+	rc.mutex.Lock()
+	entry, ok := rc.rewards[key]
+	rc.mutex.Unlock()
+	if ok && time.Since(entry.ts) < rc.RewardTTL {
+		return entry.reward.copy(), nil
+	}
+	mrfmk := MRFMK{}
+	if err := GetMinerRewardFromMiningKey(reqUrl, "bls:"+bls, &mrfmk); err != nil {
+		return nil, err
+	}
+	rc.mutex.Lock()
+	for k, e := range rc.rewards { //togliamo quelli scaduti
+		if time.Since(e.ts) >= rc.RewardTTL {
+			delete(rc.rewards, k)
+		}
+	}
+	rc.rewards[key] = rewardEntry{reward: mrfmk.Result, ts: time.Now()}
+	rc.mutex.Unlock()
+	return mrfmk.Result.copy(), nil
+}
+
+//Legge i reward delle chiavi bls con fetch, al massimo workers in parallelo.
+//Ritorna i reward per chiave bls, le chiavi in errore mancano.
+func getMinerRewards(workers int, blsKeys []string, fetch func(bls string) (TMinerReward, error)) map[string]TMinerReward {
+	rewards := map[string]TMinerReward{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	if len(blsKeys) < workers {
+		workers = len(blsKeys)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bls := range jobs {
+				reward, err := fetch(bls)
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				rewards[bls] = reward
+				mutex.Unlock()
+			}
+		}()
+	}
+	seen := map[string]bool{}
+	for _, bls := range blsKeys {
+		if bls == "" || seen[bls] {
+			continue
+		}
+		seen[bls] = true
+		jobs <- bls
+	}
+	close(jobs)
+	wg.Wait()
+	return rewards
+}
+
+func (mr TMinerReward) copy() TMinerReward {
+	c := TMinerReward{}
+	for id, val := range mr {
+		c[id] = val
+	}
+	return c
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetMinerRewards(t *testing.T) {
+	var calls, running, maxRunning int32
+	var mutex sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&running, 1)
+		mutex.Lock()
+		if n > maxRunning {
+			maxRunning = n
+		}
+		mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		req := struct{ Params []string }{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.HasSuffix(req.Params[0], "bad") {
+			http.Error(w, "no", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Result": map[string]int64{"PRV": int64(len(req.Params[0]))}})
+	}))
+	defer srv.Close()
+
+	const workers = 4
+	env := &Env{REWARD_WORKERS: workers, RPCCache: NewRPCCache(time.Minute, time.Minute), FullnodePool: NewEndpointPool("test", []string{srv.URL})}
+	keys := []string{"bad"}
+	for i := 0; i < 3*workers; i++ {
+		keys = append(keys, strings.Repeat("k", i+1))
+	}
+	keys = append(keys, "k") //doppione
+	rewards := env.GetMinerRewards(keys)
+	if len(rewards) != 3*workers {
+		t.Fatalf("got %d rewards", len(rewards))
+	}
+	if reward := rewards["kkk"]; reward.GetPRV() != int64(len("bls:kkk")) {
+		t.Errorf("wrong reward %v", reward)
+	}
+	if maxRunning > workers {
+		t.Errorf("%d requests in parallel, max %d", maxRunning, workers)
+	}
+	if calls != int32(3*workers+1) {
+		t.Errorf("%d calls, want %d", calls, 3*workers+1)
+	}
+	env.GetMinerRewards(keys[1:])
+	if calls != int32(3*workers+1) {
+		t.Errorf("cache not used: %d calls", calls)
+	}
+}
+
+func TestBeaconSnapshotEviction(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"Result":{"BeaconHeight":100,"Epoch":2,"AutoStaking":[{"IncPubKey":"inc1","IsAutoStake":true}]}}`))
+	}))
+	defer srv.Close()
+	cache := NewRPCCache(time.Minute, time.Minute)
+	cache.beacons["http://stale.example"] = beaconEntry{ts: time.Now().Add(-2 * cache.BeaconTTL)}
+	for i := 0; i < 2; i++ {
+		bbsd := BBSD{}
+		if err := cache.GetBeaconSnapshot(RPCNode{URL: srv.URL}, &bbsd); err != nil || bbsd.Result.BeaconHeight != 100 {
+			t.Fatalf("got %+v %v", bbsd.Result.BeaconHeight, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("cache not used: %d calls", calls)
+	}
+	if _, stale := cache.beacons["http://stale.example"]; stale {
+		t.Errorf("expired beacon state not evicted")
+	}
+}
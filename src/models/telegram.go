@@ -5,15 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func (env *Env) SayText(chatID int64, text string) error {
-	myClient := &http.Client{Timeout: 10 * time.Second}
+	myClient := &http.Client{Timeout: RPCTimeout}
 	// Create the request body struct
 	reqBody := &sendMessageReqBody{
 		ChatID: chatID,
@@ -36,12 +40,16 @@ func (env *Env) SayText(chatID int64, text string) error {
 	}
 	req.Header.Add("Content-Type", "application/json; charset=UTF-8")
 	// Send a post request with your token
+	start := time.Now()
 	res, err := myClient.Do(req)
-	defer res.Body.Close()
+	TelegramRequestDuration.WithLabelValues("sendMessage").Observe(time.Since(start).Seconds())
 	if err != nil {
+		TelegramRequestErrors.WithLabelValues("sendMessage").Inc()
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
+		TelegramRequestErrors.WithLabelValues("sendMessage").Inc()
 		return errors.New("unexpected status" + res.Status)
 	}
 	return nil
@@ -52,6 +60,161 @@ func (env *Env) SayErr(chatID int64, err error) error {
 	return env.SayText(chatID, text)
 }
 
+// Risposta generica delle API telegram
+// https://core.telegram.org/bots/api#making-requests
+type apiResponse struct {
+	Ok          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+	ErrorCode   int             `json:"error_code"`
+}
+
+//chiama il metodo method delle API telegram con reqBody in json e decodifica il result in result (se non nil)
+func (env *Env) apiCall(method string, reqBody interface{}, result interface{}) error {
+	myClient := &http.Client{Timeout: RPCTimeout}
+	reqBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", env.GetApiUrl(method), bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json; charset=UTF-8")
+	return env.doApiRequest(myClient, method, req, result)
+}
+
+//esegue la richiesta req al metodo method e decodifica il result, registrando latenza ed errori
+func (env *Env) doApiRequest(myClient *http.Client, method string, req *http.Request, result interface{}) error {
+	start := time.Now()
+	res, err := myClient.Do(req)
+	TelegramRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		TelegramRequestErrors.WithLabelValues(method).Inc()
+		return err
+	}
+	defer res.Body.Close()
+	apiRes := apiResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&apiRes); err != nil {
+		TelegramRequestErrors.WithLabelValues(method).Inc()
+		return err
+	}
+	if !apiRes.Ok {
+		TelegramRequestErrors.WithLabelValues(method).Inc()
+		return fmt.Errorf("%s: %d %s", method, apiRes.ErrorCode, apiRes.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(apiRes.Result, result)
+}
+
+// https://core.telegram.org/bots/api#deletemessage
+func (env *Env) DeleteMessage(chatID, messageID int64) error {
+	return env.apiCall("deleteMessage", map[string]int64{"chat_id": chatID, "message_id": messageID}, nil)
+}
+
+// https://core.telegram.org/bots/api#senddocument
+func (env *Env) SendDocument(chatID int64, filename string, data []byte, caption string) error {
+	myClient := &http.Client{Timeout: 30 * time.Second}
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	w.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	if caption != "" {
+		w.WriteField("caption", caption)
+	}
+	fw, err := w.CreateFormFile("document", filename)
+	if err != nil {
+		return err
+	}
+	if _, err = fw.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	log.Printf("sendDocument: %d %s %d bytes\n", chatID, filename, len(data))
+	req, err := http.NewRequest("POST", env.GetApiUrl("sendDocument"), buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", w.FormDataContentType())
+	return env.doApiRequest(myClient, "sendDocument", req, nil)
+}
+
+// https://core.telegram.org/bots/api#file
+type TgFile struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size"`
+	FilePath string `json:"file_path"`
+}
+
+// https://core.telegram.org/bots/api#getfile
+func (env *Env) GetFile(fileID string) (*TgFile, error) {
+	reqBody := struct {
+		FileID string `json:"file_id"`
+	}{fileID}
+	file := &TgFile{}
+	if err := env.apiCall("getFile", reqBody, file); err != nil {
+		log.Println("GetFile error:", err)
+		return nil, err
+	}
+	return file, nil
+}
+
+//scarica il contenuto di un file ottenuto con GetFile, al massimo maxSize byte
+func (env *Env) DownloadFile(file *TgFile, maxSize int64) ([]byte, error) {
+	if file.FileSize > maxSize {
+		return nil, fmt.Errorf("file too big: %d bytes, max %d", file.FileSize, maxSize)
+	}
+	myClient := &http.Client{Timeout: 30 * time.Second}
+	start := time.Now()
+	res, err := myClient.Get(env.FILE_API + env.TOKEN + "/" + file.FilePath)
+	TelegramRequestDuration.WithLabelValues("downloadFile").Observe(time.Since(start).Seconds())
+	if err != nil {
+		TelegramRequestErrors.WithLabelValues("downloadFile").Inc()
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		TelegramRequestErrors.WithLabelValues("downloadFile").Inc()
+		return nil, errors.New("unexpected status" + res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		TelegramRequestErrors.WithLabelValues("downloadFile").Inc()
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file too big, max %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// https://core.telegram.org/bots/api#chatmember
+type ChatMember struct {
+	Status string `json:"status"`
+}
+
+//ritorna vero se il membro è creatore o amministratore della chat
+func (cm *ChatMember) IsAdmin() bool {
+	return cm.Status == "creator" || cm.Status == "administrator"
+}
+
+// https://core.telegram.org/bots/api#getchatmember
+func (env *Env) GetChatMember(chatID, userID int64) (*ChatMember, error) {
+	reqBody := struct {
+		ChatID int64 `json:"chat_id"`
+		UserID int64 `json:"user_id"`
+	}{chatID, userID}
+	cm := &ChatMember{}
+	if err := env.apiCall("getChatMember", reqBody, cm); err != nil {
+		log.Println("GetChatMember error:", err)
+		return nil, err
+	}
+	return cm, nil
+}
+
 // Create a struct that mimics the webhook response body
 // https://core.telegram.org/bots/api#update
 type webhookReqBody struct {
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TokenRefreshInterval = 6 * time.Hour //ogni quanto rileggere la lista dei token dal fullnode
+	DefaultTokenDecimals = 9             //decimali di un token se il fullnode non li dice
+)
+
+// Token della chain salvato nella tabella tokens
+type Token struct {
+	ID        string
+	Symbol    string
+	Name      string
+	Decimals  int
+	Timestamp int64
+}
+
+// Token come torna da listprivacycustomtoken, i decimali solo se il nodo li fornisce
+type TListCustomToken struct {
+	ID        string
+	Name      string
+	Symbol    string
+	PDecimals *int
+	Decimals  *int
+}
+
+type TListCustomTokenResult struct {
+	ListCustomToken []TListCustomToken
+}
+
+type LPCT struct {
+	Id      int
+	Result  TListCustomTokenResult
+	Error   interface{}
+	Params  []string
+	Method  string
+	Jsonrpc string
+}
+
+// Registro in memoria dei token letti dal DB, consultato da COINS prima della lista statica
+type TokenRegistry struct {
+	mutex  sync.RWMutex
+	byID   map[string]COIN
+	byName map[string]COIN
+}
+
+var TOKENS = &TokenRegistry{}
+
+//sostituisce i token del registro. I nomi restano univoci: vincono quelli della lista statica,
+//un simbolo già usato da un altro token diventa SIMBOLO(prefisso id)
+func (tr *TokenRegistry) Set(tokens []Token) {
+	byID := map[string]COIN{}
+	byName := map[string]COIN{}
+	for _, coin := range BIG_COINS {
+		byName[coin.Name] = coin
+	}
+	for _, token := range tokens {
+		name := strings.TrimSpace(token.Symbol)
+		if name == "" {
+			name = strings.TrimSpace(token.Name)
+		}
+		if static := BIG_COINS.getStaticByID(token.ID); static != nil {
+			name = static.Name
+		} else if other, ok := byName[name]; name == "" || (ok && other.ID != token.ID) {
+			name = fmt.Sprintf("%s(%s)", name, shortID(token.ID))
+		}
+		coin := COIN{Name: name, ID: token.ID, Decimals: token.Decimals}
+		byID[token.ID] = coin
+		byName[name] = coin
+	}
+	tr.mutex.Lock()
+	tr.byID = byID
+	tr.byName = byName
+	tr.mutex.Unlock()
+}
+
+//ritorna il token con quell'id se nel registro
+func (tr *TokenRegistry) ByID(id string) (COIN, bool) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	coin, ok := tr.byID[id]
+	return coin, ok
+}
+
+//ritorna il token con quel nome se nel registro
+func (tr *TokenRegistry) ByName(name string) (COIN, bool) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	coin, ok := tr.byName[name]
+	return coin, ok
+}
+
+//numero di token nel registro
+func (tr *TokenRegistry) Len() int {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	return len(tr.byID)
+}
+
+func shortID(id string) string {
+	if len(id) > 6 {
+		return id[:6]
+	}
+	return id
+}
+
+//decimali di un token del fullnode: quelli forniti, quelli della lista statica o il default
+func (lct *TListCustomToken) decimals() int {
+	switch {
+	case lct.PDecimals != nil:
+		return *lct.PDecimals
+	case lct.Decimals != nil:
+		return *lct.Decimals
+	}
+	if static := BIG_COINS.getStaticByID(lct.ID); static != nil {
+		return static.Decimals
+	}
+	return DefaultTokenDecimals
+}
+
+func GetPrivacyCustomTokens(reqUrl string, lpct *LPCT) error {
+	myClient := &http.Client{Timeout: 3 * RPCTimeout} //la lista dei token è lunga
+	req, err := RPCNode{URL: reqUrl}.newRequest("listprivacycustomtoken", "[]")
+	if err != nil {
+		return err
+	}
+
+	err = getJson(myClient, req, "listprivacycustomtoken", &lpct)
+	if err != nil {
+		return err
+	}
+	if lpct.Error != nil {
+		return fmt.Errorf("listprivacycustomtoken: %v", lpct.Error)
+	}
+	log.Printf("Result.ListCustomToken: %d\n", len(lpct.Result.ListCustomToken))
+	return err
+}
+
+//Recupera i token salvati
+func (db *DBnode) GetTokens() ([]Token, error) {
+	tokens := []Token{}
+	rows, err := db.DB.Query("SELECT `ID`, `Symbol`, `Name`, `Decimals`, `Timestamp` FROM `tokens` ORDER BY `ID`")
+	if err != nil {
+		dbError("GetTokens", err)
+		return tokens, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		token := Token{}
+		if err = rows.Scan(&token.ID, &token.Symbol, &token.Name, &token.Decimals, &token.Timestamp); err != nil {
+			dbError("GetTokens", err)
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+	err = rows.Err()
+	if err != nil {
+		dbError("GetTokens", err)
+	}
+	return tokens, err
+}
+
+//Salva (o aggiorna) i token in un'unica transazione
+func (db *DBnode) SaveTokens(tokens []Token) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		dbError("SaveTokens", err)
+		return err
+	}
+	for _, token := range tokens {
+		_, err = tx.Exec("INSERT OR REPLACE INTO `tokens`(`ID`,`Symbol`,`Name`,`Decimals`,`Timestamp`) VALUES (?,?,?,?,?)", token.ID, token.Symbol, token.Name, token.Decimals, token.Timestamp)
+		if err != nil {
+			dbError("SaveTokens", err)
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		dbError("SaveTokens", err)
+	}
+	return err
+}
+
+//Ritorna il timestamp dell'ultimo aggiornamento dei token, 0 se mai
+func (db *DBnode) GetTokensTimestamp() int64 {
+	var ts int64
+	if err := db.DB.QueryRow("SELECT IFNULL(MAX(`Timestamp`), 0) FROM `tokens`").Scan(&ts); err != nil {
+		dbError("GetTokensTimestamp", err)
+	}
+	return ts
+}
+
+//Carica nel registro TOKENS i token del DB, rileggendoli prima dal fullnode se più vecchi di TokenRefreshInterval.
+//Se il fullnode non risponde restano quelli già salvati (o la lista statica).
+func (env *Env) RefreshTokens() error {
+	var err error
+	if time.Since(GetTSTime(env.Db.GetTokensTimestamp())) >= TokenRefreshInterval {
+		lpct := LPCT{}
+		err = env.FullnodePool.Do(func(reqUrl string) error {
+			lpct = LPCT{}
+			return GetPrivacyCustomTokens(reqUrl, &lpct)
+		})
+		if err != nil {
+			log.Println("RefreshTokens error:", err)
+		} else {
+			ts := MakeTSFromTime(time.Now())
+			tokens := make([]Token, 0, len(lpct.Result.ListCustomToken))
+			for _, lct := range lpct.Result.ListCustomToken {
+				if lct.ID == "" {
+					continue
+				}
+				tokens = append(tokens, Token{ID: lct.ID, Symbol: lct.Symbol, Name: lct.Name, Decimals: lct.decimals(), Timestamp: ts})
+			}
+			err = env.Db.SaveTokens(tokens)
+		}
+	}
+	tokens, errdb := env.Db.GetTokens()
+	if errdb != nil {
+		return errdb
+	}
+	TOKENS.Set(tokens)
+	log.Printf("RefreshTokens: %d tokens\n", TOKENS.Len())
+	return err
+}
@@ -0,0 +1,36 @@
+package models
+
+import "testing"
+
+func TestTokenRegistry(t *testing.T) {
+	defer TOKENS.Set(nil)
+	const fakeBTC = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	const newToken = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	usdt := BIG_COINS.GetCoinByName("USDT").ID
+	TOKENS.Set([]Token{
+		{ID: usdt, Symbol: "pUSDT", Decimals: 6},
+		{ID: fakeBTC, Symbol: "BTC", Decimals: 9},
+		{ID: newToken, Symbol: "NEW", Decimals: 4},
+	})
+	tests := []struct {
+		id, name string
+		decimals int
+	}{
+		{usdt, "USDT", 6},
+		{fakeBTC, "BTC(aaaaaa)", 9},
+		{newToken, "NEW", 4},
+		{PRV_ID, "PRV", 9},
+	}
+	for _, tt := range tests {
+		if got := BIG_COINS.GetNameByID(tt.id); got != tt.name {
+			t.Errorf("GetNameByID(%s) = %q, want %q", shortID(tt.id), got, tt.name)
+		}
+		coin := BIG_COINS.GetCoinByName(tt.name)
+		if coin.ID != tt.id || coin.Decimals != tt.decimals {
+			t.Errorf("GetCoinByName(%q) = %+v, want id %s decimals %d", tt.name, coin, shortID(tt.id), tt.decimals)
+		}
+	}
+	if got := BIG_COINS.GetAmount("NEW", 12345).String(); got != "1.2345" {
+		t.Errorf("GetAmount(NEW) = %s", got)
+	}
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"log"
+	"time"
+)
+
+const UpdatesRetention = 48 * time.Hour //telegram riprova un update al massimo per 24 ore
+
+//Registra l'update come ricevuto, ritorna false se lo era già (rispedito da telegram)
+func (db *DBnode) MarkUpdate(updateID, chatID int64) (bool, error) {
+	res, err := db.DB.Exec("INSERT OR IGNORE INTO `updates`(`UpdateID`,`ChatID`,`Timestamp`) VALUES (?,?,?)", updateID, chatID, MakeTSFromTime(time.Now()))
+	if err != nil {
+		dbError("MarkUpdate", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		dbError("MarkUpdate", err)
+		return false, err
+	}
+	return n == 1, nil
+}
+
+//Dimentica un update registrato con MarkUpdate, così una nuova consegna verrà elaborata
+func (db *DBnode) UnmarkUpdate(updateID int64) error {
+	_, err := db.DB.Exec("DELETE FROM `updates` WHERE `UpdateID` = ?", updateID)
+	if err != nil {
+		dbError("UnmarkUpdate", err)
+	}
+	return err
+}
+
+//Elimina gli update ricevuti prima di UpdatesRetention fa
+func (db *DBnode) PruneUpdates() error {
+	res, err := db.DB.Exec("DELETE FROM `updates` WHERE `Timestamp` < ?", MakeTSFromTime(time.Now().Add(-UpdatesRetention)))
+	if err != nil {
+		dbError("PruneUpdates", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Println("PruneUpdates:", n)
+	}
+	return nil
+}
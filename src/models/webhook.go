@@ -0,0 +1,137 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// https://core.telegram.org/bots/api#webhookinfo
+type WebhookInfo struct {
+	URL                  string   `json:"url"`
+	HasCustomCertificate bool     `json:"has_custom_certificate"`
+	PendingUpdateCount   int      `json:"pending_update_count"`
+	IPAddress            string   `json:"ip_address"`
+	LastErrorDate        int64    `json:"last_error_date"`
+	LastErrorMessage     string   `json:"last_error_message"`
+	MaxConnections       int      `json:"max_connections"`
+	AllowedUpdates       []string `json:"allowed_updates"`
+}
+
+//ritorna l'url del webhook da registrare presso telegram, vuoto se PUBLIC_URL non è impostato
+func (env *Env) WebhookURL() string {
+	if env.PUBLIC_URL == "" {
+		return ""
+	}
+	return env.PUBLIC_URL + "/telegram" + env.TGTOKEN + "/"
+}
+
+// https://core.telegram.org/bots/api#setwebhook
+func (env *Env) SetWebhook() error {
+	webhookURL := env.WebhookURL()
+	if webhookURL == "" || env.TGTOKEN == "" {
+		return errors.New("setWebhook: public_url and tgtoken are required")
+	}
+	allowed, err := json.Marshal(env.ALLOWED_UPDATES)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	w.WriteField("url", webhookURL)
+	w.WriteField("allowed_updates", string(allowed))
+	if env.WEBHOOK_SECRET != "" {
+		w.WriteField("secret_token", env.WEBHOOK_SECRET)
+	}
+	if env.UPLOAD_CERT {
+		cert, err := ioutil.ReadFile(env.CERT_FILE)
+		if err != nil {
+			return err
+		}
+		fw, err := w.CreateFormFile("certificate", filepath.Base(env.CERT_FILE))
+		if err != nil {
+			return err
+		}
+		if _, err = fw.Write(cert); err != nil {
+			return err
+		}
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	log.Printf("setWebhook: %s/telegram****/ certificate: %t allowed: %s\n", env.PUBLIC_URL, env.UPLOAD_CERT, allowed)
+	req, err := http.NewRequest("POST", env.GetApiUrl("setWebhook"), buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", w.FormDataContentType())
+	return env.doApiRequest(&http.Client{Timeout: RPCTimeout}, "setWebhook", req, nil)
+}
+
+// https://core.telegram.org/bots/api#deletewebhook
+func (env *Env) DeleteWebhook(dropPending bool) error {
+	reqBody := struct {
+		DropPendingUpdates bool `json:"drop_pending_updates"`
+	}{dropPending}
+	return env.apiCall("deleteWebhook", reqBody, nil)
+}
+
+// https://core.telegram.org/bots/api#getwebhookinfo
+func (env *Env) GetWebhookInfo() (*WebhookInfo, error) {
+	info := &WebhookInfo{}
+	if err := env.apiCall("getWebhookInfo", struct{}{}, info); err != nil {
+		log.Println("GetWebhookInfo error:", err)
+		return nil, err
+	}
+	return info, nil
+}
+
+//Confronta il webhook registrato con quello atteso dalla configurazione e ritorna le differenze
+func (env *Env) WebhookMismatches(info *WebhookInfo) []string {
+	mismatches := []string{}
+	if expected := env.WebhookURL(); expected != "" && info.URL != expected {
+		if info.URL == "" {
+			mismatches = append(mismatches, "webhook not set")
+		} else {
+			mismatches = append(mismatches, "url differs from public_url/tgtoken")
+		}
+	}
+	if info.URL != "" && info.HasCustomCertificate != env.UPLOAD_CERT {
+		mismatches = append(mismatches, "custom certificate differs from upload_cert")
+	}
+	allowed := append([]string{}, info.AllowedUpdates...)
+	expected := append([]string{}, env.ALLOWED_UPDATES...)
+	sort.Strings(allowed)
+	sort.Strings(expected)
+	if info.URL != "" && len(allowed) > 0 && strings.Join(allowed, ",") != strings.Join(expected, ",") {
+		mismatches = append(mismatches, "allowed_updates differ: "+strings.Join(info.AllowedUpdates, ","))
+	}
+	return mismatches
+}
+
+//Descrizione del webhook senza la parte segreta dell'url
+func (info *WebhookInfo) String(tgtoken string) string {
+	url := info.URL
+	if tgtoken != "" {
+		url = strings.Replace(url, tgtoken, "****", 1)
+	}
+	text := fmt.Sprintf("url: %s\ncustom certificate: %t\npending updates: %d", url, info.HasCustomCertificate, info.PendingUpdateCount)
+	if len(info.AllowedUpdates) > 0 {
+		text += "\nallowed updates: " + strings.Join(info.AllowedUpdates, ",")
+	}
+	if info.IPAddress != "" {
+		text += "\nip address: " + info.IPAddress
+	}
+	if info.LastErrorDate > 0 {
+		text += "\nlast error: " + GetTSString(info.LastErrorDate) + " " + info.LastErrorMessage
+	}
+	return text
+}
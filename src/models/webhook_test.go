@@ -0,0 +1,21 @@
+package models
+
+import "testing"
+
+func TestWebhookMismatches(t *testing.T) {
+	env := &Env{TGTOKEN: "sec", PUBLIC_URL: "https://h:8443", UPLOAD_CERT: true, ALLOWED_UPDATES: []string{"message"}}
+	ok := &WebhookInfo{URL: "https://h:8443/telegramsec/", HasCustomCertificate: true, AllowedUpdates: []string{"message"}}
+	if got := env.WebhookMismatches(ok); len(got) != 0 {
+		t.Errorf("expected no mismatches, got %v", got)
+	}
+	wrong := &WebhookInfo{URL: "https://old:8443/telegramsec/", AllowedUpdates: []string{"message", "callback_query"}}
+	if got := env.WebhookMismatches(wrong); len(got) != 3 {
+		t.Errorf("expected 3 mismatches, got %v", got)
+	}
+	if got := env.WebhookMismatches(&WebhookInfo{}); len(got) != 1 || got[0] != "webhook not set" {
+		t.Errorf("expected webhook not set, got %v", got)
+	}
+	if s := ok.String("sec"); s != "url: https://h:8443/telegram****/\ncustom certificate: true\npending updates: 0\nallowed updates: message" {
+		t.Errorf("unexpected String: %q", s)
+	}
+}